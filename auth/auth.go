@@ -28,6 +28,8 @@ var (
 	ErrBadEditorName  = errshttp.NewError(http.StatusBadRequest, "Editor name should only contain alphanumeric characters")
 	ErrUnauthorized   = errshttp.NewError(http.StatusUnauthorized, "Unauthorized")
 
+	ErrNoNextPublicKey = errshttp.NewError(http.StatusBadRequest, "Editor has no public key rotation in progress")
+
 	ErrMissingPassphrase = errors.New("Missing passphrase")
 )
 
@@ -56,7 +58,10 @@ type (
 		masterSalt         []byte
 		publicKeyBytes     []byte
 		publicKey          *rsa.PublicKey
+		nextPublicKeyBytes []byte
+		nextPublicKey      *rsa.PublicKey
 		autoPublication    bool
+		signingRequired    bool
 		revocationCounters map[string]int
 	}
 )
@@ -187,6 +192,40 @@ func (r *EditorRegistry) CreateEditorWithoutPublicKey(editorName string, autoPub
 	return editor, nil
 }
 
+// SetNextPublicKey starts the rotation of the public key of the editor: the
+// signatures made with the given key are accepted, in addition to the ones
+// made with the current key, until PromoteNextPublicKey is called.
+func (r *EditorRegistry) SetNextPublicKey(editor *Editor, publicKeyBytes []byte) error {
+	publicKey, err := unmarshalPublicKey(publicKeyBytes)
+	if err != nil {
+		return err
+	}
+	editor.nextPublicKeyBytes = publicKeyBytes
+	editor.nextPublicKey = publicKey
+	return r.UpdateEditor(editor)
+}
+
+// PromoteNextPublicKey ends the rotation of the public key of the editor:
+// the next key replaces the current one, whose signatures are not accepted
+// anymore.
+func (r *EditorRegistry) PromoteNextPublicKey(editor *Editor) error {
+	if len(editor.nextPublicKeyBytes) == 0 {
+		return ErrNoNextPublicKey
+	}
+	editor.publicKeyBytes = editor.nextPublicKeyBytes
+	editor.publicKey = editor.nextPublicKey
+	editor.nextPublicKeyBytes = nil
+	editor.nextPublicKey = nil
+	return r.UpdateEditor(editor)
+}
+
+// SetSigningRequired sets whether the versions published by the editor must
+// have a detached signature, made with one of its public keys.
+func (r *EditorRegistry) SetSigningRequired(editor *Editor, required bool) error {
+	editor.signingRequired = required
+	return r.UpdateEditor(editor)
+}
+
 func (r *EditorRegistry) RevokeMasterTokens(editor *Editor) error {
 	editor.masterSalt = readRand(saltsLen)
 	return r.UpdateEditor(editor)
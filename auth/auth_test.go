@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+// memoryVault is a Vault keeping the editors in memory.
+type memoryVault map[string]*Editor
+
+func (v memoryVault) GetEditor(editorName string) (*Editor, error) {
+	editor, ok := v[strings.ToLower(editorName)]
+	if !ok {
+		return nil, ErrEditorNotFound
+	}
+	return editor, nil
+}
+
+func (v memoryVault) CreateEditor(editor *Editor) error {
+	if _, ok := v[strings.ToLower(editor.name)]; ok {
+		return ErrEditorExists
+	}
+	v[strings.ToLower(editor.name)] = editor
+	return nil
+}
+
+func (v memoryVault) UpdateEditor(editor *Editor) error {
+	v[strings.ToLower(editor.name)] = editor
+	return nil
+}
+
+func (v memoryVault) DeleteEditor(editor *Editor) error {
+	delete(v, strings.ToLower(editor.name))
+	return nil
+}
+
+func (v memoryVault) AllEditors() ([]*Editor, error) {
+	editors := make([]*Editor, 0, len(v))
+	for _, editor := range v {
+		editors = append(editors, editor)
+	}
+	return editors, nil
+}
+
+func generateKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, publicKeyBytes
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, message []byte) []byte {
+	hashed := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestPublicKeyRotation(t *testing.T) {
+	reg, err := NewEditorRegistry(memoryVault{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentKey, currentPublicKey := generateKey(t)
+	nextKey, nextPublicKey := generateKey(t)
+	editor, err := reg.CreateEditorWithPublicKey("cozy", currentPublicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("sha256 of the tarball")
+	currentSignature := sign(t, currentKey, message)
+	nextSignature := sign(t, nextKey, message)
+	if !editor.VerifySignature(message, currentSignature) || editor.VerifySignature(message, nextSignature) {
+		t.Fatal("expected only the current key to be accepted before the rotation")
+	}
+	if err = reg.PromoteNextPublicKey(editor); err != ErrNoNextPublicKey {
+		t.Fatalf("expected ErrNoNextPublicKey, got %v", err)
+	}
+
+	if err = reg.SetNextPublicKey(editor, []byte("not a key")); err == nil {
+		t.Fatal("expected an invalid next public key to be rejected")
+	}
+	if err = reg.SetNextPublicKey(editor, nextPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	editor, err = reg.GetEditor("Cozy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !editor.VerifySignature(message, currentSignature) || !editor.VerifySignature(message, nextSignature) {
+		t.Fatal("expected both keys to be accepted during the rotation")
+	}
+	currentID, nextID := editor.PublicKeyID(), editor.NextPublicKeyID()
+	if currentID == "" || nextID == "" || currentID == nextID {
+		t.Fatalf("unexpected key ids %q and %q", currentID, nextID)
+	}
+	if !editor.VerifySignatureWithKeyID(nextID, message, nextSignature) ||
+		!editor.VerifySignatureWithKeyID("", message, nextSignature) ||
+		editor.VerifySignatureWithKeyID(currentID, message, nextSignature) ||
+		editor.VerifySignatureWithKeyID("unknown", message, currentSignature) {
+		t.Fatal("unexpected verification with the key ids")
+	}
+
+	if err = reg.PromoteNextPublicKey(editor); err != nil {
+		t.Fatal(err)
+	}
+	if editor.VerifySignature(message, currentSignature) || !editor.VerifySignature(message, nextSignature) {
+		t.Fatal("expected only the next key to be accepted after the rotation")
+	}
+	if editor.PublicKeyID() != nextID || editor.NextPublicKeyID() != "" {
+		t.Fatalf("unexpected key ids %q and %q after the rotation", editor.PublicKeyID(), editor.NextPublicKeyID())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -37,22 +38,28 @@ func (t *tokenData) UnmarshalJSON(data []byte) error {
 
 func (e *Editor) MarshalJSON() ([]byte, error) {
 	v := struct {
-		Name      string `json:"name"`
-		PublicKey string `json:"public_key,omitempty"`
+		Name          string `json:"name"`
+		PublicKey     string `json:"public_key,omitempty"`
+		NextPublicKey string `json:"next_public_key,omitempty"`
 	}{
-		Name:      e.name,
-		PublicKey: e.MarshalPublicKeyPEM(),
+		Name:          e.name,
+		PublicKey:     e.MarshalPublicKeyPEM(),
+		NextPublicKey: marshalPublicKeyPEM(e.nextPublicKeyBytes),
 	}
 	return json.Marshal(v)
 }
 
 func (e *Editor) MarshalPublicKeyPEM() string {
-	if len(e.publicKeyBytes) == 0 {
+	return marshalPublicKeyPEM(e.publicKeyBytes)
+}
+
+func marshalPublicKeyPEM(publicKeyBytes []byte) string {
+	if len(publicKeyBytes) == 0 {
 		return ""
 	}
 	block := &pem.Block{
 		Type:  pubKeyBlocType,
-		Bytes: e.publicKeyBytes,
+		Bytes: publicKeyBytes,
 	}
 	return string(pem.EncodeToMemory(block))
 }
@@ -65,22 +72,81 @@ func (e *Editor) AutoPublication() bool {
 	return e.autoPublication
 }
 
+// SigningRequired returns true if the versions published by the editor must
+// have a detached signature.
+func (e *Editor) SigningRequired() bool {
+	return e.signingRequired
+}
+
 func (e *Editor) IsComplete() bool {
 	return len(e.name) > 0 && len(e.editorSalt) == saltsLen
 }
 
+// VerifySignature checks the signature of the message with the public key
+// of the editor, or with its next public key during a rotation.
 func (e *Editor) VerifySignature(message, signature []byte) bool {
-	publicKey, err := e.PublicKey()
-	if err != nil {
-		return false
-	}
-
 	hash := sha256.New()
 	hash.Write(message)
 	hashed := hash.Sum(nil)
 
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed, signature)
-	return err == nil
+	if publicKey, err := e.PublicKey(); err == nil {
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed, signature) == nil {
+			return true
+		}
+	}
+	if nextPublicKey, err := e.NextPublicKey(); err == nil {
+		if rsa.VerifyPKCS1v15(nextPublicKey, crypto.SHA256, hashed, signature) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicKeyID returns the identifier of the public key of the editor, given
+// with the signatures to tell which key has been used. It is empty if the
+// editor has no public key.
+func (e *Editor) PublicKeyID() string {
+	return publicKeyID(e.publicKeyBytes)
+}
+
+// NextPublicKeyID returns the identifier of the next public key of the
+// editor, if a rotation is in progress.
+func (e *Editor) NextPublicKeyID() string {
+	return publicKeyID(e.nextPublicKeyBytes)
+}
+
+// publicKeyID is the hex encoding of the first 8 bytes of the sha256 of the
+// public key, as it is stored.
+func publicKeyID(publicKeyBytes []byte) string {
+	if len(publicKeyBytes) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(publicKeyBytes)
+	return hex.EncodeToString(sum[:8])
+}
+
+// VerifySignatureWithKeyID checks the signature of the message with the
+// public key of the editor identified by keyID, either the current or the next
+// one. An empty keyID is accepted for both keys, like VerifySignature.
+func (e *Editor) VerifySignatureWithKeyID(keyID string, message, signature []byte) bool {
+	switch keyID {
+	case "":
+		return e.VerifySignature(message, signature)
+	case e.PublicKeyID():
+		return verifyPKCS1v15(e.PublicKey, message, signature)
+	case e.NextPublicKeyID():
+		return verifyPKCS1v15(e.NextPublicKey, message, signature)
+	}
+	return false
+}
+
+func verifyPKCS1v15(getKey func() (*rsa.PublicKey, error), message, signature []byte) bool {
+	publicKey, err := getKey()
+	if err != nil {
+		return false
+	}
+	hashed := sha256.Sum256(message)
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature) == nil
 }
 
 func (e *Editor) GenerateMasterToken(masterSecret []byte, maxAge time.Duration) ([]byte, error) {
@@ -193,3 +259,18 @@ func (e *Editor) PublicKey() (*rsa.PublicKey, error) {
 	}
 	return e.publicKey, nil
 }
+
+// NextPublicKey returns the public key of the rotation in progress, if any.
+func (e *Editor) NextPublicKey() (*rsa.PublicKey, error) {
+	if len(e.nextPublicKeyBytes) == 0 {
+		return nil, errors.New("Editor has no next public key associated")
+	}
+	if e.nextPublicKey == nil {
+		var err error
+		e.nextPublicKey, err = unmarshalPublicKey(e.nextPublicKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.nextPublicKey, nil
+}
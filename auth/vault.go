@@ -19,7 +19,9 @@ type editorForCouchdb struct {
 	EditorSalt         []byte         `json:"session_secret_salt"`
 	MasterSalt         []byte         `json:"master_secret_salt"`
 	PublicKeyBytes     []byte         `json:"public_key"`
+	NextPublicKeyBytes []byte         `json:"next_public_key,omitempty"`
 	AutoPublication    bool           `json:"auto_publication"`
+	SigningRequired    bool           `json:"signing_required,omitempty"`
 	RevocationCounters map[string]int `json:"revocation_counters,omitempty"`
 }
 
@@ -41,7 +43,9 @@ func (r *couchdbVault) GetEditor(editorName string) (*Editor, error) {
 		editorSalt:         e.EditorSalt,
 		masterSalt:         e.MasterSalt,
 		publicKeyBytes:     e.PublicKeyBytes,
+		nextPublicKeyBytes: e.NextPublicKeyBytes,
 		autoPublication:    e.AutoPublication,
+		signingRequired:    e.SigningRequired,
 		revocationCounters: e.RevocationCounters,
 	}
 	var needUpdate bool
@@ -75,7 +79,9 @@ func (r *couchdbVault) CreateEditor(editor *Editor) error {
 		EditorSalt:         editor.editorSalt,
 		MasterSalt:         editor.masterSalt,
 		PublicKeyBytes:     editor.publicKeyBytes,
+		NextPublicKeyBytes: editor.nextPublicKeyBytes,
 		AutoPublication:    editor.autoPublication,
+		SigningRequired:    editor.signingRequired,
 		RevocationCounters: editor.revocationCounters,
 	})
 	return err
@@ -93,7 +99,9 @@ func (r *couchdbVault) UpdateEditor(editor *Editor) error {
 		EditorSalt:         editor.editorSalt,
 		MasterSalt:         editor.masterSalt,
 		PublicKeyBytes:     editor.publicKeyBytes,
+		NextPublicKeyBytes: editor.nextPublicKeyBytes,
 		AutoPublication:    editor.autoPublication,
+		SigningRequired:    editor.signingRequired,
 		RevocationCounters: editor.revocationCounters,
 	})
 	return err
@@ -130,7 +138,9 @@ func (r *couchdbVault) AllEditors() ([]*Editor, error) {
 			editorSalt:         e.EditorSalt,
 			masterSalt:         e.MasterSalt,
 			publicKeyBytes:     e.PublicKeyBytes,
+			nextPublicKeyBytes: e.NextPublicKeyBytes,
 			autoPublication:    e.AutoPublication,
+			signingRequired:    e.SigningRequired,
 			revocationCounters: e.RevocationCounters,
 		})
 	}
@@ -30,12 +30,20 @@ type Cache struct {
 	// MaxEntries is the maximum number of cache entries before
 	// an item is evicted. Zero means no limit.
 	MaxEntries int
+	// MaxBytes is the maximum total size of the values stored in the cache
+	// before an item is evicted. Zero means no limit.
+	MaxBytes int64
 	// TTL is the time-to-live of each entries in the cache.
 	TTL time.Duration
 
 	mu    sync.Mutex
 	ll    *list.List
 	cache map[Key]*list.Element
+	size  int64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
 type entry struct {
@@ -62,14 +70,17 @@ func (c *Cache) Add(key Key, value Value) {
 	defer c.mu.Unlock()
 	if ele, hit := c.cache[key]; hit {
 		c.ll.MoveToFront(ele)
+		c.size += int64(len(value)) - int64(len(ele.Value.(*entry).value))
 		ele.Value.(*entry).date = time.Now()
 		ele.Value.(*entry).value = value
 	} else {
 		ele := c.ll.PushFront(&entry{key, value, time.Now()})
 		c.cache[key] = ele
-		if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
-			c.RemoveOldest()
-		}
+		c.size += int64(len(value))
+	}
+	for (c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries) ||
+		(c.MaxBytes != 0 && c.size > c.MaxBytes) {
+		c.removeOldest()
 	}
 }
 
@@ -81,10 +92,13 @@ func (c *Cache) Get(key Key) (value Value, ok bool) {
 		if c.TTL == 0 || time.Since(ele.Value.(*entry).date) <= c.TTL {
 			c.ll.MoveToFront(ele)
 			ele.Value.(*entry).date = time.Now()
+			c.hits++
 			return ele.Value.(*entry).value, true
 		}
 		c.removeElement(ele)
+		c.evictions++
 	}
+	c.misses++
 	return
 }
 
@@ -101,8 +115,22 @@ func (c *Cache) Remove(key Key) {
 func (c *Cache) RemoveOldest() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.removeOldest()
+}
+
+// Stats returns the cumulative number of hits, misses and evictions of the
+// cache. Expired entries count as misses, and as evictions when they are
+// dropped.
+func (c *Cache) Stats() (hits, misses, evictions uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.evictions
+}
+
+func (c *Cache) removeOldest() {
 	if ele := c.ll.Back(); ele != nil {
 		c.removeElement(ele)
+		c.evictions++
 	}
 }
 
@@ -110,4 +138,5 @@ func (c *Cache) removeElement(e *list.Element) {
 	c.ll.Remove(e)
 	kv := e.Value.(*entry)
 	delete(c.cache, kv.key)
+	c.size -= int64(len(kv.value))
 }
@@ -28,3 +28,83 @@ func TestLRU(t *testing.T) {
 		t.Fatal("should have key", key)
 	}
 }
+
+func TestLRUStats(t *testing.T) {
+	lru := New(2, 100*time.Millisecond)
+	lru.Add("a", []byte("a"))
+	lru.Add("b", []byte("b"))
+
+	lru.Get("a")
+	lru.Get("b")
+	lru.Get("c")
+
+	if hits, misses, evictions := lru.Stats(); hits != 2 || misses != 1 || evictions != 0 {
+		t.Fatalf("unexpected stats: hits=%d misses=%d evictions=%d", hits, misses, evictions)
+	}
+
+	lru.Add("c", []byte("c"))
+	if _, ok := lru.Get("a"); ok {
+		t.Fatal("should not have key a")
+	}
+	if hits, misses, evictions := lru.Stats(); hits != 2 || misses != 2 || evictions != 1 {
+		t.Fatalf("unexpected stats: hits=%d misses=%d evictions=%d", hits, misses, evictions)
+	}
+
+	time.Sleep(101 * time.Millisecond)
+
+	if _, ok := lru.Get("c"); ok {
+		t.Fatal("should not have key c")
+	}
+	if hits, misses, evictions := lru.Stats(); hits != 2 || misses != 3 || evictions != 2 {
+		t.Fatalf("unexpected stats: hits=%d misses=%d evictions=%d", hits, misses, evictions)
+	}
+}
+
+func TestLRUMaxBytes(t *testing.T) {
+	lru := New(0, 0)
+	lru.MaxBytes = 10
+
+	lru.Add("a", []byte("1"))
+	lru.Add("b", []byte("22"))
+	lru.Add("c", []byte("333"))
+	lru.Add("d", []byte("4444"))
+
+	for _, key := range []Key{"a", "b", "c", "d"} {
+		if _, ok := lru.Get(key); !ok {
+			t.Fatal("should have key", key)
+		}
+	}
+
+	lru.Add("e", []byte("55555"))
+	for _, key := range []Key{"a", "b", "c"} {
+		if _, ok := lru.Get(key); ok {
+			t.Fatal("should not have key", key)
+		}
+	}
+	for _, key := range []Key{"d", "e"} {
+		if _, ok := lru.Get(key); !ok {
+			t.Fatal("should have key", key)
+		}
+	}
+
+	lru.Add("f", []byte("66666"))
+	if _, ok := lru.Get("d"); ok {
+		t.Fatal("should not have key d")
+	}
+	for _, key := range []Key{"e", "f"} {
+		if _, ok := lru.Get(key); !ok {
+			t.Fatal("should have key", key)
+		}
+	}
+
+	lru.MaxEntries = 1
+	lru.Add("g", []byte("7"))
+	for _, key := range []Key{"e", "f"} {
+		if _, ok := lru.Get(key); ok {
+			t.Fatal("should not have key", key)
+		}
+	}
+	if _, ok := lru.Get("g"); !ok {
+		t.Fatal("should have key g")
+	}
+}
@@ -69,6 +69,45 @@ var prefixTable = []prefixEntry{
 	// TODO(bradfitz): popular audio & video formats at least
 }
 
+// ftypBrands maps the major brands of the ISO-BMFF ftyp box to their MIME
+// types.
+var ftypBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heic",
+}
+
+// svgSniffLen is the number of bytes scanned to find the svg root element,
+// after the optional XML declaration, comments and doctype.
+const svgSniffLen = 512
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
+
+var headerBytesNeeded = computeHeaderBytesNeeded()
+
+func computeHeaderBytesNeeded() int {
+	n := sniffLen
+	if svgSniffLen > n {
+		n = svgSniffLen
+	}
+	for _, pte := range prefixTable {
+		// MIMEType needs at least one more byte than the prefix to match it
+		if l := len(pte.prefix) + 1; l > n {
+			n = l
+		}
+	}
+	return n
+}
+
+// HeaderBytesNeeded returns the number of bytes of a file that MIMEType needs
+// to detect its type. Reading more than that from the file is useless.
+func HeaderBytesNeeded() int {
+	return headerBytesNeeded
+}
+
 // MIMEType returns the MIME type from the data in the provided header
 // of the data.
 // It returns the empty string if the MIME type can't be determined.
@@ -80,12 +119,30 @@ func MIMEType(filename string, hdr []byte) string {
 			return pte.mtype
 		}
 	}
+	if t := ftypBrandType(hdr); t != "" {
+		return t
+	}
+	if isWebP(hdr) {
+		return "image/webp"
+	}
+	svgHdr := hdr
+	if hlen > svgSniffLen {
+		svgHdr = hdr[:svgSniffLen]
+	}
+	if IsSVG(svgHdr) {
+		return "image/svg+xml"
+	}
 	t := http.DetectContentType(hdr)
 	t = strings.Replace(t, "; charset=utf-8", "", 1)
 	if t != "application/octet-stream" && t != "text/plain" {
 		return t
 	}
-	return MIMETypeByExtension(path.Ext(filename))
+	// The content of a file with the svg extension has already been checked
+	// by IsSVG: the extension alone must not make it an image.
+	if ext := MIMETypeByExtension(path.Ext(filename)); ext != "image/svg+xml" {
+		return ext
+	}
+	return t
 }
 
 // MIMETypeByExtension calls mime.TypeByExtension, and removes optional parameters,
@@ -94,3 +151,96 @@ func MIMETypeByExtension(ext string) string {
 	mimeParts := strings.SplitN(mime.TypeByExtension(ext), ";", 2)
 	return strings.TrimSpace(mimeParts[0])
 }
+
+// ftypBrandType returns the MIME type for an ISO-BMFF file, based on the
+// major brand of its ftyp box, found at offset 8. It returns the empty string
+// if the header is not a known ftyp box.
+func ftypBrandType(hdr []byte) string {
+	if len(hdr) < 12 || !bytes.Equal(hdr[4:8], []byte("ftyp")) {
+		return ""
+	}
+	return ftypBrands[string(hdr[8:12])]
+}
+
+// isWebP returns true if the header is the one of a RIFF container holding a
+// WebP image: "RIFF", followed by the 4 bytes of the file size, and "WEBP".
+func isWebP(hdr []byte) bool {
+	return len(hdr) >= 12 &&
+		bytes.Equal(hdr[:4], []byte("RIFF")) &&
+		bytes.Equal(hdr[8:12], []byte("WEBP"))
+}
+
+// IsSVG returns true if the root element of the document is a svg element,
+// possibly after an XML declaration, comments and a doctype. A document with
+// another root element, like an HTML page with an inline svg, is not an SVG
+// image. Contrary to MIMEType, which only scans the first svgSniffLen bytes,
+// the whole data is scanned, for the documents with a long prolog.
+func IsSVG(data []byte) bool {
+	hdr := bytes.TrimPrefix(data, []byte("\ufeff"))
+	for {
+		hdr = bytes.TrimLeft(hdr, "\t\n\r ")
+		var end int
+		switch {
+		case bytes.HasPrefix(hdr, []byte("<?")):
+			end = skipAfter(hdr, "?>")
+		case bytes.HasPrefix(hdr, []byte("<!--")):
+			end = skipAfter(hdr, "-->")
+		case bytes.HasPrefix(hdr, []byte("<!")):
+			end = skipDoctype(hdr)
+		default:
+			return isSVGStartTag(hdr)
+		}
+		if end < 0 {
+			return false
+		}
+		hdr = hdr[end:]
+	}
+}
+
+// skipAfter returns the index following the first occurrence of sep in hdr,
+// or -1 if there is none.
+func skipAfter(hdr []byte, sep string) int {
+	i := bytes.Index(hdr, []byte(sep))
+	if i < 0 {
+		return -1
+	}
+	return i + len(sep)
+}
+
+// skipDoctype returns the index following the doctype at the beginning of
+// hdr, whose internal subset between brackets can contain '>', or -1 if it is
+// not complete.
+func skipDoctype(hdr []byte) int {
+	depth := 0
+	for i, b := range hdr {
+		switch b {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '>':
+			if depth <= 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// isSVGStartTag returns true if hdr starts with the start tag of a svg
+// element, possibly with a namespace prefix like <svg:svg.
+func isSVGStartTag(hdr []byte) bool {
+	if !bytes.HasPrefix(hdr, []byte("<")) {
+		return false
+	}
+	name := hdr[1:]
+	if i := bytes.IndexAny(name, "\t\n\r />"); i >= 0 {
+		name = name[:i]
+	} else {
+		return false
+	}
+	if i := bytes.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return string(name) == "svg"
+}
@@ -0,0 +1,107 @@
+package magic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMIMETypeSVG(t *testing.T) {
+	tests := []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"></svg>`,
+		`<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg"/>`,
+		`<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!-- Created with Inkscape (http://www.inkscape.org/) -->
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">
+<svg xmlns="http://www.w3.org/2000/svg" version="1.1"></svg>`,
+		"\ufeff  \n<svg></svg>",
+		`<!DOCTYPE svg [<!ENTITY a "b">]><svg:svg xmlns:svg="http://www.w3.org/2000/svg"/>`,
+	}
+	for _, data := range tests {
+		if mime := MIMEType("icon", []byte(data)); mime != "image/svg+xml" {
+			t.Errorf("expected image/svg+xml for %q, got %q", data, mime)
+		}
+	}
+
+	long := `<?xml version="1.0"?><!-- ` + strings.Repeat("a", svgSniffLen) + ` --><svg/>`
+	if mime := MIMEType("icon", []byte(long)); mime == "image/svg+xml" {
+		t.Errorf("unexpected image/svg+xml beyond the sniffed header")
+	}
+	if !IsSVG([]byte(long)) {
+		t.Errorf("expected IsSVG to scan the whole data")
+	}
+
+	if mime := MIMEType("icon", []byte(`<?xml version="1.0"?><foo/>`)); mime == "image/svg+xml" {
+		t.Errorf("unexpected image/svg+xml for non-svg XML")
+	}
+	if mime := MIMEType("icon", []byte(`hello <svg>`)); mime == "image/svg+xml" {
+		t.Errorf("unexpected image/svg+xml for text")
+	}
+
+	html := []string{
+		`<html><body><svg xmlns="http://www.w3.org/2000/svg"></svg><script>alert(1)</script></body></html>`,
+		`<!DOCTYPE html><html><svg></svg></html>`,
+		`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"><svg/></html>`,
+		`<!-- <svg> --><html><svg/></html>`,
+		`<svgfoo/>`,
+	}
+	for _, data := range html {
+		if mime := MIMEType("icon.svg", []byte(data)); mime == "image/svg+xml" {
+			t.Errorf("unexpected image/svg+xml for %q", data)
+		}
+	}
+}
+
+func TestMIMETypeWebP(t *testing.T) {
+	// Header of a 1x1 lossless WebP image
+	data := []byte{
+		'R', 'I', 'F', 'F', 0x1a, 0, 0, 0, 'W', 'E', 'B', 'P',
+		'V', 'P', '8', 'L', 0x0d, 0, 0, 0, 0x2f, 0, 0, 0,
+		0x10, 0x07, 0x10, 0x11, 0x11, 0x88, 0x88, 0xfe, 0x07, 0,
+	}
+	if mime := MIMEType("screenshot", data); mime != "image/webp" {
+		t.Errorf("expected image/webp, got %q", mime)
+	}
+
+	// A RIFF container that is not a WebP image
+	wav := []byte{'R', 'I', 'F', 'F', 0x24, 0, 0, 0, 'W', 'A', 'V', 'E'}
+	if mime := MIMEType("sound", wav); mime == "image/webp" {
+		t.Errorf("unexpected image/webp for a WAVE file")
+	}
+}
+
+func TestMIMETypeFtypBrands(t *testing.T) {
+	tests := []struct {
+		brand string
+		mime  string
+	}{
+		{"avif", "image/avif"},
+		{"avis", "image/avif"},
+		{"heic", "image/heic"},
+		{"heix", "image/heic"},
+		{"mif1", "image/heic"},
+	}
+	for _, test := range tests {
+		hdr := append([]byte{0, 0, 0, 0x1c, 'f', 't', 'y', 'p'}, test.brand...)
+		if mime := MIMEType("screenshot", hdr); mime != test.mime {
+			t.Errorf("expected %s for brand %q, got %q", test.mime, test.brand, mime)
+		}
+	}
+
+	quicktime := []byte{0, 0, 0, 0x14, 'f', 't', 'y', 'p', 'q', 't', ' ', ' ', 0, 0, 0, 0}
+	if mime := MIMEType("video", quicktime); mime != "video/quicktime" {
+		t.Errorf("expected video/quicktime, got %q", mime)
+	}
+}
+
+func TestHeaderBytesNeeded(t *testing.T) {
+	n := HeaderBytesNeeded()
+	if n < 512 {
+		t.Fatalf("expected at least 512 bytes, got %d", n)
+	}
+	for _, pte := range prefixTable {
+		if len(pte.prefix) >= n {
+			t.Errorf("prefix for %s is longer than %d bytes", pte.mtype, n)
+		}
+	}
+}
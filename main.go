@@ -17,6 +17,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cozy/cozy-apps-registry/auth"
@@ -42,10 +43,14 @@ var appDUCFlag string
 var appDUCByFlag string
 
 var editorAutoPublicationFlag bool
+var editorSigningRequiredFlag bool
 
 var flagInfraMaintenance bool
 var flagShortMaintenance bool
 var flagDisallowManualExec bool
+var flagMaintenanceStart string
+var flagMaintenanceEnd string
+var flagReplacedBy string
 
 var editorRegistry *auth.EditorRegistry
 var sessionSecret []byte
@@ -82,15 +87,65 @@ func init() {
 	flags.StringSlice("contexts", nil, "deprecated and renamed `--spaces`")
 	checkNoErr(viper.BindPFlag("contexts", flags.Lookup("contexts")))
 
+	flags.StringSlice("trusted-proxies", nil, "IP addresses or CIDR networks of the reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted")
+	checkNoErr(viper.BindPFlag("trusted-proxies", flags.Lookup("trusted-proxies")))
+
+	flags.StringSlice("admin-editors", nil, "editors whose master token gives access to the statistics of the spaces")
+	checkNoErr(viper.BindPFlag("admin-editors", flags.Lookup("admin-editors")))
+
 	flags.Bool("syslog", false, "enable syslog logging")
 	checkNoErr(viper.BindPFlag("syslog", flags.Lookup("syslog")))
 
+	flags.Float64("manifest-size-threshold", 0.1, "tolerated relative difference between the uncompressed_size of a manifest and the tarball content")
+	checkNoErr(viper.BindPFlag("manifest-size.threshold", flags.Lookup("manifest-size-threshold")))
+
+	flags.Bool("manifest-size-strict", false, "reject versions whose manifest uncompressed_size does not match the tarball content")
+	checkNoErr(viper.BindPFlag("manifest-size.strict", flags.Lookup("manifest-size-strict")))
+
+	flags.Bool("strict-publish", false, "reject the publications whose request body contains unknown fields")
+	checkNoErr(viper.BindPFlag("strict-publish", flags.Lookup("strict-publish")))
+
+	flags.Bool("store-tarballs", false, "keep a copy of the tarballs of the versions in CouchDB")
+	checkNoErr(viper.BindPFlag("store-tarballs", flags.Lookup("store-tarballs")))
+
+	flags.Bool("shared-versions-views", false, "use versions views shared by all the applications instead of one design document per application")
+	checkNoErr(viper.BindPFlag("couchdb.shared-versions-views", flags.Lookup("shared-versions-views")))
+
+	flags.Int("cache-versions-latest-size", 256, "maximum number of entries in the cache of latest versions")
+	checkNoErr(viper.BindPFlag("cache.versions_latest_size", flags.Lookup("cache-versions-latest-size")))
+
+	flags.Int("cache-versions-list-size", 256, "maximum number of entries in the cache of versions lists")
+	checkNoErr(viper.BindPFlag("cache.versions_list_size", flags.Lookup("cache-versions-list-size")))
+
+	flags.Int("cache-versions-published-size", 256, "maximum number of entries in the cache of published versions")
+	checkNoErr(viper.BindPFlag("cache.versions_published_size", flags.Lookup("cache-versions-published-size")))
+
+	flags.Duration("cache-ttl", 5*time.Minute, "time to live of the entries of the versions caches")
+	checkNoErr(viper.BindPFlag("cache.ttl", flags.Lookup("cache-ttl")))
+
+	flags.Duration("download-timeout", 30*time.Second, "timeout of the downloads of the versions tarballs")
+	checkNoErr(viper.BindPFlag("download.timeout", flags.Lookup("download-timeout")))
+
+	flags.Duration("downloads-flush-interval", time.Minute, "interval between two writes of the downloads counters of the versions")
+	checkNoErr(viper.BindPFlag("downloads-flush-interval", flags.Lookup("downloads-flush-interval")))
+
+	flags.Int("download-max-redirects", 10, "maximum number of redirects followed when downloading a tarball")
+	checkNoErr(viper.BindPFlag("download.max_redirects", flags.Lookup("download-max-redirects")))
+
+	flags.Int("publish-rate-per-minute", 10, "number of versions an editor can publish per minute")
+	checkNoErr(viper.BindPFlag("publish-rate.per_minute", flags.Lookup("publish-rate-per-minute")))
+
+	flags.Int("publish-rate-burst", 30, "number of versions an editor can publish in a row")
+	checkNoErr(viper.BindPFlag("publish-rate.burst", flags.Lookup("publish-rate-burst")))
+
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(genTokenCmd)
 	rootCmd.AddCommand(verifyTokenCmd)
 	rootCmd.AddCommand(revokeTokensCmd)
 	rootCmd.AddCommand(genSessionSecret)
 	rootCmd.AddCommand(printPublicKeyCmd)
+	rootCmd.AddCommand(setNextPublicKeyCmd)
+	rootCmd.AddCommand(promoteNextPublicKeyCmd)
 	rootCmd.AddCommand(verifySignatureCmd)
 	rootCmd.AddCommand(addEditorCmd)
 	rootCmd.AddCommand(rmEditorCmd)
@@ -102,6 +157,12 @@ func init() {
 	maintenanceCmd.AddCommand(maintenanceDeactivateAppCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(backfillLatestVersionsCmd)
+	rootCmd.AddCommand(cleanupViewsCmd)
+	rootCmd.AddCommand(rebuildViewsCmd)
+	rootCmd.AddCommand(refreshPopularityCmd)
+	rootCmd.AddCommand(featureAppCmd)
+	rootCmd.AddCommand(archiveAppCmd)
 
 	passphraseFlag = genSessionSecret.Flags().Bool("passphrase", false, "enforce or dismiss the session secret encryption")
 
@@ -130,11 +191,17 @@ func init() {
 	maintenanceActivateAppCmd.Flags().BoolVar(&flagInfraMaintenance, "infra", false, "specify a maintenance specific to our infra")
 	maintenanceActivateAppCmd.Flags().BoolVar(&flagShortMaintenance, "short", false, "specify a short maintenance")
 	maintenanceActivateAppCmd.Flags().BoolVar(&flagDisallowManualExec, "no-manual-exec", false, "specify a maintenance disallowing manual execution")
+	maintenanceActivateAppCmd.Flags().StringVar(&flagMaintenanceStart, "start", "", "specify the start of a scheduled maintenance (RFC3339 date)")
+	maintenanceActivateAppCmd.Flags().StringVar(&flagMaintenanceEnd, "end", "", "specify the end of a scheduled maintenance (RFC3339 date)")
 	maintenanceActivateAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 
 	maintenanceDeactivateAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	featureAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	archiveAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	archiveAppCmd.Flags().StringVar(&flagReplacedBy, "replaced-by", "", "specify the slug of the application replacing the archived one")
 
 	addEditorCmd.Flags().BoolVar(&editorAutoPublicationFlag, "auto-publication", false, "activate auto-publication of version for this editor")
+	addEditorCmd.Flags().BoolVar(&editorSigningRequiredFlag, "signing-required", false, "require a detached signature of the versions published by this editor")
 }
 
 func useConfig(cmd *cobra.Command) (err error) {
@@ -216,15 +283,22 @@ var serveCmd = &cobra.Command{
 	PreRunE: compose(loadSessionSecret, prepareRegistry, prepareSpaces),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		InitLogger(LoggerOptions{Syslog: viper.GetBool("syslog")})
+		trustedProxies, err = parseTrustedProxies(viper.GetStringSlice("trusted-proxies"))
+		if err != nil {
+			return err
+		}
+		adminEditors = viper.GetStringSlice("admin-editors")
 		address := fmt.Sprintf("%s:%d", viper.GetString("host"), viper.GetInt("port"))
 		fmt.Printf("Listening on %s...\n", address)
 		errc := make(chan error)
+		stopDownloadsFlusher := registry.StartDownloadsFlusher()
+		defer stopDownloadsFlusher()
 		router := Router(address)
 		go func() {
 			errc <- router.Start(address)
 		}()
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		select {
 		case err = <-errc:
 			return err
@@ -250,6 +324,60 @@ var printPublicKeyCmd = &cobra.Command{
 	},
 }
 
+var setNextPublicKeyCmd = &cobra.Command{
+	Use:     "set-next-pubkey [editor] [file]",
+	Short:   `Start the rotation of the public key of the specified editor with the given PEM or SSH public key file`,
+	PreRunE: prepareRegistry,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		editor, args, err := fetchEditor(args)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("Missing argument for public key file path")
+		}
+
+		publicKeyPath := registry.AbsPath(args[0])
+		f, err := os.Open(publicKeyPath)
+		if err != nil {
+			return fmt.Errorf("Failed to open file %q: %s", publicKeyPath, err)
+		}
+		defer f.Close()
+		publicKey, err := ioutil.ReadAll(io.LimitReader(f, 10*1024))
+		if err != nil {
+			return fmt.Errorf("Could not read file %q: %s", publicKeyPath, err)
+		}
+
+		fmt.Printf("Setting the next public key of editor %q...", editor.Name())
+		if err = editorRegistry.SetNextPublicKey(editor, publicKey); err != nil {
+			fmt.Println("failed")
+			return err
+		}
+		fmt.Printf("ok (key id %s)\n", editor.NextPublicKeyID())
+		return nil
+	},
+}
+
+var promoteNextPublicKeyCmd = &cobra.Command{
+	Use:     "promote-next-pubkey [editor]",
+	Short:   `End the rotation of the public key of the specified editor: its next public key replaces the current one`,
+	PreRunE: prepareRegistry,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		editor, _, err := fetchEditor(args)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Promoting the next public key of editor %q...", editor.Name())
+		if err = editorRegistry.PromoteNextPublicKey(editor); err != nil {
+			fmt.Println("failed")
+			return err
+		}
+		fmt.Printf("ok (key id %s)\n", editor.PublicKeyID())
+		return nil
+	},
+}
+
 var verifySignatureCmd = &cobra.Command{
 	Use:     "verify [editor] [file]",
 	Short:   `Verify a signature given via stdin for a specified editor and file`,
@@ -326,7 +454,7 @@ var genTokenCmd = &cobra.Command{
 				err = fmt.Errorf("Space %q does not exist", appSpaceFlag)
 			} else {
 				var app *registry.App
-				app, err = registry.FindApp(space, appNameFlag, registry.Stable)
+				app, err = registry.FindAppMeta(context.Background(), space, appNameFlag)
 				if err == nil {
 					token, err = editor.GenerateEditorToken(sessionSecret, maxAge, app.Slug)
 				}
@@ -417,7 +545,7 @@ var verifyTokenCmd = &cobra.Command{
 			if !ok {
 				return fmt.Errorf("Space %q does not exist", appSpaceFlag)
 			}
-			app, err := registry.FindApp(space, appNameFlag, registry.Stable)
+			app, err := registry.FindAppMeta(context.Background(), space, appNameFlag)
 			if err != nil {
 				return err
 			}
@@ -595,7 +723,10 @@ var addEditorCmd = &cobra.Command{
 		// }
 
 		fmt.Printf("Creating new editor %q...", editorName)
-		_, err = editorRegistry.CreateEditorWithoutPublicKey(editorName, editorAutoPublicationFlag)
+		editor, err := editorRegistry.CreateEditorWithoutPublicKey(editorName, editorAutoPublicationFlag)
+		if err == nil && editorSigningRequiredFlag {
+			err = editorRegistry.SetSigningRequired(editor, true)
+		}
 		if err != nil {
 			fmt.Println("failed")
 			return err
@@ -750,6 +881,22 @@ var maintenanceActivateAppCmd = &cobra.Command{
 			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
 		}
 
+		var start, end *time.Time
+		if flagMaintenanceStart != "" {
+			t, err := time.Parse(time.RFC3339, flagMaintenanceStart)
+			if err != nil {
+				return fmt.Errorf("Bad start date %q: %s", flagMaintenanceStart, err)
+			}
+			start = &t
+		}
+		if flagMaintenanceEnd != "" {
+			t, err := time.Parse(time.RFC3339, flagMaintenanceEnd)
+			if err != nil {
+				return fmt.Errorf("Bad end date %q: %s", flagMaintenanceEnd, err)
+			}
+			end = &t
+		}
+
 		messages := make(map[string]registry.MaintenanceMessage)
 		for {
 			locale := prompt("Locale (empty to abort):")
@@ -772,6 +919,8 @@ var maintenanceActivateAppCmd = &cobra.Command{
 			FlagShortMaintenance:   flagShortMaintenance,
 			FlagDisallowManualExec: flagDisallowManualExec,
 			Messages:               messages,
+			Start:                  start,
+			End:                    end,
 		}
 		return registry.ActivateMaintenanceApp(space, args[0], opts)
 	},
@@ -793,6 +942,42 @@ var maintenanceDeactivateAppCmd = &cobra.Command{
 	},
 }
 
+var featureAppCmd = &cobra.Command{
+	Use:     "feature-app [slug] [rank]",
+	Short:   `Set the rank of an application in the featured ones, the highest first, or 0 to unfeature it`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		rank, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("Bad rank %q: %s", args[1], err)
+		}
+		space, ok := registry.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+		return registry.SetAppFeatured(space, args[0], rank)
+	},
+}
+
+var archiveAppCmd = &cobra.Command{
+	Use:     "archive-app [slug]",
+	Short:   `Archive an application, optionally replaced by another one`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		space, ok := registry.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+		return registry.ArchiveApp(space, args[0], flagReplacedBy)
+	},
+}
+
 var exportCmd = &cobra.Command{
 	Use:     "export [file]",
 	Short:   `Export the entire registry into one tarball file.`,
@@ -853,6 +1038,74 @@ var importCmd = &cobra.Command{
 	},
 }
 
+var backfillLatestVersionsCmd = &cobra.Command{
+	Use:     "backfill-latest-versions",
+	Short:   `Store the latest stable version on the applications created before it was denormalized`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, spaceName := range registry.Spaces() {
+			space, _ := registry.GetSpace(spaceName)
+			count, err := registry.BackfillLatestVersions(space)
+			fmt.Printf("Space %q: %d application(s) updated.\n", spaceName, count)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var cleanupViewsCmd = &cobra.Command{
+	Use:     "cleanup-views",
+	Short:   `Delete the versions views of the deleted applications`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, spaceName := range registry.Spaces() {
+			space, _ := registry.GetSpace(spaceName)
+			count, err := registry.CleanupOrphanViews(space)
+			fmt.Printf("Space %q: %d design document(s) deleted.\n", spaceName, count)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var rebuildViewsCmd = &cobra.Command{
+	Use:     "rebuild-views",
+	Short:   `Rewrite the outdated versions views of the applications`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, spaceName := range registry.Spaces() {
+			space, _ := registry.GetSpace(spaceName)
+			count, err := registry.RebuildAllVersionViews(space)
+			fmt.Printf("Space %q: %d design document(s) written.\n", spaceName, count)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var refreshPopularityCmd = &cobra.Command{
+	Use:     "refresh-popularity",
+	Short:   `Set the total number of downloads on the applications, to sort them on it`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, spaceName := range registry.Spaces() {
+			space, _ := registry.GetSpace(spaceName)
+			count, err := registry.RefreshPopularity(space)
+			fmt.Printf("Space %q: %d application(s) updated.\n", spaceName, count)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
 func prepareRegistry(cmd *cobra.Command, args []string) error {
 	editorsDB, err := registry.InitGlobalClient(
 		viper.GetString("couchdb.url"),
@@ -863,6 +1116,63 @@ func prepareRegistry(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Could not reach CouchDB: %s", err)
 	}
 
+	registry.ManifestSizeThreshold = viper.GetFloat64("manifest-size.threshold")
+	registry.ManifestSizeStrict = viper.GetBool("manifest-size.strict")
+	registry.StrictPublish = viper.GetBool("strict-publish")
+	registry.SharedVersionsViews = viper.GetBool("couchdb.shared-versions-views")
+	registry.StoreTarballs = viper.GetBool("store-tarballs")
+	registry.ValidCategories = viper.GetStringSlice("categories")
+	if viper.IsSet("max-tags") {
+		registry.MaxTags = viper.GetInt("max-tags")
+	}
+	if viper.IsSet("latest-version-channels") {
+		var channels []registry.Channel
+		for _, name := range viper.GetStringSlice("latest-version-channels") {
+			ch, err := registry.StrToChannel(name)
+			if err != nil {
+				return fmt.Errorf("Invalid latest-version-channels: %s", err)
+			}
+			channels = append(channels, ch)
+		}
+		registry.LatestVersionChannels = channels
+	}
+	if viper.IsSet("search-locales") {
+		registry.SearchLocales = viper.GetStringSlice("search-locales")
+	}
+	if viper.IsSet("manifest-filenames") {
+		registry.ManifestFilenames = viper.GetStringSlice("manifest-filenames")
+	}
+	if viper.IsSet("attachments.allowed_types") {
+		registry.AllowedAttachmentTypes = viper.GetStringSlice("attachments.allowed_types")
+	}
+
+	if d := viper.GetDuration("downloads-flush-interval"); d > 0 {
+		registry.DownloadsFlushInterval = d
+	}
+
+	registry.InitCaches(registry.CacheConfig{
+		VersionsLatestSize:    viper.GetInt("cache.versions_latest_size"),
+		VersionsListSize:      viper.GetInt("cache.versions_list_size"),
+		VersionsPublishedSize: viper.GetInt("cache.versions_published_size"),
+		TTL:                   viper.GetDuration("cache.ttl"),
+	})
+
+	maxRedirects := viper.GetInt("download.max_redirects")
+	registry.InitDownloadClient(registry.DownloadConfig{
+		Timeout:      viper.GetDuration("download.timeout"),
+		MaxRedirects: &maxRedirects,
+		AllowedHosts: viper.GetStringSlice("download.allowed_hosts"),
+		AllowHTTP:    viper.GetBool("download.allow_http"),
+		Retries:      viper.GetInt("download.retries"),
+		RetryDelay:   viper.GetDuration("download.retry_delay"),
+		Resumable:    viper.GetBool("download.resumable"),
+	})
+
+	registry.InitPublishRateLimiter(registry.PublishRateConfig{
+		PerMinute: viper.GetInt("publish-rate.per_minute"),
+		Burst:     viper.GetInt("publish-rate.burst"),
+	})
+
 	vault := auth.NewCouchDBVault(editorsDB)
 	editorRegistry, err = auth.NewEditorRegistry(vault)
 	if err != nil {
@@ -877,16 +1187,20 @@ func prepareSpaces(cmd *cobra.Command, args []string) error {
 	if len(spacesNames) == 0 {
 		spacesNames = viper.GetStringSlice("contexts") // retro-compat
 	}
-	if len(spacesNames) > 0 {
-		for _, spaceName := range spacesNames {
-			if err := registry.RegisterSpace(spaceName); err != nil {
-				return err
-			}
+	if len(spacesNames) == 0 {
+		spacesNames = []string{"__default__"}
+	}
+	for _, spaceName := range spacesNames {
+		space, err := registry.RegisterSpace(spaceName)
+		if err != nil {
+			return err
 		}
-		return nil
+		if strings.TrimSpace(spaceName) == "" {
+			spaceName = "__default__"
+		}
+		space.MaxAppSize = viper.GetInt64("max-app-size." + strings.TrimSpace(spaceName))
 	}
-
-	return registry.RegisterSpace("__default__")
+	return nil
 }
 
 func loadSessionSecret(cmd *cobra.Command, args []string) error {
@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/magic"
+)
+
+// AllowedAttachmentTypes is the list of the MIME types of the icons and
+// screenshots that the registry accepts to store and to serve as is. The
+// other attachments are served as application/octet-stream, to be downloaded,
+// so that a file uploaded as a screenshot can not be used for stored XSS. The
+// SVG images, which can contain scripts, are served with a sandboxing content
+// security policy, and as attachments.
+var AllowedAttachmentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/svg+xml",
+}
+
+// forbiddenAttachmentType is the MIME type used to serve the attachments whose
+// type is not allowed.
+const forbiddenAttachmentType = "application/octet-stream"
+
+// svgSniffLen is the number of bytes of a served attachment in which the svg
+// root element is looked for. The SVG images exported by Illustrator or
+// Inkscape can start with comments and a doctype longer than the header used
+// by magic.MIMEType.
+const svgSniffLen = 64 * 1024
+
+// attachmentMIMEType returns the MIME type of an attachment detected from its
+// content, and whether this type is allowed. The type is detected from the
+// first bytes, and the svg root element is looked for in the whole data.
+func attachmentMIMEType(filename string, data []byte) (string, bool) {
+	mime := magic.MIMEType(filename, sniffHeader(data))
+	if !isAllowedAttachmentType(mime) && magic.IsSVG(data) {
+		mime = "image/svg+xml"
+	}
+	return mime, isAllowedAttachmentType(mime)
+}
+
+func isAllowedAttachmentType(mime string) bool {
+	for _, allowed := range AllowedAttachmentTypes {
+		if strings.EqualFold(mime, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffAttachment sets the content type of the attachment to the one detected
+// from its content, or to application/octet-stream with Download set if this
+// type is not allowed. The stored content type is not trusted.
+func sniffAttachment(att *Attachment, filename string) {
+	br := bufio.NewReaderSize(att.Content, svgSniffLen)
+	// Peek returns an error for the attachments smaller than the header, but
+	// the bytes read are still enough to detect their type.
+	hdr, _ := br.Peek(svgSniffLen)
+	att.Content = struct {
+		io.Reader
+		io.Closer
+	}{br, att.Content}
+
+	mime, ok := attachmentMIMEType(filename, hdr)
+	if !ok {
+		att.ContentType = forbiddenAttachmentType
+		att.Download = true
+		return
+	}
+	att.ContentType = mime
+}
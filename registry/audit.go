@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/echo"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditCreateApp     = "create_app"
+	AuditUpdateApp     = "update_app"
+	AuditCreateVersion = "create_version"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var auditIndex = echo.Map{"fields": []string{"space", "timestamp"}}
+
+// EditorAudit is an entry of the audit log, recording an action of an editor
+// on an application or a version. The entries are never modified once
+// written.
+type EditorAudit struct {
+	ID  string `json:"_id,omitempty"`
+	Rev string `json:"_rev,omitempty"`
+
+	Space     string    `json:"space"`
+	Editor    string    `json:"editor"`
+	Action    string    `json:"action"`
+	Slug      string    `json:"slug"`
+	Version   string    `json:"version,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AuditFilter restricts the entries returned by GetAuditLog. The zero values
+// do not filter anything.
+type AuditFilter struct {
+	Editor string
+	Slug   string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of entries, 100 by default.
+	Limit int
+}
+
+// WriteEditorAudit appends the given entry to the audit log of the space. Its
+// timestamp is set to the current time if it is empty.
+func WriteEditorAudit(c *Space, entry *EditorAudit) error {
+	entry.ID = ""
+	entry.Rev = ""
+	entry.Space = c.prefix
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	// The timestamps are compared as strings by the mango queries, so they
+	// must all have the same format.
+	entry.Timestamp = entry.Timestamp.UTC().Truncate(time.Second)
+	_, _, err := globalAuditDB.CreateDoc(ctx, entry)
+	return err
+}
+
+// GetAuditLog returns the entries of the audit log of the space matching the
+// filter, the most recent first.
+func GetAuditLog(c *Space, opts AuditFilter) ([]*EditorAudit, error) {
+	rows, err := globalAuditDB.Find(ctx, auditQuery(c.prefix, opts))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*EditorAudit, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var entry *EditorAudit
+		if err = rows.ScanDoc(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// auditQuery returns the mango query of the entries of the audit log, which
+// relies on auditIndex.
+func auditQuery(space string, opts AuditFilter) string {
+	timestamp := `"$gt": null`
+	if !opts.Since.IsZero() {
+		timestamp = string(sprintfJSON(`"$gte": %s`, opts.Since.UTC().Format(time.RFC3339)))
+	}
+	if !opts.Until.IsZero() {
+		timestamp += "," + string(sprintfJSON(`"$lt": %s`, opts.Until.UTC().Format(time.RFC3339)))
+	}
+	selector := string(sprintfJSON(`"space": %s, "timestamp": {`, space)) + timestamp + "}"
+	if opts.Editor != "" {
+		selector += "," + string(sprintfJSON(`"editor": %s`, opts.Editor))
+	}
+	if opts.Slug != "" {
+		selector += "," + string(sprintfJSON(`"slug": %s`, opts.Slug))
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	} else if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	return string(sprintfJSON(`{
+  "use_index": "audit-index",
+  "selector": {`+selector+`},
+  "sort": [{"space": "desc"}, {"timestamp": "desc"}],
+  "limit": %s
+}`, limit))
+}
@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+var ErrCompatibleWithInvalid = errshttp.NewError(http.StatusBadRequest, "Invalid stack version: should be of the form \"1.5.0\"")
+
+// versionComparison is a single comparison of a versions constraint, like
+// ">=1.5.0".
+type versionComparison struct {
+	op      string
+	version [3]int
+}
+
+// versionConstraint is a constraint on the version of the stack, as declared
+// in the manifests. It is a list of alternatives separated by "||", each one
+// being a list of comparisons that must all be satisfied, separated by spaces
+// or commas: ">=1.5.0 <2.0.0 || >=2.1.0". The caret and tilde ranges of npm,
+// like "^1.5.0" or "~1.5.0", are also accepted and expanded into two
+// comparisons.
+type versionConstraint [][]versionComparison
+
+var (
+	constraintOperators = []string{">=", "<=", "==", ">", "<", "=", "^", "~"}
+	constraintSpacesReg = regexp.MustCompile(`(>=|<=|==|>|<|=|\^|~)\s+`)
+)
+
+func parseVersionConstraint(constraint string) (versionConstraint, error) {
+	var vc versionConstraint
+	constraint = constraintSpacesReg.ReplaceAllString(constraint, "$1")
+	for _, alternative := range strings.Split(constraint, "||") {
+		terms := strings.FieldsFunc(alternative, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		})
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("empty alternative in constraint %q", constraint)
+		}
+		comparisons := make([]versionComparison, 0, len(terms))
+		for _, term := range terms {
+			op := "="
+			for _, o := range constraintOperators {
+				if strings.HasPrefix(term, o) {
+					op = o
+					term = term[len(o):]
+					break
+				}
+			}
+			version, err := parseStackVersion(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint %q: %s", constraint, err)
+			}
+			switch op {
+			case "^", "~":
+				comparisons = append(comparisons,
+					versionComparison{op: ">=", version: version},
+					versionComparison{op: "<", version: rangeUpperBound(op, term, version)})
+			default:
+				comparisons = append(comparisons, versionComparison{op: op, version: version})
+			}
+		}
+		vc = append(vc, comparisons)
+	}
+	return vc, nil
+}
+
+// rangeUpperBound returns the excluded upper bound of a caret or tilde range,
+// following the npm semantics: "^1.2.3" allows the changes that do not modify
+// the left-most non-zero number (<2.0.0), and "~1.2.3" allows the patch
+// changes if the minor number is given (<1.3.0), or the minor changes if not.
+func rangeUpperBound(op, term string, version [3]int) (upper [3]int) {
+	if i := strings.IndexAny(term, "-+"); i >= 0 {
+		term = term[:i]
+	}
+	given := len(strings.Split(term, "."))
+	i := 0
+	if op == "^" {
+		for i < given-1 && version[i] == 0 {
+			i++
+		}
+	} else if given > 1 {
+		i = 1
+	}
+	copy(upper[:], version[:i])
+	upper[i] = version[i] + 1
+	return upper
+}
+
+// parseStackVersion parses a version of the stack, like "1.5.0" or "v1.5".
+// The missing numbers are zeros, and the pre-release and build suffixes are
+// ignored.
+func parseStackVersion(version string) (v [3]int, err error) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if version == "" || len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", version)
+	}
+	for i, part := range parts {
+		if v[i], err = strconv.Atoi(part); err != nil || v[i] < 0 {
+			return v, fmt.Errorf("invalid version %q", version)
+		}
+	}
+	return v, nil
+}
+
+func compareStackVersions(v1, v2 [3]int) int {
+	for i := 0; i < 3; i++ {
+		if v1[i] < v2[i] {
+			return -1
+		}
+		if v1[i] > v2[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (vc versionConstraint) allows(version [3]int) bool {
+	for _, comparisons := range vc {
+		ok := true
+		for _, c := range comparisons {
+			cmp := compareStackVersions(version, c.version)
+			switch c.op {
+			case ">=":
+				ok = cmp >= 0
+			case "<=":
+				ok = cmp <= 0
+			case ">":
+				ok = cmp > 0
+			case "<":
+				ok = cmp < 0
+			default:
+				ok = cmp == 0
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompatibleWith returns true if the given version of the stack satisfies
+// the constraint declared by the version of the application. A version
+// without constraint is compatible with all the stacks.
+func (v *Version) isCompatibleWith(stackVersion [3]int) bool {
+	if v.CozyVersion == "" {
+		return true
+	}
+	vc, err := parseVersionConstraint(v.CozyVersion)
+	if err != nil {
+		return false
+	}
+	return vc.allows(stackVersion)
+}
+
+// cozyVersionConstraint returns the constraint on the version of the stack
+// declared in the manifest, either as a cozy_version range, or as a min_cozy
+// minimal version, and the name of the field it comes from.
+func (m *Manifest) cozyVersionConstraint() (constraint, field string) {
+	if constraint = strings.TrimSpace(m.CozyVersion); constraint != "" {
+		return constraint, "cozy_version"
+	}
+	if min := strings.TrimSpace(m.MinCozy); min != "" {
+		return ">=" + strings.TrimPrefix(min, ">="), "min_cozy"
+	}
+	return "", ""
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+var ErrCursorInvalid = errshttp.NewError(http.StatusBadRequest, "Invalid cursor token")
+
+// Cursor is the position of a page of the applications list: the value of
+// the sort field and the slug of the last application of the previous page.
+// It is exchanged with the clients as an opaque token, built by EncodeCursor.
+type Cursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	Slug  string          `json:"k"`
+}
+
+// EncodeCursor returns the opaque token of the given cursor.
+func EncodeCursor(cursor *Cursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor returns the cursor encoded in the given token.
+func DecodeCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	var cursor Cursor
+	if err = json.Unmarshal(b, &cursor); err != nil || cursor.Slug == "" {
+		return nil, ErrCursorInvalid
+	}
+	if cursor.Sort != "slug" && (len(cursor.Value) == 0 || string(cursor.Value) == "null") {
+		return nil, ErrCursorInvalid
+	}
+	return &cursor, nil
+}
+
+// appCursor returns the cursor placed after the given application, for a list
+// sorted on the given field.
+func appCursor(app *App, sortField string) *Cursor {
+	var value interface{}
+	switch sortField {
+	case "type":
+		value = app.Type
+	case "editor":
+		value = app.Editor
+	case "category":
+		value = app.Category
+	case "created_at":
+		value = app.CreatedAt
+	case "updated_at":
+		value = app.UpdatedAt
+	case "latest_version_created_at":
+		value = app.LatestStableCreatedAt
+	case "downloads":
+		value = app.TotalDownloads
+	}
+	cursor := &Cursor{Sort: sortField, Slug: app.Slug}
+	if sortField != "slug" {
+		cursor.Value, _ = json.Marshal(value)
+	}
+	return cursor
+}
+
+// cursorSelector returns the part of the mango selector keeping only the
+// applications placed after the cursor, in the given order. The slug is used
+// to order the applications sharing the same value of the sort field. The
+// condition is wrapped in a $and to not conflict with the $or of a search.
+func cursorSelector(cursor *Cursor, order string) string {
+	op := "$gt"
+	if order == "desc" {
+		op = "$lt"
+	}
+	if cursor.Sort == "slug" {
+		return string(sprintfJSON(`"$and": [{"slug": {%s: %s}}]`, op, cursor.Slug))
+	}
+	return string(sprintfJSON(`"$and": [{"$or": [{%s: {%s: %s}}, {%s: %s, "slug": {%s: %s}}]}]`,
+		sortFieldName(cursor.Sort), op, cursor.Value,
+		sortFieldName(cursor.Sort), cursor.Value, op, cursor.Slug))
+}
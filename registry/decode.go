@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+// DecodeStrict decodes the JSON document read from r into v, like
+// json.Unmarshal, except that the fields unknown to v are rejected with an
+// error naming them, instead of being silently dropped. It is used for the
+// documents sent by the editors, where an unknown field is most probably a
+// misspelled one.
+func DecodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	const unknownFieldPrefix = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknownFieldPrefix) {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Unknown field %s in the request body: check its spelling",
+			strings.TrimPrefix(msg, unknownFieldPrefix))
+	}
+	return errshttp.NewError(http.StatusBadRequest,
+		"Invalid JSON in the request body: %s", err)
+}
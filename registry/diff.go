@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// diffScalarFields are the fields of the manifests compared by DiffVersions,
+// in addition to the permissions and routes.
+var diffScalarFields = []string{
+	"name",
+	"version",
+	"license",
+	"source",
+	"category",
+	"uncompressed_size",
+}
+
+// VersionDiff describes the changes in the manifest between two versions of
+// an application. All the lists are sorted.
+type VersionDiff struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	PermissionsAdded   []string `json:"permissions_added,omitempty"`
+	PermissionsRemoved []string `json:"permissions_removed,omitempty"`
+	PermissionsChanged []string `json:"permissions_changed,omitempty"`
+
+	RoutesAdded   []string `json:"routes_added,omitempty"`
+	RoutesRemoved []string `json:"routes_removed,omitempty"`
+
+	Fields map[string]FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is the old and new values of a field of the manifest. A value
+// is nil when the field is absent.
+type FieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// DiffVersions returns the changes in the manifest between two published
+// versions of an application, to help writing its changelog.
+func DiffVersions(ctx context.Context, c *Space, appSlug, fromVersion, toVersion string) (*VersionDiff, error) {
+	from, err := FindPublishedVersion(ctx, c, appSlug, fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := FindPublishedVersion(ctx, c, appSlug, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := diffManifests(from, to)
+	if err != nil {
+		return nil, err
+	}
+	diff.From = from.Version
+	diff.To = to.Version
+	return diff, nil
+}
+
+func diffManifests(from, to *Version) (*VersionDiff, error) {
+	var fromFields, toFields map[string]json.RawMessage
+	if err := json.Unmarshal(from.Manifest, &fromFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(to.Manifest, &toFields); err != nil {
+		return nil, err
+	}
+	fromManifest, err := from.ParsedManifest()
+	if err != nil {
+		return nil, err
+	}
+	toManifest, err := to.ParsedManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &VersionDiff{}
+	for name, perm := range toManifest.Permissions {
+		old, ok := fromManifest.Permissions[name]
+		if !ok {
+			diff.PermissionsAdded = append(diff.PermissionsAdded, name)
+		} else if !samePermission(old, perm) {
+			diff.PermissionsChanged = append(diff.PermissionsChanged, name)
+		}
+	}
+	for name := range fromManifest.Permissions {
+		if _, ok := toManifest.Permissions[name]; !ok {
+			diff.PermissionsRemoved = append(diff.PermissionsRemoved, name)
+		}
+	}
+	for route := range toManifest.Routes {
+		if _, ok := fromManifest.Routes[route]; !ok {
+			diff.RoutesAdded = append(diff.RoutesAdded, route)
+		}
+	}
+	for route := range fromManifest.Routes {
+		if _, ok := toManifest.Routes[route]; !ok {
+			diff.RoutesRemoved = append(diff.RoutesRemoved, route)
+		}
+	}
+	sort.Strings(diff.PermissionsAdded)
+	sort.Strings(diff.PermissionsRemoved)
+	sort.Strings(diff.PermissionsChanged)
+	sort.Strings(diff.RoutesAdded)
+	sort.Strings(diff.RoutesRemoved)
+
+	for _, field := range diffScalarFields {
+		oldValue, newValue := compactJSON(fromFields[field]), compactJSON(toFields[field])
+		if !bytes.Equal(oldValue, newValue) {
+			if diff.Fields == nil {
+				diff.Fields = make(map[string]FieldChange)
+			}
+			diff.Fields[field] = FieldChange{From: oldValue, To: newValue}
+		}
+	}
+	return diff, nil
+}
+
+// samePermission returns true if the two permissions are equal, ignoring the
+// order of their verbs and the ignored verbs.
+func samePermission(p1, p2 Permission) bool {
+	v1 := append([]string(nil), p1.Verbs...)
+	v2 := append([]string(nil), p2.Verbs...)
+	sort.Strings(v1)
+	sort.Strings(v2)
+	p1.Verbs, p2.Verbs = v1, v2
+	p1.ignoredVerbs, p2.ignoredVerbs = nil, nil
+	return reflect.DeepEqual(p1, p2)
+}
+
+func compactJSON(value json.RawMessage) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return value
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,274 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik"
+	"github.com/sirupsen/logrus"
+)
+
+// The downloads of the versions are counted without ever updating a document,
+// so that the hot applications do not cause revision conflicts: the increments
+// are buffered in memory, and flushed periodically as new documents holding
+// the number of downloads of a version since the previous flush. The view of
+// the downloads database sums them by application and version.
+//
+// A version downloaded during an interval costs a single small document per
+// instance of the registry, whatever its number of downloads. The increments
+// not flushed yet are lost if the process is killed.
+
+const (
+	downloadsDesignDoc = "downloads"
+	downloadsView      = "by-version"
+)
+
+// DownloadsFlushInterval is the interval between two writes of the buffered
+// downloads counters to CouchDB.
+var DownloadsFlushInterval = time.Minute
+
+var downloadsDesign = map[string]interface{}{
+	"language": "javascript",
+	"views": map[string]interface{}{
+		downloadsView: map[string]interface{}{
+			"map":    `function(doc) { if (doc.slug && doc.version && doc.count) { emit([doc.slug, doc.version], doc.count); } }`,
+			"reduce": "_sum",
+		},
+	},
+}
+
+type downloadsKey struct {
+	space   string
+	slug    string
+	version string
+}
+
+type downloadsCount struct {
+	Slug      string    `json:"slug"`
+	Version   string    `json:"version"`
+	Count     int64     `json:"count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var pendingDownloads = struct {
+	sync.Mutex
+	counts map[downloadsKey]int64
+}{counts: make(map[downloadsKey]int64)}
+
+// IncrementVersionDownloads counts a download of the given version. The
+// increment is written to CouchDB by the next call to FlushDownloads.
+func IncrementVersionDownloads(c *Space, slug, version string) {
+	key := downloadsKey{space: c.prefix, slug: slug, version: version}
+	pendingDownloads.Lock()
+	pendingDownloads.counts[key]++
+	pendingDownloads.Unlock()
+}
+
+// GetVersionDownloads returns the number of downloads of the given version,
+// including the ones not flushed yet.
+func GetVersionDownloads(c *Space, slug, version string) (int64, error) {
+	rows, err := c.DownloadsDB().Query(ctx, downloadsDesignDoc, downloadsView, map[string]interface{}{
+		"key":    []string{slug, version},
+		"reduce": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int64
+	if rows.Next() {
+		if err = rows.ScanValue(&count); err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	pendingDownloads.Lock()
+	count += pendingDownloads.counts[downloadsKey{space: c.prefix, slug: slug, version: version}]
+	pendingDownloads.Unlock()
+	return count, nil
+}
+
+// FlushDownloads writes the buffered downloads counters to CouchDB. The
+// counters that could not be written are kept for the next flush.
+func FlushDownloads() error {
+	pendingDownloads.Lock()
+	counts := pendingDownloads.counts
+	pendingDownloads.counts = make(map[downloadsKey]int64)
+	pendingDownloads.Unlock()
+
+	var firstErr error
+	now := time.Now().UTC()
+	for key, count := range counts {
+		c, ok := spaces[key.space]
+		if !ok {
+			continue
+		}
+		doc := &downloadsCount{
+			Slug:      key.slug,
+			Version:   key.version,
+			Count:     count,
+			CreatedAt: now,
+		}
+		if _, _, err := c.DownloadsDB().CreateDoc(ctx, doc); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			pendingDownloads.Lock()
+			pendingDownloads.counts[key] += count
+			pendingDownloads.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// StartDownloadsFlusher flushes the downloads counters every
+// DownloadsFlushInterval, until the returned function is called. This
+// function does a last flush before returning.
+func StartDownloadsFlusher() (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(DownloadsFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := FlushDownloads(); err != nil {
+					logrus.WithField("nspace", "downloads").Errorf("Could not flush the downloads counters: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		if err := FlushDownloads(); err != nil {
+			logrus.WithField("nspace", "downloads").Errorf("Could not flush the downloads counters: %s", err)
+		}
+	}
+}
+
+// RefreshPopularity sets the total number of downloads of the applications of
+// the space on their documents, so that they can be sorted on it. The
+// applications modified concurrently are skipped, and refreshed by the next
+// call. It returns the number of applications updated.
+func RefreshPopularity(c *Space) (int, error) {
+	totals, err := appsDownloads(c)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := c.AppsDB().AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var doc json.RawMessage
+		if err = rows.ScanDoc(&doc); err != nil {
+			return count, err
+		}
+		fields, err := popularityUpdate(doc, totals[rows.ID()])
+		if err != nil {
+			return count, err
+		}
+		if fields == nil {
+			continue
+		}
+		if _, err = c.AppsDB().Put(ctx, rows.ID(), fields); err != nil {
+			if kivik.StatusCode(err) != http.StatusConflict {
+				return count, err
+			}
+			logrus.WithFields(logrus.Fields{
+				"nspace": "downloads",
+				"space":  c.prefix,
+				"slug":   rows.ID(),
+			}).Warn("Application modified concurrently: popularity not refreshed")
+			continue
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// popularityUpdate returns the fields of the given document with its total
+// number of downloads set, or nil if the document is up to date. The other
+// fields are kept as they were read, so that they are written back unchanged.
+// The documents written before the downloads counters do not have the field,
+// and are updated even without downloads, to be listed when sorting on it.
+func popularityUpdate(doc json.RawMessage, total int64) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	if raw, ok := fields["total_downloads"]; ok {
+		var current int64
+		if err := json.Unmarshal(raw, &current); err == nil && current == total {
+			return nil, nil
+		}
+	}
+	fields["total_downloads"] = json.RawMessage(strconv.FormatInt(total, 10))
+	return fields, nil
+}
+
+// appsDownloads returns the total number of downloads of the versions of each
+// application of the space.
+func appsDownloads(c *Space) (map[string]int64, error) {
+	rows, err := c.DownloadsDB().Query(ctx, downloadsDesignDoc, downloadsView, map[string]interface{}{
+		"reduce":      true,
+		"group_level": 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var key []string
+		var total int64
+		if err = rows.ScanKey(&key); err != nil {
+			return nil, err
+		}
+		if err = rows.ScanValue(&total); err != nil {
+			return nil, err
+		}
+		if len(key) > 0 {
+			totals[key[0]] = total
+		}
+	}
+	return totals, rows.Err()
+}
+
+// ensureDownloadsViews creates the design document of the downloads database
+// if it does not exist yet.
+func ensureDownloadsViews(c *Space) error {
+	var ddoc struct {
+		Rev string `json:"_rev"`
+	}
+	err := c.DownloadsDB().Get(ctx, "_design/"+downloadsDesignDoc).ScanDoc(&ddoc)
+	if err == nil {
+		return nil
+	}
+	if kivik.StatusCode(err) != http.StatusNotFound {
+		return err
+	}
+	_, err = c.DownloadsDB().Put(ctx, "_design/"+downloadsDesignDoc, downloadsDesign)
+	return err
+}
@@ -10,7 +10,11 @@ import (
 	"io"
 	"io/ioutil"
 	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
 
 	"github.com/go-kivik/kivik"
 )
@@ -172,6 +176,8 @@ func Import(in io.Reader) (err error) {
 	}()
 
 	docs := make(map[string]string) // id -> rev of created documents
+	now := time.Now().UTC()
+	client := dbClient()
 
 	tr := tar.NewReader(zr)
 	for {
@@ -241,6 +247,11 @@ func Import(in io.Reader) (err error) {
 		if err = json.NewDecoder(tr).Decode(&v); err != nil {
 			return err
 		}
+		if strings.HasSuffix(dbName, "-"+versDBSuffix) {
+			if v, err = markImportedVersion(v, now); err != nil {
+				return err
+			}
+		}
 		fmt.Printf("Creating document %q...", fmt.Sprintf("%s/%s", dbName, docID))
 		id, rev, err := db.CreateDoc(ctx, v)
 		if err != nil {
@@ -253,3 +264,138 @@ func Import(in io.Reader) (err error) {
 
 	return nil
 }
+
+// markImportedVersion sets the publication date of an imported version to
+// the date of the import, unless the export already has one: restoring a dump
+// of this registry must keep the original publication dates. Its creation
+// date is kept from the export, so that the versions keep their order in the
+// views.
+func markImportedVersion(doc json.RawMessage, now time.Time) (json.RawMessage, error) {
+	var v map[string]interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	if published, ok := v["published_at"]; ok && published != nil {
+		return doc, nil
+	}
+	v["published_at"] = now
+	return json.Marshal(v)
+}
+
+// AppExport is a portable dump of an application with all its published
+// versions. The attachments of the versions are not included, only their
+// names: they are extracted again from the tarballs by ImportApp.
+type AppExport struct {
+	App         *App                `json:"app"`
+	Versions    []*Version          `json:"versions"`
+	Attachments map[string][]string `json:"attachments"`
+}
+
+// ExportApp returns the dump of the given application and of its published
+// versions, without their revisions.
+func ExportApp(c *Space, appSlug string) (*AppExport, error) {
+	app, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	app.Rev = ""
+
+	rows, err := versionViewQuery(ctx, c, c.VersDB(), appSlug, channelToStr(Dev), map[string]interface{}{
+		"descending":   false,
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exp := &AppExport{
+		App:         app,
+		Versions:    make([]*Version, 0),
+		Attachments: make(map[string][]string),
+	}
+	for rows.Next() {
+		var ver *Version
+		if err = rows.ScanDoc(&ver); err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(ver.Attachments))
+		for name := range ver.Attachments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		exp.Attachments[ver.Version] = names
+		ver.Rev = ""
+		ver.Attachments = nil
+		exp.Versions = append(exp.Versions, ver)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return exp, nil
+}
+
+// ImportApp recreates the application and the versions of the given dump. It
+// is idempotent: the application and the versions that already exist are
+// skipped. Like for a restore, the imported versions without a publication
+// date are marked as published at the date of the import. The attachments of the versions are extracted from their
+// tarballs, downloaded from their URL.
+func ImportApp(c *Space, exp *AppExport, editor *auth.Editor) error {
+	if exp.App == nil {
+		return fmt.Errorf("Invalid application export: the application is missing")
+	}
+	if !strings.EqualFold(exp.App.Editor, editor.Name()) {
+		return ErrAppEditorMismatch
+	}
+
+	app, err := findApp(ctx, c, exp.App.Slug)
+	if err == ErrAppNotFound {
+		app = &App{}
+		*app = *exp.App
+		app.ID = getAppID(app.Slug)
+		app.Rev = ""
+		app.Versions = nil
+		app.LatestVersion = nil
+		if _, app.Rev, err = c.AppsDB().CreateDoc(ctx, app); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !strings.EqualFold(app.Editor, editor.Name()) {
+		return ErrAppEditorMismatch
+	}
+
+	for _, exported := range exp.Versions {
+		_, err = FindPublishedVersion(ctx, c, app.Slug, exported.Version)
+		if err == nil {
+			continue
+		}
+		if err != ErrVersionNotFound {
+			return err
+		}
+
+		downloaded, attachments, err := downloadVersion(ctx, c, &VersionOptions{
+			Version: exported.Version,
+			URL:     exported.URL,
+			Sha256:  exported.Sha256,
+			Sha512:  exported.Sha512,
+		})
+		if err != nil {
+			return fmt.Errorf("Could not import version %s: %s", exported.Version, err)
+		}
+
+		ver := *exported
+		ver.ID = getVersionID(app.Slug, ver.Version)
+		ver.Rev = ""
+		ver.Attachments = nil
+		ver.TarballObject = downloaded.TarballObject
+		if ver.PublishedAt == nil {
+			now := time.Now().UTC()
+			ver.PublishedAt = &now
+		}
+		if err = importReleaseVersion(c, &ver, attachments, app); err != nil {
+			return fmt.Errorf("Could not import version %s: %s", exported.Version, err)
+		}
+	}
+	return nil
+}
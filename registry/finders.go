@@ -1,16 +1,25 @@
 package registry
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/cozy/cozy-apps-registry/errshttp"
 	"github.com/cozy/cozy-apps-registry/lru"
 
 	"github.com/cozy/echo"
 	"github.com/go-kivik/kivik"
+	"github.com/sirupsen/logrus"
 )
 
 var validFilters = []string{
@@ -28,18 +37,103 @@ var validSorts = []string{
 	"category",
 	"created_at",
 	"updated_at",
+	// Applications without a stable version are not listed when sorting on
+	// the date of their latest version
+	"latest_version_created_at",
+	// Sorts on the total_downloads field, refreshed by RefreshPopularity
+	"downloads",
+}
+
+// sortFieldName returns the field of the applications documents used for the
+// given sort.
+func sortFieldName(sort string) string {
+	if sort == "downloads" {
+		return "total_downloads"
+	}
+	return sort
 }
 
 const maxLimit = 200
 
+// maxCountLimit is the maximum number of applications that are counted when
+// computing the total of a listing. Beyond it, ErrAppsCountExceeded is
+// returned rather than a wrong total.
+const maxCountLimit = 100000
+
+// warnedSearchIndexes are the indexes for which a search not covered by the
+// index has already been logged.
+var warnedSearchIndexes sync.Map
+
 // basic caching system. could be generalized, was installed for a quick win:
 // two caches are added for latest versions ans versions list, since this data
 // is being fetched form couch for each application, this avoids 1+2*N rtts.
+// The published versions are also cached, to serve their attachments with
+// their date of publication without an extra request.
 var (
-	cacheVersionsLatest = lru.New(256, 5*time.Minute)
-	cacheVersionsList   = lru.New(256, 5*time.Minute)
+	cacheVersionsLatest    = lru.New(defaultCacheSize, defaultCacheTTL)
+	cacheVersionsList      = lru.New(defaultCacheSize, defaultCacheTTL)
+	cacheVersionsPublished = lru.New(defaultCacheSize, defaultCacheTTL)
+)
+
+const (
+	defaultCacheSize = 256
+	defaultCacheTTL  = 5 * time.Minute
 )
 
+// CacheConfig contains the configuration of the versions caches. The zero
+// values are replaced by the defaults.
+type CacheConfig struct {
+	VersionsLatestSize    int
+	VersionsListSize      int
+	VersionsPublishedSize int
+	TTL                   time.Duration
+}
+
+// InitCaches rebuilds the versions caches with the given configuration. The
+// caches are not protected against a concurrent replacement, so it should be
+// called before serving the registry.
+func InitCaches(cfg CacheConfig) {
+	if cfg.VersionsLatestSize <= 0 {
+		cfg.VersionsLatestSize = defaultCacheSize
+	}
+	if cfg.VersionsListSize <= 0 {
+		cfg.VersionsListSize = defaultCacheSize
+	}
+	if cfg.VersionsPublishedSize <= 0 {
+		cfg.VersionsPublishedSize = defaultCacheSize
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultCacheTTL
+	}
+	cacheVersionsLatest = lru.New(cfg.VersionsLatestSize, cfg.TTL)
+	cacheVersionsList = lru.New(cfg.VersionsListSize, cfg.TTL)
+	cacheVersionsPublished = lru.New(cfg.VersionsPublishedSize, cfg.TTL)
+}
+
+// InvalidateVersionsCache removes the cached latest versions and versions
+// lists of all the channels of the given application.
+func InvalidateVersionsCache(appSlug string) {
+	for _, channel := range []Channel{Stable, Patch, Beta, Dev} {
+		key := lru.Key(appSlug + "/" + channelToStr(channel))
+		cacheVersionsLatest.Remove(key)
+		cacheVersionsList.Remove(key)
+	}
+	cacheVersionsList.Remove(lru.Key(appSlug + "/all"))
+}
+
+// publishedVersionKey returns the key of the given version in the cache of
+// the published versions. Contrary to the other caches, the versions are
+// looked up by their number, which may exist in several spaces.
+func publishedVersionKey(c *Space, appSlug, version string) lru.Key {
+	return lru.Key(c.prefix + "/" + appSlug + "/" + version)
+}
+
+// forgetPublishedVersion removes a deleted version from the cache of the
+// published versions.
+func forgetPublishedVersion(c *Space, appSlug, version string) {
+	cacheVersionsPublished.Remove(publishedVersionKey(c, appSlug, version))
+}
+
 func getVersionID(appSlug, version string) string {
 	return getAppID(appSlug) + "-" + version
 }
@@ -48,7 +142,7 @@ func getAppID(appSlug string) string {
 	return strings.ToLower(appSlug)
 }
 
-func findApp(c *Space, appSlug string) (*App, error) {
+func findApp(ctx context.Context, c *Space, appSlug string) (*App, error) {
 	if !validSlugReg.MatchString(appSlug) {
 		return nil, ErrAppSlugInvalid
 	}
@@ -68,18 +162,35 @@ func findApp(c *Space, appSlug string) (*App, error) {
 	return doc, nil
 }
 
-func FindApp(c *Space, appSlug string, channel Channel) (*App, error) {
-	doc, err := findApp(c, appSlug)
+// LatestVersionChannels are the channels in which FindApp looks for the latest
+// version of an application, in order, so that an application without stable
+// version still shows its latest patch, beta or dev one.
+var LatestVersionChannels = []Channel{Stable, Patch, Beta, Dev}
+
+// FindApp returns the application with its versions of the given channel, its
+// latest version, looked up in LatestVersionChannels, and its label. It costs
+// several requests to CouchDB: FindAppMeta should be preferred when only the
+// metadata of the application are needed.
+//
+// It returns ErrAppNotFound for a slug that has never been used, and an
+// AppArchivedError for an archived application.
+func FindApp(ctx context.Context, c *Space, appSlug string, channel Channel) (*App, error) {
+	doc, err := findApp(ctx, c, appSlug)
 	if err != nil {
 		return nil, err
 	}
+	if err = ArchivedAppError(doc); err != nil {
+		return nil, err
+	}
 
 	doc.DataUsageCommitment, doc.DataUsageCommitmentBy = defaultDataUserCommitment(doc, nil)
-	doc.Versions, err = FindAppVersions(c, doc.Slug, channel)
+	doc.Versions, err = FindAppVersions(ctx, c, doc.Slug, channel)
 	if err != nil {
 		return nil, err
 	}
-	doc.LatestVersion, err = FindLatestVersion(c, doc.Slug, Stable)
+	doc.LatestVersion, err = latestVersionWithFallback(LatestVersionChannels, func(ch Channel) (*Version, error) {
+		return FindLatestVersion(ctx, c, doc.Slug, ch)
+	})
 	if err != nil && err != ErrVersionNotFound {
 		return nil, err
 	}
@@ -88,34 +199,157 @@ func FindApp(c *Space, appSlug string, channel Channel) (*App, error) {
 	return doc, nil
 }
 
-func FindAppAttachment(c *Space, appSlug, filename string, channel Channel) (*kivik.Attachment, error) {
+// ArchivedAppError returns the error telling that the application has been
+// archived, or nil if it has not.
+func ArchivedAppError(app *App) error {
+	if !app.Archived {
+		return nil
+	}
+	if app.ReplacedBy != "" {
+		return &AppArchivedError{ReplacedBy: app.ReplacedBy}
+	}
+	return ErrAppArchived
+}
+
+// latestVersionWithFallback returns the latest version found in the first of
+// the given channels that has one, or ErrVersionNotFound.
+func latestVersionWithFallback(channels []Channel, find func(Channel) (*Version, error)) (*Version, error) {
+	for _, ch := range channels {
+		ver, err := find(ch)
+		if err != ErrVersionNotFound {
+			return ver, err
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+// FindAppMeta returns the application as it is stored, with only its data
+// usage commitment defaulted. Its versions, latest version and label are not
+// looked up, contrary to FindApp.
+func FindAppMeta(ctx context.Context, c *Space, appSlug string) (*App, error) {
+	doc, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	doc.DataUsageCommitment, doc.DataUsageCommitmentBy = defaultDataUserCommitment(doc, nil)
+	return doc, nil
+}
+
+// Attachment is an attachment of a version, with the metadata needed to
+// answer conditional HTTP requests.
+type Attachment struct {
+	*kivik.Attachment
+	// ETag is the digest of the attachment computed by CouchDB, or one
+	// derived from the version checksum if it is not available.
+	ETag string
+	// LastModified is the date of publication of the version.
+	LastModified time.Time
+	// Download is true when the type of the attachment is not allowed: it is
+	// then served as application/octet-stream, and should be downloaded
+	// instead of being displayed.
+	Download bool
+}
+
+func FindAppAttachment(ctx context.Context, c *Space, appSlug, filename string, channel Channel) (*Attachment, error) {
 	if !validSlugReg.MatchString(appSlug) {
 		return nil, ErrAppSlugInvalid
 	}
 
-	ver, err := FindLatestVersion(c, appSlug, channel)
+	ver, err := FindLatestVersion(ctx, c, appSlug, channel)
 	if err != nil {
 		return nil, err
 	}
 
-	return FindVersionAttachment(c, appSlug, ver.Version, filename)
+	return findVersionAttachment(ctx, c, ver, filename)
 }
 
-func FindVersionAttachment(c *Space, appSlug, version, filename string) (*kivik.Attachment, error) {
-	db := c.VersDB()
-
-	att, err := db.GetAttachment(ctx, getVersionID(appSlug, version), "", filename)
+func FindVersionAttachment(ctx context.Context, c *Space, appSlug, version, filename string) (*Attachment, error) {
+	ver, err := findCachedPublishedVersion(ctx, c, appSlug, version)
 	if err != nil {
-		if kivik.StatusCode(err) == http.StatusNotFound {
-			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Could not find attachment %q", filename))
+		return nil, err
+	}
+
+	return findVersionAttachment(ctx, c, ver, filename)
+}
+
+// findCachedPublishedVersion returns the given published version, like
+// FindPublishedVersion, but from the cache of the published versions when
+// possible. A published version does not change, so its cache entry only has
+// to be removed when it is deleted.
+func findCachedPublishedVersion(ctx context.Context, c *Space, appSlug, version string) (*Version, error) {
+	key := publishedVersionKey(c, appSlug, version)
+	if data, ok := cacheVersionsPublished.Get(key); ok {
+		var ver *Version
+		if err := json.Unmarshal(data, &ver); err == nil {
+			return ver, nil
 		}
+	}
+
+	ver, err := FindPublishedVersion(ctx, c, appSlug, version)
+	if err != nil {
 		return nil, err
 	}
+	if data, err := json.Marshal(ver); err == nil {
+		cacheVersionsPublished.Add(key, lru.Value(data))
+	}
+	return ver, nil
+}
 
-	return att, nil
+// OpenVersionAttachment returns a reader on the content of the given
+// attachment of a version, with its MIME type, detected from its first bytes,
+// and its size. The reader must be closed by the caller.
+func OpenVersionAttachment(ctx context.Context, c *Space, appSlug, version, filename string) (io.ReadCloser, string, int64, error) {
+	att, err := FindVersionAttachment(ctx, c, appSlug, version, filename)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return att.Content, att.ContentType, att.Size, nil
 }
 
-func findVersion(appSlug, version string, dbs ...*kivik.DB) (*Version, error) {
+func findVersionAttachment(ctx context.Context, c *Space, ver *Version, filename string) (*Attachment, error) {
+	db := c.VersDB()
+
+	att, err := db.GetAttachment(ctx, getVersionID(ver.Slug, ver.Version), "", filename)
+	if err != nil {
+		return nil, wrapAttachmentError(err, filename)
+	}
+
+	etag := att.Digest
+	if etag == "" {
+		sum := sha256.Sum256([]byte(ver.Sha256 + "/" + filename))
+		etag = hex.EncodeToString(sum[:16])
+	}
+	lastModified := ver.CreatedAt
+	if ver.PublishedAt != nil {
+		lastModified = *ver.PublishedAt
+	}
+
+	attachment := &Attachment{
+		Attachment:   att,
+		ETag:         etag,
+		LastModified: lastModified,
+	}
+	sniffAttachment(attachment, filename)
+	return attachment, nil
+}
+
+// wrapAttachmentError classifies the errors returned by CouchDB when fetching
+// an attachment: a missing attachment is a 404, and the other failures of the
+// storage are reported as a bad gateway instead of an internal error.
+func wrapAttachmentError(err error, filename string) error {
+	switch code := kivik.StatusCode(err); {
+	case code == http.StatusNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Could not find attachment %q", filename))
+	case code == http.StatusServiceUnavailable:
+		return errshttp.NewError(http.StatusServiceUnavailable,
+			"Could not fetch attachment %q: storage is unavailable: %s", filename, err)
+	default:
+		return errshttp.NewError(http.StatusBadGateway,
+			"Could not fetch attachment %q: %s", filename, err)
+	}
+}
+
+func findVersion(ctx context.Context, appSlug, version string, dbs ...*kivik.DB) (*Version, error) {
 	if !validSlugReg.MatchString(appSlug) {
 		return nil, ErrAppSlugInvalid
 	}
@@ -143,36 +377,94 @@ func findVersion(appSlug, version string, dbs ...*kivik.DB) (*Version, error) {
 	return nil, ErrVersionNotFound
 }
 
-func FindPendingVersion(c *Space, appSlug, version string) (*Version, error) {
+func FindPendingVersion(ctx context.Context, c *Space, appSlug, version string) (*Version, error) {
 	// Test for pending version
-	return findVersion(appSlug, version, c.dbPendingVers)
+	ver, err := findVersion(ctx, appSlug, version, c.dbPendingVers)
+	if err != nil {
+		return nil, err
+	}
+	ver.pending = true
+	return ver, nil
 }
 
-func FindPublishedVersion(c *Space, appSlug, version string) (*Version, error) {
+func FindPublishedVersion(ctx context.Context, c *Space, appSlug, version string) (*Version, error) {
 	// Test for released version only
-	return findVersion(appSlug, version, c.dbVers)
+	return findVersion(ctx, appSlug, version, c.dbVers)
+}
+
+func FindVersion(ctx context.Context, c *Space, appSlug, version string) (*Version, error) {
+	// Test for released version, then for pending version
+	ver, err := findVersion(ctx, appSlug, version, c.dbVers)
+	if err != ErrVersionNotFound {
+		return ver, err
+	}
+	return FindPendingVersion(ctx, c, appSlug, version)
+}
+
+// AppExists returns true if an application with the given slug exists,
+// archived or not. It only asks CouchDB for the revision of the document, with
+// a HEAD request, instead of fetching it.
+func AppExists(c *Space, appSlug string) (bool, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return false, ErrAppSlugInvalid
+	}
+	return docExists(c.AppsDB(), getAppID(appSlug))
+}
+
+// VersionExists returns true if the given version exists, either published
+// or pending, like FindVersion, without fetching its document.
+func VersionExists(c *Space, appSlug, version string) (bool, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return false, ErrAppSlugInvalid
+	}
+	if !validVersionReg.MatchString(version) {
+		return false, ErrVersionInvalid
+	}
+	for _, db := range []*kivik.DB{c.dbVers, c.dbPendingVers} {
+		ok, err := docExists(db, getVersionID(appSlug, version))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
 }
 
-func FindVersion(c *Space, appSlug, version string) (*Version, error) {
-	// Test for pending and released version
-	return findVersion(appSlug, version, c.dbVers, c.dbPendingVers)
+func docExists(db *kivik.DB, docID string) (bool, error) {
+	if _, err := db.Rev(ctx, docID); err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
-func versionViewQuery(c *Space, db *kivik.DB, appSlug, channel string, opts map[string]interface{}) (*kivik.Rows, error) {
-	rows, err := db.Query(ctx, versViewDocName(appSlug), channel, opts)
+func versionViewQuery(ctx context.Context, c *Space, db *kivik.DB, appSlug, channel string, opts map[string]interface{}) (*kivik.Rows, error) {
+	query := opts
+	if _, ok := opts["reduce"]; !ok {
+		query = make(map[string]interface{}, len(opts)+1)
+		for k, v := range opts {
+			query[k] = v
+		}
+		query["reduce"] = false
+	}
+	if SharedVersionsViews {
+		query = sharedViewOptions(appSlug, query)
+	}
+	rows, err := db.Query(ctx, versViewDocName(appSlug), channel, query)
 	if err != nil {
 		if kivik.StatusCode(err) == http.StatusNotFound {
 			if err = createVersionsViews(c, appSlug); err != nil {
 				return nil, err
 			}
-			return versionViewQuery(c, db, appSlug, channel, opts)
+			return versionViewQuery(ctx, c, db, appSlug, channel, opts)
 		}
 		return nil, err
 	}
 	return rows, nil
 }
 
-func FindLatestVersion(c *Space, appSlug string, channel Channel) (*Version, error) {
+func FindLatestVersion(ctx context.Context, c *Space, appSlug string, channel Channel) (*Version, error) {
 	if !validSlugReg.MatchString(appSlug) {
 		return nil, ErrAppSlugInvalid
 	}
@@ -188,7 +480,7 @@ func FindLatestVersion(c *Space, appSlug string, channel Channel) (*Version, err
 	}
 
 	db := c.VersDB()
-	rows, err := versionViewQuery(c, db, appSlug, channelStr, map[string]interface{}{
+	rows, err := versionViewQuery(ctx, c, db, appSlug, channelStr, map[string]interface{}{
 		"limit":        1,
 		"descending":   true,
 		"include_docs": true,
@@ -218,46 +510,208 @@ func FindLatestVersion(c *Space, appSlug string, channel Channel) (*Version, err
 	return latestVersion, nil
 }
 
-func FindAppVersions(c *Space, appSlug string, channel Channel) (*AppVersions, error) {
-	db := c.VersDB()
-
+// FindLatestVersions returns the latest versions of the given channel of
+// several applications, indexed by their slugs. The applications without
+// version in this channel are absent from the map.
+//
+// When SharedVersionsViews is false, the views are defined per application:
+// the stable versions missing from the cache are fetched with two bulk
+// requests, using the latest stable version denormalized on the applications
+// documents. This field can be outdated, so these versions are not cached.
+// The other versions are looked up with FindLatestVersion, which issues one
+// query bounded by the slug, on the shared view or on the view of the
+// application, and fills its cache.
+func FindLatestVersions(ctx context.Context, c *Space, slugs []string, channel Channel) (map[string]*Version, error) {
 	channelStr := channelToStr(channel)
+	versions := make(map[string]*Version, len(slugs))
+	seen := make(map[string]bool, len(slugs))
+	var missing []string
+	for _, slug := range slugs {
+		if !validSlugReg.MatchString(slug) {
+			return nil, ErrAppSlugInvalid
+		}
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		if data, ok := cacheVersionsLatest.Get(lru.Key(slug + "/" + channelStr)); ok {
+			var ver *Version
+			if err := json.Unmarshal(data, &ver); err == nil {
+				versions[slug] = ver
+				continue
+			}
+		}
+		missing = append(missing, slug)
+	}
 
-	key := lru.Key(appSlug + "/" + channelStr)
-	if data, ok := cacheVersionsList.Get(key); ok {
-		var versions *AppVersions
-		if err := json.Unmarshal(data, &versions); err == nil {
-			return versions, nil
+	if channel == Stable && !SharedVersionsViews && len(missing) > 0 {
+		var err error
+		missing, err = findLatestStableVersions(ctx, c, missing, versions)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	rows, err := versionViewQuery(c, db, appSlug, channelStr, map[string]interface{}{
-		"limit":      2000,
-		"descending": false,
+	for _, slug := range missing {
+		ver, err := FindLatestVersion(ctx, c, slug, channel)
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions[slug] = ver
+	}
+	return versions, nil
+}
+
+// findLatestStableVersions fetches the latest stable versions of the given
+// applications in bulk, and adds them to the versions map. They are not added
+// to the cache, as the latest stable version denormalized on the applications
+// documents can be outdated. It returns the slugs of the applications whose
+// latest stable version is not known from their documents.
+func findLatestStableVersions(ctx context.Context, c *Space, slugs []string, versions map[string]*Version) ([]string, error) {
+	appIDs := make([]string, len(slugs))
+	for i, slug := range slugs {
+		appIDs[i] = getAppID(slug)
+	}
+	rows, err := c.AppsDB().AllDocs(ctx, map[string]interface{}{
+		"keys":         appIDs,
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]string, len(slugs))
+	for rows.Next() {
+		var doc struct {
+			Slug                string `json:"slug"`
+			LatestStableVersion string `json:"latest_stable_version"`
+		}
+		// The keys without document, or deleted, can not be scanned.
+		if err := rows.ScanDoc(&doc); err != nil || doc.LatestStableVersion == "" {
+			continue
+		}
+		latest[doc.Slug] = doc.LatestStableVersion
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []string
+	verIDs := make([]string, 0, len(latest))
+	for _, slug := range slugs {
+		if version, ok := latest[slug]; ok {
+			verIDs = append(verIDs, getVersionID(slug, version))
+		} else {
+			remaining = append(remaining, slug)
+		}
+	}
+	if len(verIDs) == 0 {
+		return remaining, nil
+	}
+
+	rows, err = c.VersDB().AllDocs(ctx, map[string]interface{}{
+		"keys":         verIDs,
+		"include_docs": true,
 	})
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	for rows.Next() {
+		var data json.RawMessage
+		var ver *Version
+		if err := rows.ScanDoc(&data); err != nil || len(data) == 0 || string(data) == "null" {
+			continue
+		}
+		if err = json.Unmarshal(data, &ver); err != nil {
+			return nil, err
+		}
+		ver.ID = ""
+		ver.Rev = ""
+		ver.Attachments = nil
+		versions[ver.Slug] = ver
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The versions that could not be fetched, if the denormalized version is
+	// outdated, are looked up in the views.
+	for slug := range latest {
+		if _, ok := versions[slug]; !ok {
+			remaining = append(remaining, slug)
+		}
+	}
+	return remaining, nil
+}
 
-	allVersions := make([]string, int(rows.TotalRows()))
+// FindLatestVersionSince returns the latest version of the given channel, and
+// whether it was created after the since date. It allows the updaters to
+// skip the download of a version they already have.
+func FindLatestVersionSince(ctx context.Context, c *Space, appSlug string, channel Channel, since time.Time) (*Version, bool, error) {
+	ver, err := FindLatestVersion(ctx, c, appSlug, channel)
+	if err != nil {
+		return nil, false, err
+	}
+	return ver, ver.CreatedAt.After(since), nil
+}
+
+// versionRows is the subset of *kivik.Rows used to read the versions views.
+type versionRows interface {
+	Next() bool
+	ScanValue(dest interface{}) error
+	TotalRows() int64
+	Err() error
+}
+
+// scanVersions reads the version numbers emitted as values by a versions
+// view. It fails if the stream of the view has been interrupted, instead of
+// returning a truncated list.
+func scanVersions(rows versionRows) ([]string, error) {
+	allVersions := make([]string, 0, rows.TotalRows())
 	for rows.Next() {
 		var version string
-		if err = rows.ScanValue(&version); err != nil {
+		if err := rows.ScanValue(&version); err != nil {
 			return nil, err
 		}
 		allVersions = append(allVersions, version)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return allVersions, nil
+}
 
-	var stable, beta, dev []string
+// partitionVersions dispatches the versions returned by the view of the given
+// channel in the lists of the channels they belong to. The lists are
+// cumulative: a stable version is also listed in the patch, beta and dev
+// lists, a beta version in the beta and dev lists, and a dev version only in
+// the dev list.
+func partitionVersions(channel Channel, allVersions []string) *AppVersions {
+	var stable, patch, beta, dev []string
 	switch channel {
 	case Stable:
 		stable = allVersions
+	case Patch:
+		patch = allVersions
+		for _, v := range allVersions {
+			if GetVersionChannel(v) == Stable {
+				stable = append(stable, v)
+			}
+		}
 	case Beta:
 		beta = allVersions
 		for _, v := range allVersions {
-			if GetVersionChannel(v) == Stable {
+			switch GetVersionChannel(v) {
+			case Stable:
 				stable = append(stable, v)
+				fallthrough
+			case Patch:
+				patch = append(patch, v)
 			}
 		}
 	case Dev:
@@ -267,7 +721,10 @@ func FindAppVersions(c *Space, appSlug string, channel Channel) (*AppVersions, e
 			case Stable:
 				stable = append(stable, v)
 				fallthrough
-			default:
+			case Patch:
+				patch = append(patch, v)
+				fallthrough
+			case Beta:
 				beta = append(beta, v)
 			}
 		}
@@ -275,11 +732,102 @@ func FindAppVersions(c *Space, appSlug string, channel Channel) (*AppVersions, e
 		panic("unreachable")
 	}
 
-	versions := &AppVersions{
+	return &AppVersions{
 		Stable: stable,
+		Patch:  patch,
 		Beta:   beta,
 		Dev:    dev,
 	}
+}
+
+// CountAppVersions returns the number of versions of the application in the
+// given channel, using the reduce of the versions view instead of listing
+// them.
+func CountAppVersions(ctx context.Context, c *Space, appSlug string, channel Channel) (int, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return 0, ErrAppSlugInvalid
+	}
+
+	rows, err := versionViewQuery(ctx, c, c.VersDB(), appSlug, channelToStr(channel), map[string]interface{}{
+		"reduce": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	if rows.Next() {
+		if err = rows.ScanValue(&count); err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// LatestVersionDate returns the creation date of the most recent version of
+// the application in the given channel, using the reduce of the dates view
+// instead of fetching the version. Use FindLatestVersion to get the version
+// itself.
+func LatestVersionDate(ctx context.Context, c *Space, appSlug string, channel Channel) (time.Time, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return time.Time{}, ErrAppSlugInvalid
+	}
+
+	rows, err := versionViewQuery(ctx, c, c.VersDB(), appSlug, channelToStr(channel)+"-date", map[string]interface{}{
+		"reduce": true,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+
+	var date *time.Time
+	if rows.Next() {
+		if err = rows.ScanValue(&date); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return time.Time{}, err
+	}
+	if date == nil {
+		return time.Time{}, ErrVersionNotFound
+	}
+	return *date, nil
+}
+
+func FindAppVersions(ctx context.Context, c *Space, appSlug string, channel Channel) (*AppVersions, error) {
+	db := c.VersDB()
+
+	channelStr := channelToStr(channel)
+
+	key := lru.Key(appSlug + "/" + channelStr)
+	if data, ok := cacheVersionsList.Get(key); ok {
+		var versions *AppVersions
+		if err := json.Unmarshal(data, &versions); err == nil {
+			return versions, nil
+		}
+	}
+
+	rows, err := versionViewQuery(ctx, c, db, appSlug, channelStr, map[string]interface{}{
+		"limit":      2000,
+		"descending": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allVersions, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := partitionVersions(channel, allVersions)
 
 	if data, err := json.Marshal(versions); err == nil {
 		cacheVersionsList.Add(key, data)
@@ -288,13 +836,201 @@ func FindAppVersions(c *Space, appSlug string, channel Channel) (*AppVersions, e
 	return versions, nil
 }
 
+// FindAllAppVersions returns all the versions of the application, each one
+// in the list of its own channel. Contrary to FindAppVersions, the lists are
+// not cumulative: a stable version is only in the stable list. A single read
+// of the dev view is needed, as it contains the versions of all channels.
+func FindAllAppVersions(ctx context.Context, c *Space, appSlug string) (*AppVersions, error) {
+	key := lru.Key(appSlug + "/all")
+	if data, ok := cacheVersionsList.Get(key); ok {
+		var versions *AppVersions
+		if err := json.Unmarshal(data, &versions); err == nil {
+			return versions, nil
+		}
+	}
+
+	rows, err := versionViewQuery(ctx, c, c.VersDB(), appSlug, channelToStr(Dev), map[string]interface{}{
+		"limit":      2000,
+		"descending": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allVersions, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := splitVersionsByChannel(allVersions)
+
+	if data, err := json.Marshal(versions); err == nil {
+		cacheVersionsList.Add(key, data)
+	}
+
+	return versions, nil
+}
+
+// splitVersionsByChannel dispatches the versions in the list of their own
+// channel only.
+func splitVersionsByChannel(allVersions []string) *AppVersions {
+	versions := &AppVersions{}
+	for _, version := range allVersions {
+		switch GetVersionChannel(version) {
+		case Stable:
+			versions.Stable = append(versions.Stable, version)
+		case Patch:
+			versions.Patch = append(versions.Patch, version)
+		case Beta:
+			versions.Beta = append(versions.Beta, version)
+		case Dev:
+			versions.Dev = append(versions.Dev, version)
+		}
+	}
+	return versions
+}
+
+// FindVersionsForChannelRange returns the published versions of the given
+// channel that are between the min and max versions. An empty min or max
+// version means that the range is unbounded on this side. When inclusive is
+// true, the bounds themselves are part of the range.
+//
+// Note that in the dev channel, the versions sharing the same number are
+// all included or excluded together since their order only depends on their
+// creation date.
+func FindVersionsForChannelRange(ctx context.Context, c *Space, appSlug string, channel Channel, min, max string, inclusive bool) ([]*Version, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return nil, ErrAppSlugInvalid
+	}
+	if (min != "" && !validVersionReg.MatchString(min)) ||
+		(max != "" && !validVersionReg.MatchString(max)) {
+		return nil, ErrVersionInvalid
+	}
+	switch channel {
+	case Stable, Patch, Beta, Dev:
+	default:
+		return nil, ErrChannelInvalid
+	}
+
+	db := c.VersDB()
+	opts := channelRangeOptions(channel, min, max, inclusive)
+	rows, err := versionViewQuery(ctx, c, db, appSlug, channelToStr(channel), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]*Version, 0)
+	for rows.Next() {
+		var version *Version
+		if err = rows.ScanDoc(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrVersionNotFound
+	}
+
+	return versions, nil
+}
+
+// channelRangeOptions returns the options of the query of the versions view
+// of the given channel for the versions between min and max.
+func channelRangeOptions(channel Channel, min, max string, inclusive bool) map[string]interface{} {
+	opts := map[string]interface{}{
+		"limit":        2000,
+		"descending":   false,
+		"include_docs": true,
+	}
+	if min != "" {
+		startKey, before := versionViewKey(min, channel)
+		if !inclusive && !before {
+			startKey = append(startKey, map[string]interface{}{})
+		}
+		opts["startkey"] = startKey
+	}
+	if max != "" {
+		endKey, before := versionViewKey(max, channel)
+		if inclusive && !before {
+			endKey = append(endKey, map[string]interface{}{})
+		} else {
+			opts["inclusive_end"] = false
+		}
+		opts["endkey"] = endKey
+	}
+	return opts
+}
+
 type AppsListOptions struct {
-	Limit                int
-	Cursor               int
+	Limit int
+	// Cursor is the number of applications skipped. It is slow for deep pages,
+	// and inconsistent when applications are created concurrently: Token
+	// should be preferred.
+	//
+	// Deprecated: the int cursor is kept for one release for compatibility.
+	Cursor int
+	// Token is the opaque cursor of the page, as returned in NextToken by the
+	// previous page. When set, Cursor is ignored and Reverse is not supported.
+	Token string
+	// NextToken is set to the token of the next page, if there is one.
+	NextToken string
+
+	// Sort is the field the applications are sorted on, one of validSorts,
+	// prefixed by a "-" for the descending order. When sorting on
+	// latest_version_created_at, the applications without a stable version
+	// are not listed at all: the field is missing from their documents, and
+	// the selector of the sorted field only matches the documents having it.
 	Sort                 string
 	Filters              map[string]string
 	LatestVersionChannel Channel
 	VersionsChannel      Channel
+	// Search, when not empty, only keeps the applications whose slug or name
+	// in one of SearchLocales contains the given string, ignoring case.
+	Search string
+	// WithTotal asks for the total number of applications matching the
+	// filters, which is then set in the Total field. It costs an extra request
+	// to CouchDB, so it should only be used when needed.
+	WithTotal bool
+	Total     int
+	// Reverse returns the page placed before the cursor, instead of the one
+	// starting at the cursor, to allow navigating to the previous pages. The
+	// returned cursor is then the one of the previous page. It also requires
+	// counting the applications.
+	Reverse bool
+	// IncludeArchived also lists the applications that have been archived.
+	IncludeArchived bool
+	// IncludePrivate also lists the private applications.
+	IncludePrivate bool
+	// SummaryOnly skips the lookup of the versions of each application: only
+	// the latest stable version stored on the application is returned, and
+	// the label is not computed.
+	SummaryOnly bool
+	// ETag is set to a weak etag of the returned page, computed from the
+	// applications documents and from their versions and latest version.
+	// When it matches IfNoneMatch, NotModified is set to true.
+	IfNoneMatch string
+	ETag        string
+	NotModified bool
+	// CompatibleWith, when not empty, only keeps the applications whose latest
+	// version in LatestVersionChannel accepts this version of the stack. The
+	// applications are filtered after the pagination, so a page can contain
+	// fewer applications than the limit.
+	CompatibleWith string
+	// Locale, when not empty, keeps only the best matching locale of the name
+	// and description of the applications, with the fallbacks of
+	// LocalizedName. All the locales are returned by default.
+	Locale string
+	// FeaturedFirst lists the featured applications matching the filters
+	// before the others, the highest Featured first, on the first page only.
+	// They are then excluded from the following pages, and are not counted
+	// in the limit. It can not be used with Reverse, whose pages would miss
+	// the featured applications.
+	FeaturedFirst bool
 }
 
 func GetPendingVersions(c *Space) ([]*Version, error) {
@@ -317,13 +1053,26 @@ func GetPendingVersions(c *Space) ([]*Version, error) {
 		if err := rows.ScanDoc(&version); err != nil {
 			return nil, err
 		}
+		version.pending = true
 		versions = append(versions, version)
 	}
 
 	return versions, nil
 }
 
-func GetAppsList(c *Space, opts *AppsListOptions) (int, []*App, error) {
+func GetAppsList(ctx context.Context, c *Space, opts *AppsListOptions) (int, []*App, error) {
+	if opts.FeaturedFirst && opts.Reverse {
+		return 0, nil, ErrFeaturedFirstReverse
+	}
+
+	var stackVersion [3]int
+	if opts.CompatibleWith != "" {
+		var err error
+		if stackVersion, err = parseStackVersion(opts.CompatibleWith); err != nil {
+			return 0, nil, ErrCompatibleWithInvalid
+		}
+	}
+
 	db := c.AppsDB()
 	order := "asc"
 	sortField := opts.Sort
@@ -334,26 +1083,28 @@ func GetAppsList(c *Space, opts *AppsListOptions) (int, []*App, error) {
 	if sortField == "" || !stringInArray(sortField, validSorts) {
 		sortField = "slug"
 	}
-	sort := fmt.Sprintf(`{"%s": "%s"}`, sortField, order)
+	if opts.Reverse {
+		order = reverseOrder(order)
+	}
+	sort := fmt.Sprintf(`{"%s": "%s"}`, sortFieldName(sortField), order)
 	if sortField != "slug" {
 		sort += fmt.Sprintf(`,{"slug": "%s"}`, order)
 	}
 
-	selector := string(sprintfJSON(`%s: {"$gt": null}`, sortField))
-	for name, val := range opts.Filters {
-		if !stringInArray(name, validFilters) {
-			continue
-		}
-		if selector != "" {
-			selector += ","
+	// The filters are shared by the query of the featured applications.
+	filters := filtersSelector(opts)
+	selector := appsListSelector(sortField, filters, opts)
+	// The cursor is not part of the selector used to count the applications.
+	var afterSelector string
+	if opts.Token != "" {
+		after, err := DecodeCursor(opts.Token)
+		if err != nil {
+			return 0, nil, err
 		}
-		switch name {
-		case "tags", "locales":
-			tags := strings.Split(val, ",")
-			selector += string(sprintfJSON(`%s: {"$all": %s}`, name, tags))
-		default:
-			selector += string(sprintfJSON("%s: %s", name, val))
+		if opts.Reverse || after.Sort != sortField {
+			return 0, nil, ErrCursorInvalid
 		}
+		afterSelector = cursorSelector(after, order)
 	}
 
 	if opts.Limit == 0 {
@@ -365,14 +1116,61 @@ func GetAppsList(c *Space, opts *AppsListOptions) (int, []*App, error) {
 	designsCount := len(appsIndexes)
 	limit := opts.Limit + designsCount + 1
 	cursor := opts.Cursor
+	if opts.Token != "" {
+		cursor = 0
+	}
 	useIndex := "apps-index-by-" + sortField
+	if opts.Search != "" && !searchCoveredByIndex(sortField, opts) {
+		warnUncoveredSearch(useIndex)
+	}
+
+	// The featured applications are only listed on the first page.
+	withFeatured := opts.FeaturedFirst && opts.Cursor == 0 && opts.Token == "" && !opts.Reverse
+	var featured []*App
+	if withFeatured {
+		var err error
+		featured, err = findFeaturedApps(ctx, db, filters, opts)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var total int
+	if opts.WithTotal || opts.Reverse {
+		var err error
+		total, err = countApps(ctx, db, useIndex, selector)
+		if err != nil {
+			return 0, nil, err
+		}
+		opts.Total = total
+		// The featured applications are excluded from the main query, but
+		// are part of the total.
+		if opts.WithTotal && opts.FeaturedFirst {
+			featuredCount := len(featured)
+			if !withFeatured {
+				featuredCount, err = countApps(ctx, db, "apps-index-by-featured", featuredSelector(filters, opts))
+				if err != nil {
+					return 0, nil, err
+				}
+			}
+			opts.Total += featuredCount
+		}
+	}
+	if afterSelector != "" {
+		selector += "," + afterSelector
+	}
+
+	skip := cursor
+	if opts.Reverse {
+		skip = reverseSkip(cursor, total)
+	}
 	req := sprintfJSON(`{
   "use_index": %s,
   "selector": {`+selector+`},
   "skip": %s,
   "sort": [`+sort+`],
   "limit": %s
-}`, useIndex, cursor, limit)
+}`, useIndex, skip, limit)
 
 	rows, err := db.Find(ctx, req)
 	if err != nil {
@@ -391,47 +1189,359 @@ func GetAppsList(c *Space, opts *AppsListOptions) (int, []*App, error) {
 		}
 		res = append(res, doc)
 	}
-	if len(res) == 0 {
-		return -1, res, nil
+	res, cursor = paginate(res, opts.Limit, cursor, opts.Reverse)
+	if cursor >= 0 && !opts.Reverse {
+		opts.NextToken = EncodeCursor(appCursor(res[len(res)-1], sortField))
 	}
-
-	if len(res) > opts.Limit {
-		res = res[:opts.Limit]
-		cursor += len(res)
-	} else {
-		// we fetch one more element so we know in this case the end of the list
-		// has been reached.
-		cursor = -1
+	if withFeatured {
+		res = prependFeatured(featured, res)
 	}
 
 	for _, app := range res {
 		app.DataUsageCommitment, app.DataUsageCommitmentBy = defaultDataUserCommitment(app, nil)
-		app.Versions, err = FindAppVersions(c, app.Slug, opts.VersionsChannel)
+		if opts.Locale != "" {
+			app.collapseLocales(opts.Locale)
+		}
+		if opts.SummaryOnly {
+			continue
+		}
+		app.Versions, err = FindAppVersions(ctx, c, app.Slug, opts.VersionsChannel)
 		if err != nil {
 			return 0, nil, err
 		}
-		app.LatestVersion, err = FindLatestVersion(c, app.Slug, opts.LatestVersionChannel)
+		app.LatestVersion, err = FindLatestVersion(ctx, c, app.Slug, opts.LatestVersionChannel)
 		if err != nil && err != ErrVersionNotFound {
 			return 0, nil, err
 		}
 		app.Label = calculateAppLabel(app, app.LatestVersion)
 	}
 
+	if opts.CompatibleWith != "" {
+		res, err = filterCompatibleApps(ctx, c, res, opts, stackVersion)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// The etag is computed once the versions are known, as a new version
+	// changes the page without changing the applications documents. Only the
+	// latest stable version is denormalized on them, not the versions lists
+	// nor the latest versions of the other channels, so the enrichment can not
+	// be skipped when the etag matches.
+	opts.ETag = appsListETag(res, cursor, opts)
+	opts.NotModified = etagMatches(opts.IfNoneMatch, opts.ETag)
+
 	return cursor, res, nil
 }
 
-func GetMaintainanceApps(c *Space) ([]*App, error) {
-	req := `{
+// filtersSelector returns the part of the mango selector matching the filters
+// and the search of the given options.
+func filtersSelector(opts *AppsListOptions) string {
+	var filters string
+	for name, val := range opts.Filters {
+		if !stringInArray(name, validFilters) {
+			continue
+		}
+		if filters != "" {
+			filters += ","
+		}
+		switch name {
+		case "tags", "locales":
+			tags := strings.Split(val, ",")
+			filters += string(sprintfJSON(`%s: {"$all": %s}`, name, tags))
+		case "type", "editor", "category":
+			if strings.Contains(val, ",") {
+				vals := strings.Split(val, ",")
+				filters += string(sprintfJSON(`%s: {"$in": %s}`, name, vals))
+			} else {
+				filters += string(sprintfJSON("%s: %s", name, val))
+			}
+		default:
+			filters += string(sprintfJSON("%s: %s", name, val))
+		}
+	}
+	if opts.Search != "" {
+		if filters != "" {
+			filters += ","
+		}
+		filters += string(searchSelector(opts.Search))
+	}
+	return filters
+}
+
+// appsListSelector returns the mango selector of the applications listed
+// with the given sort field, filters and options, without the cursor.
+func appsListSelector(sortField, filters string, opts *AppsListOptions) string {
+	selector := string(sprintfJSON(`%s: {"$gt": null}`, sortFieldName(sortField)))
+	if filters != "" {
+		selector += "," + filters
+	}
+	if excluded := exclusionSelector(opts); excluded != "" {
+		selector += "," + excluded
+	}
+	return selector
+}
+
+// filterCompatibleApps returns the applications whose latest version accepts
+// the given version of the stack. The latest versions are looked up when they
+// have not been already, with SummaryOnly.
+func filterCompatibleApps(ctx context.Context, c *Space, apps []*App, opts *AppsListOptions, stackVersion [3]int) ([]*App, error) {
+	compatibles := make([]*App, 0, len(apps))
+	for _, app := range apps {
+		latest := app.LatestVersion
+		if opts.SummaryOnly {
+			var err error
+			latest, err = FindLatestVersion(ctx, c, app.Slug, opts.LatestVersionChannel)
+			if err != nil && err != ErrVersionNotFound {
+				return nil, err
+			}
+		}
+		if latest != nil && latest.isCompatibleWith(stackVersion) {
+			compatibles = append(compatibles, app)
+		}
+	}
+	return compatibles, nil
+}
+
+// findFeaturedApps returns the featured applications matching the filters,
+// sorted by decreasing rank. It relies on the by-featured index of
+// appsIndexes.
+func findFeaturedApps(ctx context.Context, db *kivik.DB, filters string, opts *AppsListOptions) ([]*App, error) {
+	req := sprintfJSON(`{
+  "use_index": "apps-index-by-featured",
+  "selector": {`+featuredSelector(filters, opts)+`},
+  "sort": [{"featured": "desc"}, {"slug": "desc"}],
+  "limit": %s
+}`, maxLimit)
+
+	rows, err := db.Find(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := make([]*App, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var doc *App
+		if err = rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		apps = append(apps, doc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sortFeaturedApps(apps)
+	return apps, nil
+}
+
+// featuredSelector returns the mango selector of the featured applications
+// matching the filters.
+func featuredSelector(filters string, opts *AppsListOptions) string {
+	selector := `"featured": {"$gt": 0}`
+	if filters != "" {
+		selector += "," + filters
+	}
+	// The featured applications themselves are not excluded from this query.
+	exclusion := *opts
+	exclusion.FeaturedFirst = false
+	if excluded := exclusionSelector(&exclusion); excluded != "" {
+		selector += "," + excluded
+	}
+	return selector
+}
+
+// sortFeaturedApps sorts the applications by decreasing rank, and then by
+// slug: mango can only sort all the fields in the same direction.
+func sortFeaturedApps(apps []*App) {
+	sort.SliceStable(apps, func(i, j int) bool {
+		if apps[i].Featured != apps[j].Featured {
+			return apps[i].Featured > apps[j].Featured
+		}
+		return apps[i].Slug < apps[j].Slug
+	})
+}
+
+// prependFeatured returns the page with the featured applications placed
+// before it. An application featured while the page was fetched is only kept
+// with the featured ones.
+func prependFeatured(featured, page []*App) []*App {
+	if len(featured) == 0 {
+		return page
+	}
+	res := make([]*App, 0, len(featured)+len(page))
+	slugs := make(map[string]bool, len(featured))
+	for _, app := range featured {
+		slugs[app.Slug] = true
+		res = append(res, app)
+	}
+	for _, app := range page {
+		if !slugs[app.Slug] {
+			res = append(res, app)
+		}
+	}
+	return res
+}
+
+// exclusionSelector returns the part of the mango selector excluding the
+// archived and private applications, unless asked otherwise, and the featured
+// ones when they are listed separately. A single $nor is
+// used, which also matches the documents without these fields. It does not
+// change the index used, which only depends on the sort field.
+func exclusionSelector(opts *AppsListOptions) string {
+	var excluded []string
+	if !opts.IncludeArchived {
+		excluded = append(excluded, `{"archived": true}`)
+	}
+	if !opts.IncludePrivate {
+		excluded = append(excluded, `{"private": true}`)
+	}
+	if opts.FeaturedFirst {
+		excluded = append(excluded, `{"featured": {"$gt": 0}}`)
+	}
+	if len(excluded) == 0 {
+		return ""
+	}
+	return `"$nor": [` + strings.Join(excluded, ",") + `]`
+}
+
+// appsListETag returns a weak etag of the given page of applications, derived
+// from their identifiers, revisions and modification dates, from their
+// versions and latest version when they have been looked up, from the
+// pagination meta returned with them, and from the options changing how they
+// are rendered.
+func appsListETag(apps []*App, next int, opts *AppsListOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s/%t/%s/%s\n", channelToStr(opts.LatestVersionChannel),
+		channelToStr(opts.VersionsChannel), opts.SummaryOnly, opts.CompatibleWith, opts.Locale)
+	fmt.Fprintf(h, "meta:%d/%s/%t/%d\n", next, opts.NextToken, opts.WithTotal, opts.Total)
+	for _, app := range apps {
+		fmt.Fprintf(h, "%s/%s/%s\n", app.ID, app.Rev, app.UpdatedAt.Format(time.RFC3339Nano))
+		if latest := app.LatestVersion; latest != nil {
+			published := latest.CreatedAt
+			if latest.PublishedAt != nil {
+				published = *latest.PublishedAt
+			}
+			fmt.Fprintf(h, "latest:%s/%s\n", latest.ID, published.Format(time.RFC3339Nano))
+		}
+		if versions := app.Versions; versions != nil {
+			fmt.Fprintf(h, "versions:%v/%v/%v/%v\n", versions.Stable, versions.Patch, versions.Beta, versions.Dev)
+		}
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches returns true if the etag is one of those listed in the given
+// if-none-match header value.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, match := range strings.Split(ifNoneMatch, ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate returns the page of applications from the fetched ones, and the
+// cursor to use to get the next page in the same direction, or -1 if the end
+// of the list has been reached. When reverse is true, the applications have
+// been fetched in the reversed order and the page is put back in the natural
+// order.
+func paginate(res []*App, limit, cursor int, reverse bool) ([]*App, int) {
+	if len(res) == 0 {
+		return res, -1
+	}
+
+	// we fetch one more element so we know when the end of the list has been
+	// reached.
+	hasMore := len(res) > limit
+	if hasMore {
+		res = res[:limit]
+	}
+	if reverse {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+		cursor -= len(res)
+	} else {
+		cursor += len(res)
+	}
+	if !hasMore {
+		cursor = -1
+	}
+	return res, cursor
+}
+
+// reverseSkip returns the number of elements to skip in the reversed list to
+// get the elements placed before the given cursor in the natural order.
+func reverseSkip(cursor, total int) int {
+	if skip := total - cursor; skip > 0 {
+		return skip
+	}
+	return 0
+}
+
+func reverseOrder(order string) string {
+	if order == "asc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+// countApps returns the number of applications matching the given selector,
+// or ErrAppsCountExceeded if there are more than maxCountLimit of them.
+func countApps(ctx context.Context, db *kivik.DB, useIndex, selector string) (int, error) {
+	// One more application than the limit is asked to tell when it is
+	// exceeded, and the design documents may be part of the results.
+	req := sprintfJSON(`{
+  "use_index": %s,
+  "selector": {`+selector+`},
+  "fields": ["_id"],
+  "limit": %s
+}`, useIndex, maxCountLimit+len(appsIndexes)+1)
+
+	rows, err := db.Find(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if count > maxCountLimit {
+		return 0, ErrAppsCountExceeded
+	}
+	return count, nil
+}
+
+// maintenanceAppsQuery is the mango query of the applications with an
+// activated maintenance. It relies on the by-maintenance index of appsIndexes.
+const maintenanceAppsQuery = `{
   "use_index": "apps-index-by-maintenance",
   "selector": {"maintenance_activated": true},
+  "sort": [{"maintenance_activated": "asc"}, {"slug": "asc"}],
   "limit": 1000
 }`
-	rows, err := c.dbApps.Find(ctx, req)
+
+func GetMaintainanceApps(c *Space) ([]*App, error) {
+	rows, err := c.dbApps.Find(ctx, maintenanceAppsQuery)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	apps := make([]*App, 0)
 	for rows.Next() {
 		var app App
@@ -441,8 +1551,52 @@ func GetMaintainanceApps(c *Space) ([]*App, error) {
 		if err = rows.ScanDoc(&app); err != nil {
 			return nil, err
 		}
+		// Scheduled maintenances are only returned during their window
+		if app.Private || !app.IsMaintenanceActive(now) {
+			continue
+		}
 		apps = append(apps, &app)
 	}
 
 	return apps, nil
 }
+
+// searchSelector returns the mango selector matching the applications whose
+// slug or name contains the given search. The names are indexed by locale, so
+// only the names in SearchLocales are searched.
+func searchSelector(search string) json.RawMessage {
+	re := searchRegexp(search)
+	fields := []string{"slug"}
+	for _, locale := range SearchLocales {
+		fields = append(fields, "name."+locale)
+	}
+	conds := make([]echo.Map, len(fields))
+	for i, field := range fields {
+		conds[i] = echo.Map{field: echo.Map{"$regex": re}}
+	}
+	return sprintfJSON(`"$or": %s`, conds)
+}
+
+// searchCoveredByIndex returns true if the index used for the given sort
+// field restricts the applications on which the $regex of a search is
+// evaluated: the first field of the index must be filtered on a single value.
+func searchCoveredByIndex(sortField string, opts *AppsListOptions) bool {
+	val, ok := opts.Filters[sortField]
+	return ok && stringInArray(sortField, validFilters) && !strings.Contains(val, ",")
+}
+
+// warnUncoveredSearch logs, once per index, that a search is evaluated by
+// CouchDB on every application of the index.
+func warnUncoveredSearch(useIndex string) {
+	if _, warned := warnedSearchIndexes.LoadOrStore(useIndex, true); warned {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"nspace": "registry",
+		"index":  useIndex,
+	}).Warn("Search is not covered by the apps index: the $regex selector is evaluated by CouchDB on every application")
+}
+
+func searchRegexp(search string) string {
+	return "(?i)" + regexp.QuoteMeta(search)
+}
@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+const (
+	defaultPublishPerMinute = 10
+	defaultPublishBurst     = 30
+)
+
+var ErrPublishRateExceeded = errshttp.NewError(http.StatusTooManyRequests, "Too many versions published by this editor, please retry later")
+
+// PublishRateConfig contains the configuration of the rate limiting of the
+// versions published by each editor. The zero values are replaced by the
+// defaults.
+type PublishRateConfig struct {
+	// PerMinute is the number of versions an editor can publish per minute,
+	// once its burst has been consumed.
+	PerMinute int
+	// Burst is the number of versions an editor can publish in a row.
+	Burst int
+}
+
+// tokenBucket is the state of the rate limiting of an editor: it is refilled
+// with PerMinute tokens per minute, up to Burst tokens, and each published
+// version consumes one token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type publishRateLimiter struct {
+	mu      sync.Mutex
+	cfg     PublishRateConfig
+	buckets map[string]*tokenBucket
+}
+
+var publishLimiter = newPublishRateLimiter(PublishRateConfig{})
+
+func newPublishRateLimiter(cfg PublishRateConfig) *publishRateLimiter {
+	if cfg.PerMinute <= 0 {
+		cfg.PerMinute = defaultPublishPerMinute
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = defaultPublishBurst
+	}
+	return &publishRateLimiter{
+		cfg:     cfg,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// InitPublishRateLimiter resets the rate limiting of the versions published by
+// the editors with the given configuration.
+func InitPublishRateLimiter(cfg PublishRateConfig) {
+	limiter := newPublishRateLimiter(cfg)
+	publishLimiter.mu.Lock()
+	defer publishLimiter.mu.Unlock()
+	publishLimiter.cfg = limiter.cfg
+	publishLimiter.buckets = limiter.buckets
+}
+
+// CheckPublishRate consumes a token of the bucket of the given editor, and
+// returns ErrPublishRateExceeded when the bucket is empty. It should be called
+// before creating a new version for the editor.
+func CheckPublishRate(editorName string) error {
+	return publishLimiter.allow(editorName, time.Now())
+}
+
+func (l *publishRateLimiter) allow(editorName string, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.cfg.Burst)
+	b, ok := l.buckets[editorName]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[editorName] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * float64(l.cfg.PerMinute)
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return ErrPublishRateExceeded
+	}
+	b.tokens--
+	return nil
+}
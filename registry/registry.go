@@ -2,28 +2,41 @@ package registry
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/errshttp"
-	"github.com/cozy/cozy-apps-registry/lru"
 	"github.com/cozy/cozy-apps-registry/magic"
 
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
 
 	"github.com/cozy/echo"
 	_ "github.com/go-kivik/couchdb" // for couchdb
@@ -31,44 +44,343 @@ import (
 	"github.com/go-kivik/kivik"
 )
 
-const maxApplicationSize = 20 * 1024 * 1024 // 20 Mo
+const defaultMaxApplicationSize = 20 * 1024 * 1024 // 20 Mo
 
 var (
 	validSlugReg    = regexp.MustCompile(`^[a-z0-9\-]*$`)
-	validVersionReg = regexp.MustCompile(`^(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})(-dev\.[a-f0-9]{1,40}|-beta.(0|[1-9][0-9]{0,4}))?$`)
+	validVersionReg = regexp.MustCompile(`^(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})(-dev\.[a-f0-9]{1,64}|-beta.(0|[1-9][0-9]{0,4})|-patch\.(0|[1-9][0-9]{0,4}))?$`)
 	validSpaceReg   = regexp.MustCompile(`^[a-z]+[a-z0-9\_\-]*$`)
+	validTagReg     = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
 
 	validAppTypes = []string{"webapp", "konnector"}
 )
 
 var (
-	ErrAppAlreadyExists  = errshttp.NewError(http.StatusConflict, "Application already exists")
-	ErrAppNotFound       = errshttp.NewError(http.StatusNotFound, "Application was not found")
-	ErrAppSlugMismatch   = errshttp.NewError(http.StatusBadRequest, "Application slug does not match the one specified in the body")
-	ErrAppSlugInvalid    = errshttp.NewError(http.StatusBadRequest, "Invalid application slug: should contain only lowercase alphanumeric characters and dashes")
-	ErrAppEditorMismatch = errshttp.NewError(http.StatusBadRequest, "Application can not be updated: editor can not change")
-
-	ErrVersionAlreadyExists = errshttp.NewError(http.StatusConflict, "Version already exists")
-	ErrVersionSlugMismatch  = errshttp.NewError(http.StatusBadRequest, "Version slug does not match the application")
-	ErrVersionNotFound      = errshttp.NewError(http.StatusNotFound, "Version was not found")
-	ErrVersionInvalid       = errshttp.NewError(http.StatusBadRequest, "Invalid version value")
-	ErrChannelInvalid       = errshttp.NewError(http.StatusBadRequest, `Invalid version channel: should be "stable", "beta" or "dev"`)
+	ErrAppAlreadyExists   = errshttp.NewError(http.StatusConflict, "Application already exists")
+	ErrAppNotFound        = errshttp.NewError(http.StatusNotFound, "Application was not found")
+	ErrAppSlugMismatch    = errshttp.NewError(http.StatusBadRequest, "Application slug does not match the one specified in the body")
+	ErrAppSlugInvalid     = errshttp.NewError(http.StatusBadRequest, "Invalid application slug: should contain only lowercase alphanumeric characters and dashes")
+	ErrAppEditorMismatch  = errshttp.NewError(http.StatusBadRequest, "Application can not be updated: editor can not change")
+	ErrAppUpdateConflict  = errshttp.NewError(http.StatusConflict, "Application was modified concurrently, please retry")
+	ErrAppFeaturedInvalid = errshttp.NewError(http.StatusBadRequest, "Invalid featured rank: should be positive, or 0 to unfeature the application")
+
+	ErrVersionAlreadyExists  = errshttp.NewError(http.StatusConflict, "Version already exists")
+	ErrVersionSlugMismatch   = errshttp.NewError(http.StatusBadRequest, "Version slug does not match the application")
+	ErrVersionTypeMismatch   = errshttp.NewError(http.StatusBadRequest, "Version type does not match the application")
+	ErrVersionEditorMismatch = errshttp.NewError(http.StatusBadRequest, "Version editor does not match the application")
+	ErrVersionNotFound       = errshttp.NewError(http.StatusNotFound, "Version was not found")
+	ErrVersionInvalid        = errshttp.NewError(http.StatusBadRequest, "Invalid version value")
+	ErrVersionLatestStable   = errshttp.NewError(http.StatusConflict, "Version is the latest stable version of the application and can only be deleted by force")
+	ErrChannelInvalid        = errshttp.NewError(http.StatusBadRequest, `Invalid version channel: should be "stable", "patch", "beta" or "dev"`)
+
+	ErrVersionSignatureMissing = errshttp.NewError(http.StatusBadRequest, "Version must be signed: the editor requires a signature of the tarball sha256")
+	ErrVersionSignatureInvalid = errshttp.NewError(http.StatusBadRequest, "Signature of the version does not verify with the public keys of the editor")
+
+	ErrMaintenanceWindowInvalid = errshttp.NewError(http.StatusBadRequest, "Invalid maintenance window: end should be after start")
+
+	ErrAppsCountExceeded    = errshttp.NewError(http.StatusBadRequest, "Too many applications match the filters to be counted")
+	ErrFeaturedFirstReverse = errshttp.NewError(http.StatusBadRequest, "The featured applications can not be listed first in the reverse order")
+
+	// ErrAppArchived is returned for an archived application that has not
+	// been replaced by another one.
+	ErrAppArchived = &AppArchivedError{}
 )
 
-var versionClient = http.Client{
-	Timeout: 30 * time.Second,
+// AppArchivedError is returned when looking for an archived application, to
+// tell it from an application that never existed. It gives the slug of the
+// application replacing it, if any.
+type AppArchivedError struct {
+	ReplacedBy string
+}
+
+func (e *AppArchivedError) Error() string {
+	if e.ReplacedBy != "" {
+		return fmt.Sprintf("Application has been archived and replaced by %q", e.ReplacedBy)
+	}
+	return "Application has been archived"
+}
+
+func (e *AppArchivedError) StatusCode() int {
+	return http.StatusGone
+}
+
+var (
+	// ManifestSizeThreshold is the maximum relative difference tolerated
+	// between the uncompressed_size declared in a manifest and the actual size
+	// of the files contained in the tarball.
+	ManifestSizeThreshold = 0.1
+	// ManifestSizeStrict makes the tarball validation fail when the declared
+	// size does not match. Otherwise, only a warning is logged.
+	ManifestSizeStrict = false
+	// StrictPublish makes the publication of the applications and versions
+	// fail when the request body contains an unknown field, see DecodeStrict.
+	StrictPublish = false
+	// StoreTarballs makes the registry keep a copy of the tarballs of the
+	// versions, as attachments of their documents, so that they do not depend
+	// on the availability of their original URL.
+	StoreTarballs = false
+	// ValidCategories is the list of the categories accepted for the
+	// applications. When it is empty, any category is accepted.
+	ValidCategories []string
+	// MaxTags is the maximum number of tags of an application.
+	MaxTags = 20
+	// ManifestFilenames are the names of the files recognized as the manifest
+	// of an application in its tarball, at any depth, by order of priority.
+	// The type of the application is inferred from manifest.webapp and
+	// manifest.konnector, and read from the "type" field of the manifest for
+	// the other names.
+	ManifestFilenames = []string{"manifest.webapp", "manifest.konnector"}
+	// SearchLocales are the locales of the localized names of the
+	// applications that are looked up by a search.
+	SearchLocales = []string{"en", "fr"}
+)
+
+// tarballAttachmentName is the name of the attachment of a version containing
+// the copy of its tarball.
+const tarballAttachmentName = "tarball"
+
+const (
+	defaultDownloadTimeout      = 30 * time.Second
+	defaultDownloadMaxRedirects = 10
+	defaultDownloadRetries      = 3
+	defaultDownloadRetryDelay   = 1 * time.Second
+)
+
+var (
+	downloadConfig DownloadConfig
+	versionClient  = newDownloadClient(downloadConfig)
+	// streamClient is used to stream the tarballs to the clients of the
+	// registry, whose transfer can last longer than the download timeout.
+	streamClient = newStreamClient(downloadConfig)
+)
+
+// DownloadConfig contains the configuration of the HTTP client used to
+// download the tarballs of the versions. The zero values are replaced by the
+// defaults.
+type DownloadConfig struct {
+	Timeout time.Duration
+	// MaxRedirects is the maximum number of redirects followed. When nil, the
+	// default of 10 redirects is used, and zero or a negative value forbids
+	// the redirects.
+	MaxRedirects *int
+	// AllowedHosts restricts the hosts the tarballs can be downloaded from.
+	// These hosts are trusted, even if they have a private address. When
+	// empty, all the hosts with a public address are allowed.
+	AllowedHosts []string
+	// AllowHTTP allows the tarballs URLs with the http scheme. Otherwise,
+	// only https is allowed.
+	AllowHTTP bool
+	// Retries is the number of times a download is retried after a transient
+	// failure, and RetryDelay the delay before the first retry, doubled for
+	// each following one. A negative Retries disables the retries.
+	Retries    int
+	RetryDelay time.Duration
+	// Resumable makes the retries resume the downloads from the last
+	// received byte when the origin accepts byte ranges. The tarballs are
+	// then buffered in temporary files.
+	Resumable bool
+}
+
+func (cfg DownloadConfig) retries() int {
+	switch {
+	case cfg.Retries < 0:
+		return 0
+	case cfg.Retries == 0:
+		return defaultDownloadRetries
+	default:
+		return cfg.Retries
+	}
+}
+
+func (cfg DownloadConfig) retryDelay() time.Duration {
+	if cfg.RetryDelay <= 0 {
+		return defaultDownloadRetryDelay
+	}
+	return cfg.RetryDelay
+}
+
+// InitDownloadClient rebuilds the HTTP client used to download the tarballs
+// with the given configuration. It should be called before serving the
+// registry.
+func InitDownloadClient(cfg DownloadConfig) {
+	downloadConfig = cfg
+	versionClient = newDownloadClient(cfg)
+	streamClient = newStreamClient(cfg)
+}
+
+// checkHost returns an error if the tarballs cannot be downloaded from the
+// given host: when it is not one of the allowed hosts, or when it is a
+// loopback, private or link-local address. The host names are not resolved.
+func (cfg DownloadConfig) checkHost(host string) error {
+	host = strings.ToLower(host)
+	if len(cfg.AllowedHosts) > 0 {
+		if stringInArray(host, cfg.AllowedHosts) {
+			return nil
+		}
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not download from host %q: it is not one of the allowed hosts", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && isInternalIP(ip) {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not download from host %q: it has the internal address %s", host, ip)
+	}
+	return nil
+}
+
+// resolveHost returns an error if the given host name, which is not one of
+// the allowed hosts, resolves to a loopback, private or link-local address.
+func (cfg DownloadConfig) resolveHost(host string) error {
+	if len(cfg.AllowedHosts) > 0 || net.ParseIP(host) != nil {
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not download from host %q: %s", host, err)
+	}
+	for _, ip := range ips {
+		if isInternalIP(ip) {
+			return errshttp.NewError(http.StatusUnprocessableEntity,
+				"Could not download from host %q: it has the internal address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// checkDownloadURL returns an error if the tarballs cannot be downloaded
+// from the given URL, because of its scheme or its host. It only checks the
+// syntax of the URL, without resolving its host: the addresses are checked by
+// the dialer of the download client when connecting.
+func checkDownloadURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid url %q: %s", rawurl, err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !downloadConfig.AllowHTTP {
+			return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+				"Invalid url %q: the scheme should be https", rawurl)
+		}
+	default:
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid url %q: the scheme should be https", rawurl)
+	}
+	if u.Hostname() == "" {
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid url %q: the host is missing", rawurl)
+	}
+	if err = downloadConfig.checkHost(u.Hostname()); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// validateDownloadURL is like checkDownloadURL, and also resolves the host of
+// the URL, to reject a host with an internal address before downloading.
+func validateDownloadURL(rawurl string) error {
+	u, err := checkDownloadURL(rawurl)
+	if err != nil {
+		return err
+	}
+	return downloadConfig.resolveHost(u.Hostname())
+}
+
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// transport returns the transport of the download client. The addresses are
+// checked when dialing, after the resolution of the host names, so that a
+// host can not resolve to a public address when its URL is validated and to
+// an internal one when it is downloaded. The allowed hosts are dialed without
+// check. The proxies of the environment are not used, as they would resolve
+// the hosts themselves.
+func (cfg DownloadConfig) transport() *http.Transport {
+	trusted := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return fmt.Errorf("could not download from the internal address %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if len(cfg.AllowedHosts) > 0 && stringInArray(strings.ToLower(host), cfg.AllowedHosts) {
+				return trusted.DialContext(ctx, network, addr)
+			}
+			return guarded.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func newDownloadClient(cfg DownloadConfig) *http.Client {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultDownloadTimeout
+	}
+	maxRedirects := defaultDownloadMaxRedirects
+	if cfg.MaxRedirects != nil {
+		maxRedirects = *cfg.MaxRedirects
+	}
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: cfg.transport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via)-1)
+			}
+			return cfg.checkHost(req.URL.Hostname())
+		},
+	}
+}
+
+// newStreamClient returns a client like the download one, but without an
+// overall timeout: only the wait for the response headers is bounded by it,
+// so that a large tarball is not cut off while it is streamed.
+func newStreamClient(cfg DownloadConfig) *http.Client {
+	client := newDownloadClient(cfg)
+	client.Transport.(*http.Transport).ResponseHeaderTimeout = client.Timeout
+	client.Timeout = 0
+	return client
 }
 
 const (
-	devSuffix  = "-dev."
-	betaSuffix = "-beta."
+	devSuffix   = "-dev."
+	betaSuffix  = "-beta."
+	patchSuffix = "-patch."
 )
 
+// defaultLocale is the locale used when a localized value is not available
+// in the requested one.
+const defaultLocale = "en"
+
 const (
 	appsDBSuffix        = "apps"
 	versDBSuffix        = "versions"
 	pendingVersDBSuffix = "pending"
+	downloadsDBSuffix   = "downloads"
 	editorsDBSuffix     = "editors"
+	auditDBSuffix       = "audit"
 )
 
 const (
@@ -86,16 +398,26 @@ const (
 var (
 	validDUCValues   = []string{DUCUserCiphered, DUCUserReserved, DUCNone}
 	validDUCByValues = []string{DUCByCozy, DUCByEditor, DUCByNone}
+
+	validAppStorePlatforms = []string{"ios", "android"}
 )
 
 var (
+	// client and clientURL are set by InitGlobalClient, and must be read with
+	// dbClient and dbClientURL.
+	clientMu  sync.RWMutex
 	client    *kivik.Client
 	clientURL *url.URL
 	spaces    map[string]*Space
 
 	globalPrefix    string
 	globalEditorsDB *kivik.DB
+	globalAuditDB   *kivik.DB
 
+	// ctx is the context used by the functions that do not take one yet.
+	//
+	// Deprecated: the callers should pass the context of their request, so
+	// that its deadline and cancellation apply to the CouchDB requests.
 	ctx = context.Background()
 
 	appsIndexes = map[string]echo.Map{
@@ -104,7 +426,11 @@ var (
 		"by-editor":      {"fields": []string{"editor", "slug", "category"}},
 		"by-category":    {"fields": []string{"category", "slug", "editor"}},
 		"by-created_at":  {"fields": []string{"created_at", "slug", "category", "editor"}},
-		"by-maintenance": {"fields": []string{"maintenance_activated"}},
+		"by-maintenance": {"fields": []string{"maintenance_activated", "slug"}},
+
+		"by-latest_version_created_at": {"fields": []string{"latest_version_created_at", "slug", "category", "editor"}},
+		"by-downloads":                 {"fields": []string{"total_downloads", "slug", "category", "editor"}},
+		"by-featured":                  {"fields": []string{"featured", "slug"}},
 	}
 
 	versIndex = echo.Map{"fields": []string{"version", "slug", "type"}}
@@ -115,6 +441,7 @@ type Label int
 
 const (
 	Stable Channel = iota + 1
+	Patch
 	Beta
 	Dev
 )
@@ -129,10 +456,15 @@ const (
 )
 
 type Space struct {
+	// MaxAppSize is the maximum size in bytes of the application tarballs
+	// accepted in this space. Zero means the default limit of 20 Mo.
+	MaxAppSize int64
+
 	prefix        string
 	dbApps        *kivik.DB
 	dbVers        *kivik.DB
 	dbPendingVers *kivik.DB
+	dbDownloads   *kivik.DB
 }
 
 func (c *Space) AppsDB() *kivik.DB {
@@ -147,6 +479,17 @@ func (c *Space) PendingVersDB() *kivik.DB {
 	return c.dbPendingVers
 }
 
+func (c *Space) DownloadsDB() *kivik.DB {
+	return c.dbDownloads
+}
+
+func (c *Space) maxAppSize() int64 {
+	if c.MaxAppSize > 0 {
+		return c.MaxAppSize
+	}
+	return defaultMaxApplicationSize
+}
+
 func (c *Space) dbName(suffix string) (name string) {
 	if c.prefix != "" {
 		name = c.prefix + "-"
@@ -167,6 +510,20 @@ type AppOptions struct {
 	Editor string `json:"editor"`
 	Type   string `json:"type"`
 
+	// Category is normalized to lower case by IsValidApp
+	Category string `json:"category,omitempty"`
+	// Tags are normalized to lower case by IsValidApp
+	Tags []string `json:"tags,omitempty"`
+
+	Name        map[string]string `json:"name,omitempty"`
+	Description map[string]string `json:"description,omitempty"`
+
+	// AppStoreURLs are the links to the mobile applications, by platform
+	AppStoreURLs map[string]string `json:"app_store_urls,omitempty"`
+
+	// Private applications are not listed, but can be installed by slug
+	Private *bool `json:"private,omitempty"`
+
 	DataUsageCommitment   *string `json:"data_usage_commitment"`
 	DataUsageCommitmentBy *string `json:"data_usage_commitment_by"`
 }
@@ -178,7 +535,46 @@ type App struct {
 	Slug      string    `json:"slug"`
 	Type      string    `json:"type"`
 	Editor    string    `json:"editor"`
+	Category  string    `json:"category,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// LatestStableVersion and LatestStableCreatedAt are the latest stable
+	// version and its date of publication. They are denormalized on the
+	// application to sort the applications by their last release, and to
+	// list them without looking up their versions.
+	LatestStableVersion   string     `json:"latest_stable_version,omitempty"`
+	LatestStableCreatedAt *time.Time `json:"latest_version_created_at,omitempty"`
+
+	// TotalDownloads is the number of downloads of all the versions of the
+	// application. It is denormalized from the downloads counters by
+	// RefreshPopularity, to sort the applications on it.
+	TotalDownloads int64 `json:"total_downloads"`
+
+	// Featured applications are listed first when asked for, the highest
+	// values first. 0 means the application is not featured.
+	Featured int `json:"featured,omitempty"`
+
+	// AppName and AppDescription are indexed by locale
+	AppName        map[string]string `json:"name,omitempty"`
+	AppDescription map[string]string `json:"description,omitempty"`
+
+	// AppStoreURLs are the links to install the mobile applications, indexed
+	// by platform: ios or android.
+	AppStoreURLs map[string]string `json:"app_store_urls,omitempty"`
+
+	// Archived apps are hidden from the list of applications, and FindApp
+	// returns an AppArchivedError for them. Their versions can still be
+	// fetched, to avoid breaking the existing installations.
+	Archived bool `json:"archived,omitempty"`
+	// ReplacedBy is the slug of the application replacing an archived one,
+	// when it has been renamed.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+
+	// Private apps are hidden from the lists of applications, but can be
+	// fetched and installed by their slug.
+	Private bool `json:"private,omitempty"`
 
 	MaintenanceActivated bool                `json:"maintenance_activated,omitempty"`
 	MaintenanceOptions   *MaintenanceOptions `json:"maintenance_options,omitempty"`
@@ -192,6 +588,66 @@ type App struct {
 	LatestVersion *Version     `json:"latest_version,omitempty"`
 }
 
+// LocalizedName returns the name of the application in the given locale,
+// falling back on its language without the region, on english, and then on
+// the first available locale.
+func (app *App) LocalizedName(locale string) string {
+	return localizedValue(app.AppName, locale)
+}
+
+// LocalizedDescription returns the description of the application in the
+// given locale, with the same fallbacks as LocalizedName.
+func (app *App) LocalizedDescription(locale string) string {
+	return localizedValue(app.AppDescription, locale)
+}
+
+func localizedValue(values map[string]string, locale string) string {
+	_, v := localizedEntry(values, locale)
+	return v
+}
+
+// localizedEntry returns the locale and the value chosen by localizedValue.
+func localizedEntry(values map[string]string, locale string) (string, string) {
+	candidates := []string{locale}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, defaultLocale)
+	for _, l := range candidates {
+		if v, ok := values[l]; ok && v != "" {
+			return l, v
+		}
+	}
+	// Iterate on the sorted locales for the result to be stable
+	locales := make([]string, 0, len(values))
+	for l := range values {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	for _, l := range locales {
+		if v := values[l]; v != "" {
+			return l, v
+		}
+	}
+	return "", ""
+}
+
+// collapseLocales keeps only the best matching locale of the name and
+// description of the application, for the clients that do not need the other
+// ones.
+func (app *App) collapseLocales(locale string) {
+	app.AppName = collapseLocalized(app.AppName, locale)
+	app.AppDescription = collapseLocalized(app.AppDescription, locale)
+}
+
+func collapseLocalized(values map[string]string, locale string) map[string]string {
+	l, v := localizedEntry(values, locale)
+	if v == "" {
+		return nil
+	}
+	return map[string]string{l: v}
+}
+
 type Locales map[string]interface{}
 
 type MaintenanceOptions struct {
@@ -199,6 +655,30 @@ type MaintenanceOptions struct {
 	FlagShortMaintenance   bool                          `json:"flag_short_maintenance"`
 	FlagDisallowManualExec bool                          `json:"flag_disallow_manual_exec"`
 	Messages               map[string]MaintenanceMessage `json:"messages"`
+
+	// Start and End define the window of a scheduled maintenance. When they
+	// are not set, the maintenance is active as long as it is activated.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// IsMaintenanceActive returns true if the maintenance of the application is
+// activated, and the given time is within its maintenance window, if any.
+func (app *App) IsMaintenanceActive(now time.Time) bool {
+	if !app.MaintenanceActivated {
+		return false
+	}
+	opts := app.MaintenanceOptions
+	if opts == nil {
+		return true
+	}
+	if opts.Start != nil && now.Before(*opts.Start) {
+		return false
+	}
+	if opts.End != nil && !now.Before(*opts.End) {
+		return false
+	}
+	return true
 }
 
 type MaintenanceMessage struct {
@@ -208,6 +688,7 @@ type MaintenanceMessage struct {
 
 type AppVersions struct {
 	Stable []string `json:"stable,omitempty"`
+	Patch  []string `json:"patch,omitempty"`
 	Beta   []string `json:"beta,omitempty"`
 	Dev    []string `json:"dev,omitempty"`
 }
@@ -226,9 +707,78 @@ type VersionOptions struct {
 	Version     string          `json:"version"`
 	URL         string          `json:"url"`
 	Sha256      string          `json:"sha256"`
+	Sha512      string          `json:"sha512,omitempty"`
 	Parameters  json.RawMessage `json:"parameters"`
 	Icon        string          `json:"icon"`
-	Screenshots []string        `json:"screenshots"`
+	Screenshots []Screenshot    `json:"screenshots"`
+
+	// Signature is a detached signature of the sha256 of the tarball, in
+	// hexadecimal, made with a public key of the editor and encoded in
+	// base64. SignatureKeyID identifies the key, see auth.Editor.PublicKeyID.
+	Signature      string `json:"signature,omitempty"`
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+
+	// ManifestOverrides are fields merged over the manifest of the tarball,
+	// to fix it without rebuilding the tarball. Only the fields of
+	// ManifestOverridableFields can be overridden.
+	ManifestOverrides map[string]interface{} `json:"manifest_overrides,omitempty"`
+}
+
+// ManifestOverridableFields are the fields of the manifests that can be
+// overridden when publishing a version. The fields identifying the version,
+// like its slug, version or editor, must never be added.
+var ManifestOverridableFields = []string{
+	"category",
+	"categories",
+	"short_description",
+	"long_description",
+	"screenshots",
+	"tags",
+}
+
+// Screenshot is a screenshot of an application. In the manifests and the
+// versions options, a screenshot can be given as the path of its file in the
+// tarball only, or as an object with a caption and an order.
+type Screenshot struct {
+	// URL is the path of the screenshot in the tarball, which is also its
+	// path under the screenshots routes of the version.
+	URL string `json:"url"`
+	// Caption is indexed by locale.
+	Caption map[string]string `json:"caption,omitempty"`
+	// Order is the position of the screenshot: the screenshots are sorted on
+	// it, and keep their declaration order when it is equal.
+	Order int `json:"order,omitempty"`
+}
+
+// UnmarshalJSON accepts a screenshot given as a string, for the manifests
+// written before the captions.
+func (s *Screenshot) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*s = Screenshot{URL: url}
+		return nil
+	}
+	type screenshot Screenshot
+	var shot screenshot
+	if err := json.Unmarshal(data, &shot); err != nil {
+		return err
+	}
+	*s = Screenshot(shot)
+	return nil
+}
+
+// sortScreenshots sorts the screenshots on their order, and normalizes their
+// paths.
+func sortScreenshots(shots []Screenshot) []Screenshot {
+	sorted := make([]Screenshot, len(shots))
+	for i, shot := range shots {
+		shot.URL = strings.TrimPrefix(path.Join("/", shot.URL), "/")
+		sorted[i] = shot
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Order < sorted[j].Order
+	})
+	return sorted
 }
 
 type Version struct {
@@ -236,87 +786,302 @@ type Version struct {
 	Rev         string                 `json:"_rev,omitempty"`
 	Attachments map[string]interface{} `json:"_attachments,omitempty"`
 
-	Slug      string          `json:"slug"`
-	Editor    string          `json:"editor"`
-	Type      string          `json:"type"`
-	Version   string          `json:"version"`
-	Manifest  json.RawMessage `json:"manifest"`
-	CreatedAt time.Time       `json:"created_at"`
-	URL       string          `json:"url"`
-	Size      int64           `json:"size,string"`
-	Sha256    string          `json:"sha256"`
-	TarPrefix string          `json:"tar_prefix"`
+	Slug     string          `json:"slug"`
+	Editor   string          `json:"editor"`
+	Type     string          `json:"type"`
+	Version  string          `json:"version"`
+	Manifest json.RawMessage `json:"manifest"`
+	// CreatedAt is the date of creation of the version. It is kept when the
+	// version is imported from another registry, and the versions views are
+	// sorted on it.
+	CreatedAt time.Time `json:"created_at"`
+	// PublishedAt is the date when the version entered this registry, if it
+	// differs from its creation date: when a pending version has been
+	// approved, or when the version has been imported.
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	URL         string     `json:"url"`
+	Size        int64      `json:"size,string"`
+	Sha256      string     `json:"sha256"`
+	Sha512      string     `json:"sha512,omitempty"`
+	// Permissions are the permissions requested in the manifest, parsed to
+	// be displayed without reading the whole manifest.
+	Permissions map[string]Permission `json:"permissions,omitempty"`
+	// TarballObject is the name of the attachment containing the copy of the
+	// tarball, if it has been stored by the registry.
+	TarballObject string `json:"tarball_object,omitempty"`
+	TarPrefix     string `json:"tar_prefix"`
+	// ManifestPath is the path of the manifest in the tarball.
+	ManifestPath string `json:"manifest_path,omitempty"`
+	// CozyVersion is the constraint on the version of the stack declared in
+	// the manifest, like ">=1.5.0". It is empty when there is none.
+	CozyVersion string `json:"cozy_version,omitempty"`
+	// Screenshots are the screenshots of the version, sorted on their order,
+	// with their captions. The screenshots of the locales are not included.
+	Screenshots []Screenshot `json:"screenshots,omitempty"`
+	// OverriddenFields are the fields of the manifest that have been
+	// overridden at publication, and do not come from the tarball.
+	OverriddenFields []string `json:"overridden_fields,omitempty"`
+	// Signature and SignatureKeyID are the detached signature given at
+	// publication, see VersionOptions, so that the clients can check it.
+	Signature      string `json:"signature,omitempty"`
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+
+	// pending is true for the versions read from the pending versions
+	// database, which can still be modified or deleted before being approved.
+	pending bool
+	// parsedManifest caches the result of ParsedManifest.
+	parsedManifest atomic.Value
+}
+
+// IsImmutable returns true if the version has been published: its document
+// and manifest never change anymore, and can be cached indefinitely, contrary
+// to a pending version.
+func (v *Version) IsImmutable() bool {
+	return !v.pending
+}
+
+// TruncateDates sets the dates of the application in UTC and truncated to the
+// second, so that the same date always gives the same payload in the HTTP
+// responses. It must not be called on a document that is written back to
+// CouchDB, where the dates keep their full precision: the dev versions are
+// ordered by their creation date in the views.
+func (app *App) TruncateDates() {
+	app.CreatedAt = truncateDate(app.CreatedAt)
+	app.UpdatedAt = truncateDate(app.UpdatedAt)
+	if app.LatestStableCreatedAt != nil {
+		t := truncateDate(*app.LatestStableCreatedAt)
+		app.LatestStableCreatedAt = &t
+	}
+}
+
+// TruncateDates sets the dates of the version in UTC and truncated to the
+// second, like App.TruncateDates.
+func (v *Version) TruncateDates() {
+	v.CreatedAt = truncateDate(v.CreatedAt)
+	if v.PublishedAt != nil {
+		t := truncateDate(*v.PublishedAt)
+		v.PublishedAt = &t
+	}
+}
+
+func truncateDate(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
 }
 
 // Manifest type contains a subset of the attributes contained in the manifest
 // of applications. It is only here to help us reading some informations from
 // the manifest that are useful to us, without manipulating maps.
 type Manifest struct {
-	Editor      string   `json:"editor"`
-	Slug        string   `json:"slug"`
-	Version     string   `json:"version"`
-	Icon        string   `json:"icon"`
-	Screenshots []string `json:"screenshots"`
-	Locales     map[string]struct {
-		Screenshots []string `json:"screenshots"`
+	Name             string                `json:"name"`
+	Editor           string                `json:"editor"`
+	Slug             string                `json:"slug"`
+	Version          string                `json:"version"`
+	Icon             string                `json:"icon"`
+	Categories       []string              `json:"categories"`
+	Screenshots      []Screenshot          `json:"screenshots"`
+	UncompressedSize int64                 `json:"uncompressed_size"`
+	Permissions      map[string]Permission `json:"permissions"`
+	Routes           map[string]Route      `json:"routes"`
+	CozyVersion      string                `json:"cozy_version"`
+	MinCozy          string                `json:"min_cozy"`
+	Locales          map[string]struct {
+		Screenshots []Screenshot `json:"screenshots"`
 	} `json:"locales"`
 }
 
+// Route is a route declared in the manifest of a webapp.
+type Route struct {
+	Folder string `json:"folder"`
+	Index  string `json:"index,omitempty"`
+	Public bool   `json:"public"`
+}
+
+// parsedManifest is the manifest of a version parsed by ParsedManifest, with
+// the raw manifest it comes from.
+type parsedManifest struct {
+	raw      json.RawMessage
+	manifest *Manifest
+}
+
+// ParsedManifest returns the common fields of the manifest of the version.
+// The manifest is parsed once, and the result is cached on the version until
+// its manifest is replaced. The returned manifest is shared, and must not be
+// modified.
+func (v *Version) ParsedManifest() (*Manifest, error) {
+	if cached, ok := v.parsedManifest.Load().(parsedManifest); ok && bytes.Equal(cached.raw, v.Manifest) {
+		return cached.manifest, nil
+	}
+	manifest, err := parseManifest(v.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	v.parsedManifest.Store(parsedManifest{raw: v.Manifest, manifest: manifest})
+	return manifest, nil
+}
+
+func parseManifest(raw json.RawMessage) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Permission is a permission requested by an application in its manifest.
+type Permission struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Verbs       []string `json:"verbs,omitempty"`
+	Remote      bool     `json:"remote,omitempty"`
+
+	// ignoredVerbs are the verbs of the manifest that are not known, or not
+	// even strings, and have been left out of Verbs.
+	ignoredVerbs []string
+}
+
+// permissionVerbs are the verbs accepted in the permissions of the manifests.
+var permissionVerbs = []string{"ALL", "GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// UnmarshalJSON is used to parse the permissions of both webapps and
+// konnectors. The verbs can be given as a list or as a single string, and a
+// description that is not a plain string, like a localized one, is ignored.
+// The unknown verbs are ignored too, instead of rejecting the whole manifest
+// for a typo.
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type        string          `json:"type"`
+		Description json.RawMessage `json:"description"`
+		Verbs       json.RawMessage `json:"verbs"`
+		Remote      bool            `json:"remote"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Type = raw.Type
+	p.Remote = raw.Remote
+	p.Description = ""
+	p.Verbs = nil
+	p.ignoredVerbs = nil
+	if len(raw.Description) > 0 {
+		_ = json.Unmarshal(raw.Description, &p.Description)
+	}
+	if len(raw.Verbs) > 0 {
+		var verbs []json.RawMessage
+		if err := json.Unmarshal(raw.Verbs, &verbs); err != nil {
+			verbs = []json.RawMessage{raw.Verbs}
+		}
+		for _, rawVerb := range verbs {
+			var verb string
+			if err := json.Unmarshal(rawVerb, &verb); err != nil {
+				p.ignoredVerbs = append(p.ignoredVerbs, string(rawVerb))
+			} else if !stringInArray(strings.ToUpper(verb), permissionVerbs) {
+				p.ignoredVerbs = append(p.ignoredVerbs, verb)
+			} else {
+				p.Verbs = append(p.Verbs, verb)
+			}
+		}
+	}
+	return nil
+}
+
 func NewSpace(prefix string) *Space {
 	return &Space{prefix: prefix}
 }
 
 func InitGlobalClient(addr, user, pass, prefix string) (editorsDB *kivik.DB, err error) {
-	u, err := url.Parse(addr)
+	newClient, newURL, err := newDBClient(addr, user, pass)
 	if err != nil {
 		return
 	}
-	u.User = nil
+	clientMu.Lock()
+	client, clientURL = newClient, newURL
+	clientMu.Unlock()
+
+	globalPrefix = prefix
 
-	client, err = kivik.New("couch", u.String())
+	globalEditorsDB, err = ensureGlobalDB(dbName(editorsDBSuffix))
+	if err != nil {
+		return
+	}
+	globalAuditDB, err = ensureGlobalDB(dbName(auditDBSuffix))
+	if err != nil {
+		return
+	}
+	err = globalAuditDB.CreateIndex(ctx, "audit-index", "audit-index", auditIndex)
 	if err != nil {
 		return
 	}
 
+	editorsDB = globalEditorsDB
+	return
+}
+
+// newDBClient returns a CouchDB client for the given server, authenticated
+// if a user is given, and the URL of the server without credentials nor path.
+func newDBClient(addr, user, pass string) (*kivik.Client, *url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.User = nil
+
+	newClient, err := kivik.New("couch", u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if user != "" {
-		err = client.Authenticate(ctx, &chttp.BasicAuth{
+		err = newClient.Authenticate(ctx, &chttp.BasicAuth{
 			Username: user,
 			Password: pass,
 		})
 		if err != nil {
-			return
+			return nil, nil, err
 		}
 	}
 
-	clientURL = u
-	clientURL.Path = ""
-	clientURL.RawPath = ""
+	u.Path = ""
+	u.RawPath = ""
+	return newClient, u, nil
+}
 
-	globalPrefix = prefix
+// dbClient returns the current CouchDB client, or nil if it has not been
+// initialized.
+func dbClient() *kivik.Client {
+	clientMu.RLock()
+	defer clientMu.RUnlock()
+	return client
+}
+
+// dbClientURL returns the URL of the CouchDB server of the current client.
+func dbClientURL() *url.URL {
+	clientMu.RLock()
+	defer clientMu.RUnlock()
+	return clientURL
+}
 
-	editorsDBName := dbName(editorsDBSuffix)
-	exists, err := client.DBExists(ctx, editorsDBName)
+// ensureGlobalDB returns the database with the given name, shared by all the
+// spaces, and creates it if it does not exist yet.
+func ensureGlobalDB(name string) (*kivik.DB, error) {
+	client := dbClient()
+	exists, err := client.DBExists(ctx, name)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if !exists {
-		fmt.Printf("Creating database %q...", editorsDBName)
-		if _, err = client.CreateDB(ctx, editorsDBName); err != nil {
-			return
+		fmt.Printf("Creating database %q...", name)
+		if _, err = client.CreateDB(ctx, name); err != nil {
+			return nil, err
 		}
 		fmt.Println("ok.")
 	}
-
-	globalEditorsDB, err = client.DB(ctx, editorsDBName)
-	if err != nil {
-		return
-	}
-
-	editorsDB = globalEditorsDB
-	return
+	return client.DB(ctx, name)
 }
 
-func RegisterSpace(name string) error {
+// RegisterSpace registers a new space with the given name, and creates its
+// databases and indexes if they do not exist yet. The "__default__" name is
+// used for the space with an empty name.
+func RegisterSpace(name string) (*Space, error) {
 	if spaces == nil {
 		spaces = make(map[string]*Space)
 	}
@@ -325,32 +1090,71 @@ func RegisterSpace(name string) error {
 		name = ""
 	} else {
 		if !validSpaceReg.MatchString(name) {
-			return fmt.Errorf("Space named %q contains invalid characters", name)
+			return nil, fmt.Errorf("Space named %q contains invalid characters", name)
 		}
 	}
 	if _, ok := spaces[name]; ok {
-		return fmt.Errorf("Space %q already registered", name)
+		return nil, fmt.Errorf("Space %q already registered", name)
 	}
 	c := NewSpace(name)
+	if err := c.init(); err != nil {
+		return nil, err
+	}
 	spaces[name] = c
-	return c.init()
+	return c, nil
 }
 
-func GetSpacesNames() (cs []string) {
-	cs = make([]string, 0, len(spaces))
+// Spaces returns the sorted names of the registered spaces.
+func Spaces() []string {
+	cs := make([]string, 0, len(spaces))
 	for n := range spaces {
 		cs = append(cs, n)
 	}
+	sort.Strings(cs)
 	return cs
 }
 
+// GetSpace returns the registered space with the given name.
 func GetSpace(name string) (*Space, bool) {
 	c, ok := spaces[name]
 	return c, ok
 }
 
+// CheckConnections verifies that the registry can reach CouchDB: the server
+// itself, the editors database and the databases of every registered space.
+// All the failures are returned in a multierror, so that a partial outage can
+// be told apart from a complete one. It does not depend on the HTTP server and
+// can be used for readiness probes.
+func CheckConnections(ctx context.Context) error {
+	client := dbClient()
+	if client == nil {
+		return fmt.Errorf("CouchDB client is not initialized")
+	}
+	if _, err := client.Version(ctx); err != nil {
+		return multierror.Append(nil, fmt.Errorf("couchdb: %s", err))
+	}
+
+	var errm error
+	dbNames := []string{dbName(editorsDBSuffix), dbName(auditDBSuffix)}
+	for _, c := range spaces {
+		for _, suffix := range []string{appsDBSuffix, versDBSuffix, pendingVersDBSuffix, downloadsDBSuffix} {
+			dbNames = append(dbNames, c.dbName(suffix))
+		}
+	}
+	for _, name := range dbNames {
+		exists, err := client.DBExists(ctx, name)
+		if err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("couchdb %s: %s", name, err))
+		} else if !exists {
+			errm = multierror.Append(errm, fmt.Errorf("couchdb %s: database does not exist", name))
+		}
+	}
+	return errm
+}
+
 func (c *Space) init() (err error) {
-	for _, suffix := range []string{appsDBSuffix, versDBSuffix, pendingVersDBSuffix} {
+	client := dbClient()
+	for _, suffix := range []string{appsDBSuffix, versDBSuffix, pendingVersDBSuffix, downloadsDBSuffix} {
 		var ok bool
 		dbName := c.dbName(suffix)
 		ok, err = client.DBExists(ctx, dbName)
@@ -377,6 +1181,8 @@ func (c *Space) init() (err error) {
 			c.dbVers = db
 		case pendingVersDBSuffix:
 			c.dbPendingVers = db
+		case downloadsDBSuffix:
+			c.dbDownloads = db
 		default:
 			panic("unreachable")
 		}
@@ -398,48 +1204,163 @@ func (c *Space) init() (err error) {
 		return
 	}
 
-	return
+	return ensureDownloadsViews(c)
 }
 
+// ValidationError is returned by IsValidApp and IsValidVersion. In addition
+// to the message, it gives the reason of the failure of each invalid field,
+// so that the clients can report them next to their inputs.
+type ValidationError struct {
+	Fields map[string]string
+	msg    string
+}
+
+func (e *ValidationError) Error() string {
+	return e.msg
+}
+
+// newAppValidationError returns the error of an application with a single
+// invalid field.
+func newAppValidationError(field, format string, a ...interface{}) error {
+	reason := fmt.Sprintf(format, a...)
+	return &ValidationError{
+		Fields: map[string]string{field: reason},
+		msg:    "Invalid application: " + reason,
+	}
+}
+
+// IsValidApp checks the options of an application. The slugs with uppercase
+// characters are rejected, so that two slugs can not map to the same
+// document, whose identifier is the lowercase slug.
 func IsValidApp(app *AppOptions) error {
 	if app.Slug == "" || !validSlugReg.MatchString(app.Slug) {
-		return ErrAppSlugInvalid
+		return &ValidationError{
+			Fields: map[string]string{"slug": "should contain only lowercase alphanumeric characters and dashes"},
+			msg:    ErrAppSlugInvalid.Error(),
+		}
 	}
 	if app.Editor == "" {
-		return errshttp.NewError(http.StatusBadRequest, "Invalid application: "+
-			"the following `editor` field is empty")
+		return newAppValidationError("editor", "the following `editor` field is empty")
 	}
 	if !stringInArray(app.Type, validAppTypes) {
-		return errshttp.NewError(http.StatusBadRequest, "Invalid application: "+
+		return newAppValidationError("type",
 			"got type %q, must be one of these: %s", app.Type, strings.Join(validAppTypes, ", "))
 	}
 	if app.DataUsageCommitment != nil && !stringInArray(*app.DataUsageCommitment, validDUCValues) {
-		return errshttp.NewError(http.StatusBadRequest, "Invalid application: "+
+		return newAppValidationError("data_usage_commitment",
 			"got data_usage_commitment %q, must be one of these: %s", *app.DataUsageCommitment, strings.Join(validDUCValues, ", "))
 	}
 	if app.DataUsageCommitmentBy != nil && !stringInArray(*app.DataUsageCommitmentBy, validDUCByValues) {
-		return errshttp.NewError(http.StatusBadRequest, "Invalid application: "+
+		return newAppValidationError("data_usage_commitment_by",
 			"got data_usage_commitment_by %q, must be one of these: %s", *app.DataUsageCommitmentBy, strings.Join(validDUCByValues, ", "))
 	}
+	category, err := checkCategory(app.Category)
+	if err != nil {
+		return err
+	}
+	app.Category = category
+	tags, err := checkTags(app.Tags)
+	if err != nil {
+		return err
+	}
+	app.Tags = tags
+	for platform, storeURL := range app.AppStoreURLs {
+		if !stringInArray(platform, validAppStorePlatforms) {
+			return newAppValidationError("app_store_urls",
+				"got app_store_urls platform %q, must be one of these: %s", platform, strings.Join(validAppStorePlatforms, ", "))
+		}
+		if u, err := url.Parse(storeURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return newAppValidationError("app_store_urls",
+				"got app_store_urls.%s %q, must be a valid URL", platform, storeURL)
+		}
+	}
 	return nil
 }
 
+// checkCategory returns the normalized form of the given category, or an error
+// if it is not one of the valid categories. The valid categories are compared
+// in the same normalized form, as they may be configured with another case.
+func checkCategory(category string) (string, error) {
+	category = strings.ToLower(strings.TrimSpace(category))
+	if category == "" || len(ValidCategories) == 0 {
+		return category, nil
+	}
+	for _, valid := range ValidCategories {
+		if strings.ToLower(strings.TrimSpace(valid)) == category {
+			return category, nil
+		}
+	}
+	return "", newAppValidationError("category",
+		"got category %q, must be one of these: %s", category, strings.Join(ValidCategories, ", "))
+}
+
+// checkTags returns the normalized form of the given tags, or an error if
+// there are too many of them or if one is not slug-like.
+func checkTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	if len(tags) > MaxTags {
+		return nil, newAppValidationError("tags",
+			"got %d tags, must have at most %d", len(tags), MaxTags)
+	}
+	normalized := make([]string, len(tags))
+	for i, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !validTagReg.MatchString(tag) {
+			return nil, newAppValidationError("tags",
+				"got tag %q, must only contain lowercase letters, digits and dashes", tag)
+		}
+		normalized[i] = tag
+	}
+	return normalized, nil
+}
+
 func IsValidVersion(ver *VersionOptions) error {
 	var fields []string
+	reasons := make(map[string]string)
+	invalid := func(field, reason string) {
+		if _, ok := reasons[field]; !ok {
+			fields = append(fields, field)
+		}
+		reasons[field] = reason
+	}
 	if !validVersionReg.MatchString(ver.Version) {
-		fields = append(fields, "version")
+		invalid("version", "invalid version number")
 	}
 	if ver.URL == "" {
-		fields = append(fields, "url")
-	} else if _, err := url.Parse(ver.URL); err != nil {
-		fields = append(fields, "url")
+		invalid("url", "missing")
+	} else if _, err := checkDownloadURL(ver.URL); err != nil {
+		invalid("url", err.Error())
+	}
+	if ver.Sha256 == "" && ver.Sha512 == "" {
+		invalid("sha256", "missing")
+	}
+	if ver.Sha256 != "" {
+		if h, err := hex.DecodeString(ver.Sha256); err != nil || len(h) != sha256.Size {
+			invalid("sha256", "invalid sha256 checksum")
+		}
+	}
+	if ver.Sha512 != "" {
+		if h, err := hex.DecodeString(ver.Sha512); err != nil || len(h) != sha512.Size {
+			invalid("sha512", "invalid sha512 checksum")
+		}
 	}
-	if h, err := hex.DecodeString(ver.Sha256); err != nil || len(h) != 32 {
-		fields = append(fields, "sha256")
+	if ver.SignatureKeyID != "" && ver.Signature == "" {
+		invalid("signature", "missing for the signature_key_id")
+	}
+	if ver.Signature != "" && ver.Sha256 == "" {
+		invalid("sha256", "required to sign the version")
+	}
+	if err := checkManifestOverrides(ver.ManifestOverrides); err != nil {
+		invalid("manifest_overrides", err.Error())
 	}
 	if len(fields) > 0 {
-		return fmt.Errorf("Invalid version: "+
-			"the following fields are missing or erroneous: %s", strings.Join(fields, ", "))
+		return &ValidationError{
+			Fields: reasons,
+			msg: "Invalid version: " +
+				"the following fields are missing or erroneous: " + strings.Join(fields, ", "),
+		}
 	}
 	return nil
 }
@@ -449,7 +1370,7 @@ func CreateApp(c *Space, opts *AppOptions, editor *auth.Editor) (*App, error) {
 		return nil, err
 	}
 
-	_, err := findApp(c, opts.Slug)
+	_, err := findApp(ctx, c, opts.Slug)
 	if err == nil {
 		return nil, ErrAppAlreadyExists
 	}
@@ -458,21 +1379,17 @@ func CreateApp(c *Space, opts *AppOptions, editor *auth.Editor) (*App, error) {
 	}
 
 	db := c.AppsDB()
-	now := time.Now().UTC()
-	app := new(App)
-	app.ID = getAppID(opts.Slug)
-	app.Rev = ""
-	app.Slug = app.ID
-	app.Type = opts.Type
-	app.Editor = editor.Name()
-	app.CreatedAt = now
-	app.DataUsageCommitment, app.DataUsageCommitmentBy = defaultDataUserCommitment(app, opts)
+	app, err := mergeApp(nil, opts, editor)
+	if err != nil {
+		return nil, err
+	}
 	_, app.Rev, err = db.CreateDoc(ctx, app)
 	if err != nil {
 		return nil, err
 	}
 	app.Versions = &AppVersions{
 		Stable: make([]string, 0),
+		Patch:  make([]string, 0),
 		Beta:   make([]string, 0),
 		Dev:    make([]string, 0),
 	}
@@ -480,17 +1397,296 @@ func CreateApp(c *Space, opts *AppOptions, editor *auth.Editor) (*App, error) {
 	return app, nil
 }
 
-func ModifyApp(c *Space, appSlug string, opts AppOptions) (*App, error) {
-	app, err := findApp(c, appSlug)
+// maxAppWriteRetries is the number of times an application is read and merged
+// again after a conflict when writing it.
+const maxAppWriteRetries = 3
+
+// CreateOrUpdateApp creates the application described by the given options,
+// or updates it if it already exists. When updating, the fields that are not
+// specified in the options keep their previous values, and the application is
+// not written if nothing has changed.
+//
+// If the application is modified concurrently, the write is retried with the
+// new revision, and ErrAppUpdateConflict is returned when it keeps failing.
+func CreateOrUpdateApp(c *Space, opts *AppOptions, editor *auth.Editor) (*App, error) {
+	db := c.AppsDB()
+	prepare := func() (*App, bool, error) {
+		// The options are normalized when they are prepared, so each attempt
+		// works on a copy of them.
+		o := *opts
+		return prepareCreateOrUpdateApp(c, &o, editor)
+	}
+	write := func(app *App) (err error) {
+		if app.Rev == "" {
+			_, app.Rev, err = db.CreateDoc(ctx, app)
+		} else {
+			app.Rev, err = db.Put(ctx, app.ID, app)
+		}
+		return err
+	}
+	return writeAppWithRetries(prepare, write)
+}
+
+// writeAppWithRetries writes the application returned by prepare, and calls
+// it again to merge the options with the latest revision when the write is
+// rejected because of a conflict.
+func writeAppWithRetries(prepare func() (*App, bool, error), write func(*App) error) (*App, error) {
+	for i := 0; ; i++ {
+		app, updated, err := prepare()
+		if err != nil || !updated {
+			return app, err
+		}
+		err = write(app)
+		if err == nil {
+			return app, nil
+		}
+		if kivik.StatusCode(err) != http.StatusConflict {
+			return nil, err
+		}
+		if i >= maxAppWriteRetries {
+			return nil, ErrAppUpdateConflict
+		}
+	}
+}
+
+// CreateOrUpdateAppDryRun returns the application that CreateOrUpdateApp
+// would write for the given options, and whether it would be created or
+// updated, without writing it.
+func CreateOrUpdateAppDryRun(c *Space, opts *AppOptions, editor *auth.Editor) (*App, bool, error) {
+	return prepareCreateOrUpdateApp(c, opts, editor)
+}
+
+func prepareCreateOrUpdateApp(c *Space, opts *AppOptions, editor *auth.Editor) (*App, bool, error) {
+	if err := IsValidApp(opts); err != nil {
+		return nil, false, err
+	}
+
+	old, err := findApp(ctx, c, opts.Slug)
+	if err != nil && err != ErrAppNotFound {
+		return nil, false, err
+	}
+
+	app, err := mergeApp(old, opts, editor)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isAppUpdated(old, app) {
+		return old, false, nil
+	}
+	return app, true, nil
+}
+
+// isAppUpdated returns true if the merged application differs from the old
+// one, without taking the modification date into account.
+func isAppUpdated(old, app *App) bool {
+	if old == nil {
+		return true
+	}
+	merged := *app
+	merged.UpdatedAt = old.UpdatedAt
+	return !reflect.DeepEqual(old, &merged)
+}
+
+// CreateOrUpdateApps is the batch version of CreateOrUpdateApp: the existing
+// applications are fetched with a single request, and all the applications
+// are written with one bulk request. The applications that could not be
+// written are reported in the returned multierror, while the other ones are
+// returned.
+func CreateOrUpdateApps(c *Space, opts []*AppOptions, editor *auth.Editor) ([]*App, error) {
+	var errm error
+
+	ids := make([]string, 0, len(opts))
+	valids := make([]*AppOptions, 0, len(opts))
+	for _, opt := range opts {
+		// The options are normalized when they are validated: the caller's
+		// ones are left untouched.
+		o := *opt
+		if err := IsValidApp(&o); err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", o.Slug, err))
+			continue
+		}
+		id := getAppID(o.Slug)
+		if stringInArray(id, ids) {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", o.Slug,
+				"Application is specified more than once"))
+			continue
+		}
+		ids = append(ids, id)
+		valids = append(valids, &o)
+	}
+	if len(valids) == 0 {
+		return nil, errm
+	}
+
+	db := c.AppsDB()
+	olds := make(map[string]*App, len(ids))
+	{
+		rows, err := db.AllDocs(ctx, map[string]interface{}{
+			"keys":         ids,
+			"include_docs": true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if rows.ID() == "" {
+				continue
+			}
+			var value struct {
+				Deleted bool `json:"deleted"`
+			}
+			if err = rows.ScanValue(&value); err != nil {
+				return nil, err
+			}
+			if value.Deleted {
+				continue
+			}
+			var doc *App
+			if err = rows.ScanDoc(&doc); err != nil {
+				return nil, err
+			}
+			olds[rows.ID()] = doc
+		}
+	}
+
+	apps := make([]*App, 0, len(valids))
+	// The applications left unchanged are not written, as in
+	// CreateOrUpdateApp, but they are still returned.
+	written := make([]*App, 0, len(valids))
+	for _, o := range valids {
+		old := olds[getAppID(o.Slug)]
+		app, err := mergeApp(old, o, editor)
+		if err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", o.Slug, err))
+			continue
+		}
+		if !isAppUpdated(old, app) {
+			written = append(written, old)
+			continue
+		}
+		apps = append(apps, app)
+	}
+	if len(apps) == 0 {
+		if len(written) == 0 {
+			return nil, errm
+		}
+		return written, errm
+	}
+
+	results, err := db.BulkDocs(ctx, apps)
 	if err != nil {
 		return nil, err
 	}
+	defer results.Close()
+
+	for i := 0; results.Next() && i < len(apps); i++ {
+		app := apps[i]
+		if err = results.UpdateErr(); err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", app.Slug, err))
+			continue
+		}
+		app.Rev = results.Rev()
+		written = append(written, app)
+	}
+	if err = results.Err(); err != nil {
+		return nil, err
+	}
+
+	return written, errm
+}
+
+// mergeApp returns the application document resulting from applying the
+// given options on the old application. If old is nil, a new application is
+// returned.
+func mergeApp(old *App, opts *AppOptions, editor *auth.Editor) (*App, error) {
+	if old == nil {
+		app := new(App)
+		app.ID = getAppID(opts.Slug)
+		app.Rev = ""
+		app.Slug = app.ID
+		app.Type = opts.Type
+		app.Editor = editor.Name()
+		app.Category = opts.Category
+		app.Tags = opts.Tags
+		app.CreatedAt = time.Now().UTC()
+		app.UpdatedAt = app.CreatedAt
+		app.AppName = opts.Name
+		app.AppDescription = opts.Description
+		app.AppStoreURLs = opts.AppStoreURLs
+		if opts.Private != nil {
+			app.Private = *opts.Private
+		}
+		app.DataUsageCommitment, app.DataUsageCommitmentBy = defaultDataUserCommitment(app, opts)
+		return app, nil
+	}
+
+	if !strings.EqualFold(old.Editor, editor.Name()) {
+		return nil, ErrAppEditorMismatch
+	}
+	app := *old
+	if opts.Category != "" {
+		app.Category = opts.Category
+	}
+	if opts.Tags != nil {
+		app.Tags = opts.Tags
+	}
+	if opts.Name != nil {
+		app.AppName = opts.Name
+	}
+	if opts.Description != nil {
+		app.AppDescription = opts.Description
+	}
+	if opts.AppStoreURLs != nil {
+		app.AppStoreURLs = opts.AppStoreURLs
+	}
+	if opts.Private != nil {
+		app.Private = *opts.Private
+	}
 	if opts.DataUsageCommitment != nil {
 		app.DataUsageCommitment = *opts.DataUsageCommitment
 	}
 	if opts.DataUsageCommitmentBy != nil {
 		app.DataUsageCommitmentBy = *opts.DataUsageCommitmentBy
 	}
+	app.UpdatedAt = time.Now().UTC()
+	return &app, nil
+}
+
+func ModifyApp(c *Space, appSlug string, opts AppOptions) (*App, error) {
+	app, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Category != "" {
+		if app.Category, err = checkCategory(opts.Category); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Tags != nil {
+		if app.Tags, err = checkTags(opts.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Name != nil {
+		app.AppName = opts.Name
+	}
+	if opts.Description != nil {
+		app.AppDescription = opts.Description
+	}
+	if opts.AppStoreURLs != nil {
+		app.AppStoreURLs = opts.AppStoreURLs
+	}
+	if opts.Private != nil {
+		app.Private = *opts.Private
+	}
+	if opts.DataUsageCommitment != nil {
+		app.DataUsageCommitment = *opts.DataUsageCommitment
+	}
+	if opts.DataUsageCommitmentBy != nil {
+		app.DataUsageCommitmentBy = *opts.DataUsageCommitmentBy
+	}
+	app.UpdatedAt = time.Now().UTC()
 	_, err = c.AppsDB().Put(ctx, app.ID, app)
 	if err != nil {
 		return nil, err
@@ -499,13 +1695,16 @@ func ModifyApp(c *Space, appSlug string, opts AppOptions) (*App, error) {
 }
 
 func ActivateMaintenanceApp(c *Space, appSlug string, opts MaintenanceOptions) error {
-	app, err := findApp(c, appSlug)
+	app, err := findApp(ctx, c, appSlug)
 	if err != nil {
 		return err
 	}
 	if opts.Messages == nil {
 		opts.Messages = make(map[string]MaintenanceMessage)
 	}
+	if opts.Start != nil && opts.End != nil && !opts.End.After(*opts.Start) {
+		return ErrMaintenanceWindowInvalid
+	}
 	app.MaintenanceActivated = true
 	app.MaintenanceOptions = &opts
 	_, err = c.AppsDB().Put(ctx, app.ID, app)
@@ -513,7 +1712,7 @@ func ActivateMaintenanceApp(c *Space, appSlug string, opts MaintenanceOptions) e
 }
 
 func DeactivateMaintenanceApp(c *Space, appSlug string) error {
-	app, err := findApp(c, appSlug)
+	app, err := findApp(ctx, c, appSlug)
 	if err != nil {
 		return err
 	}
@@ -523,197 +1722,934 @@ func DeactivateMaintenanceApp(c *Space, appSlug string) error {
 	return err
 }
 
-func DownloadVersion(opts *VersionOptions) (*Version, []*kivik.Attachment, error) {
-	return downloadVersion(opts)
+// ArchiveApp marks the application as archived. It is then excluded from the
+// list of applications, unless explicitly asked for. The replacedBy slug, if
+// not empty, is the application replacing it, which must exist.
+func ArchiveApp(c *Space, appSlug, replacedBy string) error {
+	app, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return err
+	}
+	if replacedBy != "" {
+		if replacedBy == app.Slug {
+			return ErrAppSlugInvalid
+		}
+		if _, err = findApp(ctx, c, replacedBy); err != nil {
+			return err
+		}
+	}
+	app.Archived = true
+	app.ReplacedBy = replacedBy
+	app.UpdatedAt = time.Now().UTC()
+	_, err = c.AppsDB().Put(ctx, app.ID, app)
+	return err
+}
+
+// SetAppFeatured sets the rank of the application in the featured ones, the
+// highest first. A rank of 0 removes the application from them.
+func SetAppFeatured(c *Space, appSlug string, featured int) error {
+	if featured < 0 {
+		return ErrAppFeaturedInvalid
+	}
+	app, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return err
+	}
+	app.Featured = featured
+	app.UpdatedAt = time.Now().UTC()
+	_, err = c.AppsDB().Put(ctx, app.ID, app)
+	return err
+}
+
+// VerifyVersionSignature checks the detached signature of the version, which
+// is required if the editor has signing enabled. When the key is not given,
+// SignatureKeyID is set to the one of the key that made the signature.
+func VerifyVersionSignature(editor *auth.Editor, opts *VersionOptions) error {
+	if opts.Signature == "" {
+		if editor.SigningRequired() {
+			return ErrVersionSignatureMissing
+		}
+		return nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(opts.Signature)
+	if err != nil {
+		return ErrVersionSignatureInvalid
+	}
+	message := []byte(strings.ToLower(opts.Sha256))
+	if opts.SignatureKeyID != "" {
+		if !editor.VerifySignatureWithKeyID(opts.SignatureKeyID, message, signature) {
+			return ErrVersionSignatureInvalid
+		}
+		return nil
+	}
+	for _, keyID := range []string{editor.PublicKeyID(), editor.NextPublicKeyID()} {
+		if keyID != "" && editor.VerifySignatureWithKeyID(keyID, message, signature) {
+			opts.SignatureKeyID = keyID
+			return nil
+		}
+	}
+	return ErrVersionSignatureInvalid
+}
+
+func DownloadVersion(ctx context.Context, c *Space, opts *VersionOptions) (*Version, []*kivik.Attachment, error) {
+	return downloadVersion(ctx, c, opts)
+}
+
+func createVersion(c *Space, db *kivik.DB, ver *Version, attachments []*kivik.Attachment, app *App, ensureVersion bool) (err error) {
+	if ver.Slug != app.Slug {
+		return ErrVersionSlugMismatch
+	}
+	if ver.Type != app.Type {
+		return ErrVersionTypeMismatch
+	}
+	// The editors names are case-insensitive: the version keeps the name of
+	// the application editor.
+	if !strings.EqualFold(ver.Editor, app.Editor) {
+		return ErrVersionEditorMismatch
+	}
+	ver.Editor = app.Editor
+
+	if ensureVersion {
+		_, err := FindVersion(ctx, c, ver.Slug, ver.Version)
+		if err == nil {
+			return ErrVersionAlreadyExists
+		}
+		if err != ErrVersionNotFound {
+			return err
+		}
+	}
+
+	_, ver.Rev, err = db.CreateDoc(ctx, ver)
+	if err != nil {
+		return err
+	}
+	// The document exists from now on, even if an attachment fails below.
+	defer InvalidateVersionsCache(ver.Slug)
+
+	for _, att := range attachments {
+		ver.Rev, err = db.PutAttachment(ctx, ver.ID, ver.Rev, att)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func CreatePendingVersion(c *Space, ver *Version, attachments []*kivik.Attachment, app *App) error {
+	return createVersion(c, c.PendingVersDB(), ver, attachments, app, true)
+}
+
+func CreateReleaseVersion(c *Space, ver *Version, attachments []*kivik.Attachment, app *App, ensureVersion bool) (err error) {
+	if err = createVersion(c, c.VersDB(), ver, attachments, app, ensureVersion); err != nil {
+		return err
+	}
+	notifyVersionPublished(c, ver)
+	releaseVersion(c, ver)
+	return nil
+}
+
+// importReleaseVersion creates a published version like CreateReleaseVersion,
+// but without notifying the publish observers: the imported versions have
+// already been published.
+func importReleaseVersion(c *Space, ver *Version, attachments []*kivik.Attachment, app *App) error {
+	if err := createVersion(c, c.VersDB(), ver, attachments, app, false); err != nil {
+		return err
+	}
+	releaseVersion(c, ver)
+	return nil
+}
+
+// releaseVersion updates the latest version of the application of a newly
+// published version. The version is published even if the application could
+// not be updated: returning an error would make the client retry a
+// publication that can only fail with ErrVersionAlreadyExists.
+func releaseVersion(c *Space, ver *Version) {
+	if errl := updateAppLatestVersion(c, ver); errl != nil {
+		logLatestVersionError(ver.Slug, errl)
+	}
+}
+
+// PublishObserver is notified of the versions published in the registry, to
+// send notifications for example.
+type PublishObserver interface {
+	OnVersionPublished(c *Space, ver *Version)
+}
+
+var (
+	publishObserversMu sync.RWMutex
+	publishObservers   []PublishObserver
+)
+
+// RegisterPublishObserver adds an observer notified of the published
+// versions. The observers are called in their own goroutine, so that they
+// cannot block nor break the publication.
+func RegisterPublishObserver(o PublishObserver) {
+	publishObserversMu.Lock()
+	defer publishObserversMu.Unlock()
+	publishObservers = append(publishObservers, o)
+}
+
+func notifyVersionPublished(c *Space, ver *Version) {
+	publishObserversMu.RLock()
+	defer publishObserversMu.RUnlock()
+	for _, o := range publishObservers {
+		// Each observer gets its own copy, as the caller keeps using the
+		// version, for example to clean it before sending it back.
+		go func(o PublishObserver, ver *Version) {
+			defer func() {
+				if r := recover(); r != nil {
+					logrus.WithFields(logrus.Fields{
+						"nspace":  "registry",
+						"slug":    ver.Slug,
+						"version": ver.Version,
+					}).Errorf("Publish observer panicked: %v", r)
+				}
+			}()
+			o.OnVersionPublished(c, ver)
+		}(o, ver.Clone())
+	}
+}
+
+// updateAppLatestVersion updates the latest stable version stored on the
+// application document, when a newer stable version is published.
+func updateAppLatestVersion(c *Space, ver *Version) error {
+	if GetVersionChannel(ver.Version) != Stable {
+		return nil
+	}
+	prepare := func() (*App, bool, error) {
+		// The application is fetched again to avoid saving its calculated
+		// fields, and to get its latest revision after a conflict.
+		app, err := findApp(ctx, c, ver.Slug)
+		if err != nil {
+			return nil, false, err
+		}
+		return app, setAppLatestVersion(app, ver), nil
+	}
+	_, err := writeAppWithRetries(prepare, putApp(c))
+	return err
+}
+
+// refreshAppLatestVersion sets again the latest stable version stored on the
+// application document from its published versions, after some of them have
+// been deleted.
+func refreshAppLatestVersion(c *Space, appSlug string) error {
+	latest, err := FindLatestVersion(ctx, c, appSlug, Stable)
+	if err != nil && err != ErrVersionNotFound {
+		return err
+	}
+	prepare := func() (*App, bool, error) {
+		app, err := findApp(ctx, c, appSlug)
+		if err != nil {
+			return nil, false, err
+		}
+		return app, resetAppLatestVersion(app, latest), nil
+	}
+	_, err = writeAppWithRetries(prepare, putApp(c))
+	return err
+}
+
+// putApp returns a function writing an existing application, for
+// writeAppWithRetries.
+func putApp(c *Space) func(*App) error {
+	return func(app *App) (err error) {
+		app.Rev, err = c.AppsDB().Put(ctx, app.ID, app)
+		return err
+	}
+}
+
+// logLatestVersionError logs the failure to update the latest stable version
+// stored on an application. It is set again by the next publication, or by
+// the backfill-latest-versions command.
+func logLatestVersionError(appSlug string, err error) {
+	logrus.WithFields(logrus.Fields{
+		"nspace": "registry",
+		"slug":   appSlug,
+	}).Errorf("Could not update the latest stable version of the application: %s", err)
+}
+
+// resetAppLatestVersion sets the given stable version as the latest one of
+// the application, or removes it if latest is nil. It returns false if the
+// application has not been modified.
+func resetAppLatestVersion(app *App, latest *Version) bool {
+	if latest == nil {
+		if app.LatestStableVersion == "" {
+			return false
+		}
+		app.LatestStableVersion = ""
+		app.LatestStableCreatedAt = nil
+		return true
+	}
+	if app.LatestStableVersion == latest.Version {
+		return false
+	}
+	app.LatestStableVersion = ""
+	return setAppLatestVersion(app, latest)
+}
+
+// setAppLatestVersion sets the given stable version as the latest one of the
+// application, if it is newer than the current one. It returns false if the
+// application has not been modified.
+func setAppLatestVersion(app *App, ver *Version) bool {
+	if app.LatestStableVersion != "" && !VersionLess(app.LatestStableVersion, ver.Version) {
+		return false
+	}
+	publishedAt := ver.CreatedAt
+	if ver.PublishedAt != nil {
+		publishedAt = *ver.PublishedAt
+	}
+	app.LatestStableVersion = ver.Version
+	app.LatestStableCreatedAt = &publishedAt
+	return true
+}
+
+// BackfillLatestVersions sets the latest stable version on the documents of
+// the applications of the given space that were created before it was
+// denormalized. The applications whose latest version could not be updated
+// are reported in the returned multierror.
+func BackfillLatestVersions(c *Space) (int, error) {
+	rows, err := c.AppsDB().AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var apps []*App
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var app *App
+		if err = rows.ScanDoc(&app); err != nil {
+			return 0, err
+		}
+		apps = append(apps, app)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var errm error
+	count := 0
+	for _, app := range apps {
+		ver, err := FindLatestVersion(ctx, c, app.Slug, Stable)
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", app.Slug, err))
+			continue
+		}
+		if !setAppLatestVersion(app, ver) {
+			continue
+		}
+		if _, err = c.AppsDB().Put(ctx, app.ID, app); err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", app.Slug, err))
+			continue
+		}
+		count++
+	}
+	return count, errm
+}
+
+func (version *Version) Clone() *Version {
+	clone := *version
+	clone.Attachments = make(map[string]interface{})
+	for k, v := range version.Attachments {
+		clone.Attachments[k] = v
+	}
+	return &clone
+}
+
+func ApprovePendingVersion(c *Space, pending *Version, app *App) (*Version, error) {
+	db := c.PendingVersDB()
+
+	release := pending.Clone()
+
+	var attachments []*kivik.Attachment
+	for filename := range release.Attachments {
+		attachment, err := db.GetAttachment(ctx, pending.ID, pending.Rev, filename)
+		if err != nil {
+			return nil, err
+		}
+		attachment.Filename = filename
+		attachments = append(attachments, attachment)
+	}
+
+	now := time.Now().UTC()
+	release.Rev = ""
+	release.Attachments = nil
+	release.PublishedAt = &now
+	release.pending = false
+
+	// We need to skip version check, because we don't drop pending
+	// version until the end to avoid data loss in case of error
+	err := CreateReleaseVersion(c, release, attachments, app, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete only at the end, to avoid data loss in case of error
+	if _, err := db.Delete(ctx, pending.ID, pending.Rev); err != nil {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// PublishPendingVersion moves the given pending version of an application to
+// the published versions. It fails with ErrVersionAlreadyExists if this
+// version has already been published. The pending version is only deleted
+// once the published one has been written, so that it is left intact on
+// error.
+func PublishPendingVersion(c *Space, appSlug, version string) (*Version, error) {
+	pending, err := FindPendingVersion(ctx, c, appSlug, version)
+	if err != nil {
+		return nil, err
+	}
+	_, err = FindPublishedVersion(ctx, c, appSlug, version)
+	if err == nil {
+		return nil, ErrVersionAlreadyExists
+	}
+	if err != ErrVersionNotFound {
+		return nil, err
+	}
+	app, err := findApp(ctx, c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	return ApprovePendingVersion(c, pending, app)
+}
+
+// PruneDevVersions permanently deletes the dev versions of an application,
+// except the keep most recent ones. The stable, patch and beta versions are
+// never deleted. It returns the number of deleted versions.
+func PruneDevVersions(c *Space, appSlug string, keep int) (int, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return 0, ErrAppSlugInvalid
+	}
+
+	db := c.VersDB()
+	rows, err := versionViewQuery(ctx, c, db, appSlug, channelToStr(Dev), map[string]interface{}{
+		"descending":   false,
+		"include_docs": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var versions []*Version
+	for rows.Next() {
+		var ver *Version
+		if err = rows.ScanDoc(&ver); err != nil {
+			return 0, err
+		}
+		versions = append(versions, ver)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	pruned := devVersionsToPrune(versions, keep)
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	docs := make([]interface{}, len(pruned))
+	for i, ver := range pruned {
+		docs[i] = map[string]interface{}{
+			"_id":      ver.ID,
+			"_rev":     ver.Rev,
+			"_deleted": true,
+		}
+	}
+	results, err := db.BulkDocs(ctx, docs)
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	var errm error
+	removed := 0
+	for i := 0; results.Next() && i < len(pruned); i++ {
+		if err = results.UpdateErr(); err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", pruned[i].Version, err))
+			continue
+		}
+		removed++
+	}
+	if err = results.Err(); err != nil {
+		errm = multierror.Append(errm, err)
+	}
+
+	InvalidateVersionsCache(appSlug)
+	for _, ver := range pruned {
+		forgetPublishedVersion(c, appSlug, ver.Version)
+	}
+	// Only dev versions are pruned, so the latest stable version should not
+	// change, but it is checked to repair it if it had become stale.
+	if removed > 0 {
+		if errl := refreshAppLatestVersion(c, appSlug); errl != nil {
+			logLatestVersionError(appSlug, errl)
+		}
+	}
+	return removed, errm
 }
 
-func createVersion(c *Space, db *kivik.DB, ver *Version, attachments []*kivik.Attachment, app *App, ensureVersion bool) (err error) {
-	if ver.Slug != app.Slug {
-		return ErrVersionSlugMismatch
+// devVersionsToPrune returns the dev versions to delete from the given
+// versions, sorted from the oldest to the newest, so that only the keep most
+// recent dev versions remain.
+func devVersionsToPrune(versions []*Version, keep int) []*Version {
+	var devs []*Version
+	for _, ver := range versions {
+		if GetVersionChannel(ver.Version) == Dev {
+			devs = append(devs, ver)
+		}
+	}
+	if keep < 0 {
+		keep = 0
 	}
+	if len(devs) <= keep {
+		return nil
+	}
+	return devs[:len(devs)-keep]
+}
 
-	if ensureVersion {
-		_, err := FindVersion(c, ver.Slug, ver.Version)
-		if err == nil {
-			return ErrVersionAlreadyExists
+// DeleteVersion permanently deletes the given version of an application, with
+// its attachments, from the published or pending versions. The latest stable
+// version is not deleted, unless force is true.
+func DeleteVersion(c *Space, appSlug, version string, force bool) error {
+	db := c.VersDB()
+	ver, err := findVersion(ctx, appSlug, version, db)
+	if err == ErrVersionNotFound {
+		db = c.PendingVersDB()
+		ver, err = findVersion(ctx, appSlug, version, db)
+	} else if err == nil && !force {
+		latest, errl := FindLatestVersion(ctx, c, appSlug, Stable)
+		if errl != nil && errl != ErrVersionNotFound {
+			return errl
 		}
-		if err != ErrVersionNotFound {
-			return err
+		if errl == nil && latest.Version == ver.Version {
+			return ErrVersionLatestStable
 		}
 	}
-
-	ver.Slug = app.Slug
-	ver.Type = app.Type
-	ver.Editor = app.Editor
-
-	_, ver.Rev, err = db.CreateDoc(ctx, ver)
 	if err != nil {
 		return err
 	}
 
-	versionChannel := GetVersionChannel(ver.Version)
-	for _, channel := range []Channel{Stable, Beta, Dev} {
-		if channel >= versionChannel {
-			key := lru.Key(ver.Slug + "/" + channelToStr(channel))
-			cacheVersionsLatest.Remove(key)
-			cacheVersionsList.Remove(key)
-		}
+	if _, err = db.Delete(ctx, ver.ID, ver.Rev); err != nil {
+		return err
 	}
 
-	for _, att := range attachments {
-		ver.Rev, err = db.PutAttachment(ctx, ver.ID, ver.Rev, att)
-		if err != nil {
-			return err
+	InvalidateVersionsCache(ver.Slug)
+	forgetPublishedVersion(c, ver.Slug, ver.Version)
+	if db == c.VersDB() && GetVersionChannel(ver.Version) == Stable {
+		if errl := refreshAppLatestVersion(c, ver.Slug); errl != nil {
+			logLatestVersionError(ver.Slug, errl)
 		}
 	}
-
 	return nil
 }
 
-func CreatePendingVersion(c *Space, ver *Version, attachments []*kivik.Attachment, app *App) error {
-	return createVersion(c, c.PendingVersDB(), ver, attachments, app, true)
+// digests contains the hexadecimal checksums of a version tarball.
+type digests struct {
+	sha256 string
+	sha512 string
 }
 
-func CreateReleaseVersion(c *Space, ver *Version, attachments []*kivik.Attachment, app *App, ensureVersion bool) (err error) {
-	return createVersion(c, c.VersDB(), ver, attachments, app, ensureVersion)
+// checkDigests computes the checksums of the given data, and verifies them
+// against the expected ones, when they are specified.
+func checkDigests(data []byte, expected digests) (computed digests, err error) {
+	h256 := sha256.New()
+	h512 := sha512.New()
+	w := io.MultiWriter(h256, h512)
+	w.Write(data)
+	computed.sha256 = hex.EncodeToString(h256.Sum(nil))
+	computed.sha512 = hex.EncodeToString(h512.Sum(nil))
+
+	if expected.sha256 != "" && !strings.EqualFold(expected.sha256, computed.sha256) {
+		err = errshttp.NewError(http.StatusUnprocessableEntity,
+			"Checksum does not match the calculated one (expecting %q, got %q)", expected.sha256, computed.sha256)
+		return
+	}
+	if expected.sha512 != "" && !strings.EqualFold(expected.sha512, computed.sha512) {
+		err = errshttp.NewError(http.StatusUnprocessableEntity,
+			"Checksum does not match the calculated one (expecting %q, got %q)", expected.sha512, computed.sha512)
+		return
+	}
+	return
 }
 
-func (version *Version) Clone() *Version {
-	clone := *version
-	clone.Attachments = make(map[string]interface{})
-	for k, v := range version.Attachments {
-		clone.Attachments[k] = v
-	}
-	return &clone
+// transientError is a download failure that may not happen again, like a
+// network error or an unavailable server, and is worth a retry.
+type transientError struct {
+	error
 }
 
-func ApprovePendingVersion(c *Space, pending *Version, app *App) (*Version, error) {
-	db := c.PendingVersDB()
+// downloadWithRetries downloads the given url, retrying with an exponential
+// backoff on the transient failures, until the context is done. When the
+// resumable downloads are enabled and the origin accepts byte ranges, the
+// retries resume from the last received byte instead of starting over.
+func downloadWithRetries(ctx context.Context, url string, expected digests, maxSize int64) (reader *bytes.Reader, computed digests, err error) {
+	if err = validateDownloadURL(url); err != nil {
+		return
+	}
 
-	release := pending.Clone()
+	part, err := newPartialTarball(downloadConfig.Resumable)
+	if err != nil {
+		return
+	}
+	defer part.Close()
 
-	var attachments []*kivik.Attachment
-	for filename := range release.Attachments {
-		attachment, err := db.GetAttachment(ctx, pending.ID, pending.Rev, filename)
+	delay := downloadConfig.retryDelay()
+	for retry := 0; ; retry++ {
+		err = downloadRequest(ctx, url, maxSize, part)
+		terr, ok := err.(*transientError)
+		if !ok {
+			break
+		}
+		err = terr.error
+		if retry >= downloadConfig.retries() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return
+	}
+
+	data, err := part.Bytes()
+	if err != nil {
+		return
+	}
+	computed, err = checkDigests(data, expected)
+	if err != nil {
+		return
+	}
+	return bytes.NewReader(data), computed, nil
+}
+
+// partialTarball holds the bytes of a tarball received so far. It is kept
+// in a temporary file for the resumable downloads, and in memory otherwise.
+type partialTarball struct {
+	file *os.File
+	buf  bytes.Buffer
+	size int64
+	// acceptRanges is true when the origin accepts to resume the download.
+	acceptRanges bool
+}
+
+func newPartialTarball(resumable bool) (*partialTarball, error) {
+	p := &partialTarball{}
+	if resumable {
+		f, err := ioutil.TempFile("", "cozy-registry-tarball-")
 		if err != nil {
 			return nil, err
 		}
-		attachment.Filename = filename
-		attachments = append(attachments, attachment)
+		p.file = f
 	}
+	return p, nil
+}
 
-	release.Rev = ""
-	release.Attachments = nil
+func (p *partialTarball) Write(b []byte) (int, error) {
+	var n int
+	var err error
+	if p.file != nil {
+		n, err = p.file.Write(b)
+	} else {
+		n, err = p.buf.Write(b)
+	}
+	p.size += int64(n)
+	return n, err
+}
 
-	// We need to skip version check, because we don't drop pending
-	// version until the end to avoid data loss in case of error
-	err := CreateReleaseVersion(c, release, attachments, app, false)
-	if err != nil {
-		return nil, err
+func (p *partialTarball) reset() error {
+	p.size = 0
+	if p.file == nil {
+		p.buf.Reset()
+		return nil
+	}
+	if err := p.file.Truncate(0); err != nil {
+		return err
 	}
+	_, err := p.file.Seek(0, io.SeekStart)
+	return err
+}
 
-	// Delete only at the end, to avoid data loss in case of error
-	if _, err := db.Delete(ctx, pending.ID, pending.Rev); err != nil {
+// Bytes returns the content of the tarball. It should only be called once
+// the download is complete.
+func (p *partialTarball) Bytes() ([]byte, error) {
+	if p.file == nil {
+		return p.buf.Bytes(), nil
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
+	return ioutil.ReadAll(p.file)
+}
 
-	return release, nil
+func (p *partialTarball) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	p.file.Close()
+	return os.Remove(p.file.Name())
 }
 
-func downloadRequest(url string, shasum string) (reader *bytes.Reader, contentType string, err error) {
+// downloadRequest makes a single request to download the tarball at the given
+// url into part. If part already contains the beginning of the tarball and
+// the origin accepts byte ranges, only the remaining bytes are requested.
+func downloadRequest(ctx context.Context, url string, maxSize int64, part *partialTarball) (err error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		err = errshttp.NewError(http.StatusUnprocessableEntity,
+		return errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: %s", url, err)
-		return
+	}
+	req = req.WithContext(ctx)
+	resuming := part.acceptRanges && part.size > 0
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", part.size))
 	}
 
 	resp, err := versionClient.Do(req)
 	if err != nil {
+		// The errors of the redirect policy are returned as is
+		var herr *errshttp.Error
+		if errors.As(err, &herr) {
+			return herr
+		}
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: %s", url, err)
-		return
+		if ctx.Err() == nil {
+			err = &transientError{err}
+		}
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err = part.reset(); err != nil {
+			return err
+		}
+		part.acceptRanges = part.file != nil && resp.Header.Get("Accept-Ranges") == "bytes"
+	case resp.StatusCode == http.StatusPartialContent && resuming:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", part.size)) {
+			// The origin did not resume at the expected offset: start over.
+			part.acceptRanges = false
+			if err = part.reset(); err != nil {
+				return err
+			}
+			return &transientError{errshttp.NewError(http.StatusUnprocessableEntity,
+				"Could not reach version on specified url %s: unexpected range %q",
+				url, resp.Header.Get("Content-Range"))}
+		}
+	default:
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: server responded with code %d",
 			url, resp.StatusCode)
-		return
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			err = &transientError{err}
+		}
+		return err
+	}
+
+	// Fail fast when the origin announces a tarball that is too big. When the
+	// length is unknown, the limited reader below still bounds the download.
+	if resp.ContentLength > maxSize-part.size {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: file is too big (%d bytes, limit is %d bytes)",
+			url, part.size+resp.ContentLength, maxSize)
+	}
+	if resp.ContentLength < 0 {
+		logrus.WithFields(logrus.Fields{
+			"nspace": "registry",
+			"url":    url,
+		}).Warn("Tarball downloaded without a Content-Length")
 	}
 
-	buf := new(bytes.Buffer)
-	_, err = io.Copy(buf, io.LimitReader(resp.Body, maxApplicationSize))
+	_, err = io.Copy(part, io.LimitReader(resp.Body, maxSize+1-part.size))
 	if err != nil {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: %s",
 			url, err)
+		if ctx.Err() == nil {
+			err = &transientError{err}
+		}
+		return err
+	}
+	if part.size > maxSize {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: file is too big (limit is %d bytes)",
+			url, maxSize)
+	}
+	return nil
+}
+
+// tarReader returns a reader on the tar archive, decompressing it if it is
+// gzipped. The compression is detected from the first bytes of the archive,
+// as the content-type sent by the servers hosting the tarballs is not
+// reliable.
+func tarReader(reader io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(reader)
+	// Peek returns an error when the archive is shorter than the header, but
+	// the available bytes are still enough to detect its type.
+	hdr, _ := br.Peek(magic.HeaderBytesNeeded())
+	reader = br
+	if magic.MIMEType("", hdr) == "application/gzip" {
+		var err error
+		if reader, err = gzip.NewReader(br); err != nil {
+			return nil, err
+		}
+	}
+	return tar.NewReader(reader), nil
+}
+
+func downloadVersion(ctx context.Context, c *Space, opts *VersionOptions) (ver *Version, attachments []*kivik.Attachment, err error) {
+	expected := digests{sha256: opts.Sha256, sha512: opts.Sha512}
+	buf, sums, err := downloadWithRetries(ctx, opts.URL, expected, c.maxAppSize())
+	if err != nil {
 		return
 	}
 
-	h := sha256.New()
-	h.Write(buf.Bytes())
-	e, _ := hex.DecodeString(shasum)
-	if !bytes.Equal(e, h.Sum(nil)) {
-		err = errshttp.NewError(http.StatusUnprocessableEntity,
-			"Checksum does not match the calculated one (expecting %q, got %q)", shasum, hex.EncodeToString(h.Sum(nil)))
+	ver, attachments, err = validateTarball(buf, opts, c.maxAppSize())
+	if err != nil {
 		return
 	}
+	ver.Sha256 = sums.sha256
+	ver.Sha512 = sums.sha512
 
-	contentType = resp.Header.Get("content-type")
-	return bytes.NewReader(buf.Bytes()), contentType, nil
+	if StoreTarballs {
+		tarball := io.NewSectionReader(buf, 0, buf.Size())
+		header := make([]byte, magic.HeaderBytesNeeded())
+		n, _ := tarball.ReadAt(header, 0)
+		contentType := magic.MIMEType("", header[:n])
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, &kivik.Attachment{
+			Content:     ioutil.NopCloser(tarball),
+			Size:        buf.Size(),
+			Filename:    tarballAttachmentName,
+			ContentType: contentType,
+		})
+		ver.TarballObject = tarballAttachmentName
+	}
+	return
 }
 
-func tarReader(reader io.Reader, contentType string) (*tar.Reader, error) {
-	var err error
-	switch contentType {
-	case
-		"application/gzip",
-		"application/x-gzip",
-		"application/x-tgz",
-		"application/tar+gzip":
-		reader, err = gzip.NewReader(reader)
-		if err != nil {
-			return nil, err
+// GetVersionTarball returns the tarball of the given published version, with
+// its MIME type and its size, or -1 if it is unknown. The copy stored by the
+// registry is used if there is one, with the type detected when it was
+// stored. Otherwise the tarball is downloaded from its URL, which must still
+// be valid for the current download configuration, and is served as
+// application/gzip.
+func GetVersionTarball(ctx context.Context, c *Space, appSlug, version string) (io.ReadCloser, string, int64, error) {
+	ver, err := FindPublishedVersion(ctx, c, appSlug, version)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if ver.TarballObject != "" {
+		att, err := c.VersDB().GetAttachment(ctx, ver.ID, "", ver.TarballObject)
+		if err == nil {
+			return att.Content, att.ContentType, att.Size, nil
 		}
-	case "application/octet-stream":
-		var r io.Reader
-		if r, err = gzip.NewReader(reader); err == nil {
-			reader = r
+		if kivik.StatusCode(err) != http.StatusNotFound {
+			return nil, "", 0, wrapAttachmentError(err, ver.TarballObject)
 		}
 	}
-	return tar.NewReader(reader), nil
+
+	if err = validateDownloadURL(ver.URL); err != nil {
+		return nil, "", 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ver.URL, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return nil, "", 0, errshttp.NewError(http.StatusBadGateway,
+			"Could not reach version on specified url %s: %s", ver.URL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", 0, errshttp.NewError(http.StatusBadGateway,
+			"Could not reach version on specified url %s: server responded with code %d",
+			ver.URL, resp.StatusCode)
+	}
+	return resp.Body, "application/gzip", resp.ContentLength, nil
 }
 
-func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.Attachment, err error) {
-	url := opts.URL
+// VerifyVersionIntegrity downloads again the tarball of the given version, and
+// checks that its checksums still match the ones recorded when the version
+// was created. It returns an error if the tarball can not be downloaded or if
+// the checksums do not match.
+func VerifyVersionIntegrity(ctx context.Context, c *Space, appSlug, version string) error {
+	ver, err := FindVersion(ctx, c, appSlug, version)
+	if err != nil {
+		return err
+	}
+	if ver.Sha256 == "" && ver.Sha512 == "" {
+		return fmt.Errorf("Version %s of %s has no recorded checksum", ver.Version, ver.Slug)
+	}
+	expected := digests{sha256: ver.Sha256, sha512: ver.Sha512}
+	_, _, err = downloadWithRetries(ctx, ver.URL, expected, c.maxAppSize())
+	return err
+}
 
-	var buf *bytes.Reader
-	var contentType string
-	tryCount := 0
-	for {
-		tryCount++
-		buf, contentType, err = downloadRequest(url, opts.Sha256)
-		if err == nil {
-			break
-		} else if tryCount <= 3 {
-			continue
-		} else {
-			return
-		}
+// ValidateTarball checks the content of an application tarball read from the
+// given reader, without downloading it. It verifies that the tarball contains
+// a valid manifest matching the specified version options, and returns the
+// version that would be created from it. The tarball is rejected when it is
+// bigger than the maximum application size of the space.
+func ValidateTarball(c *Space, r io.Reader, opts *VersionOptions) (*Version, error) {
+	maxSize := c.maxAppSize()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not read application tarball: %s", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not read application tarball: file is too big (limit is %d bytes)", maxSize)
 	}
+	ver, _, err := validateTarball(bytes.NewReader(data), opts, maxSize)
+	return ver, err
+}
+
+// sniffHeader returns the first bytes of data, enough for magic.MIMEType to
+// detect its type.
+func sniffHeader(data []byte) []byte {
+	if n := magic.HeaderBytesNeeded(); len(data) > n {
+		return data[:n]
+	}
+	return data
+}
+
+func validateTarball(buf *bytes.Reader, opts *VersionOptions, maxSize int64) (ver *Version, attachments []*kivik.Attachment, err error) {
+	url := opts.URL
 
 	counter := &Counter{}
 	var reader io.Reader = buf
 	reader = io.TeeReader(reader, counter)
 
 	var packVersion string
-	var appType, tarPrefix string
+	var appType, tarPrefix, manifestPath string
 	var manifestContent []byte
-	hasPrefix := true
+	var filesSize int64
+	var filenames []string
 
-	tr, err := tarReader(reader, contentType)
+	tr, err := tarReader(reader)
 	if err != nil {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: %s", url, err)
@@ -727,7 +2663,7 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 		}
 		if err == io.ErrUnexpectedEOF {
 			err = errshttp.NewError(http.StatusUnprocessableEntity,
-				"Could not reach version on specified url %s: file is too big %s", url, err)
+				"Could not reach version on specified url %s: file is too big (limit is %d bytes): %s", url, maxSize, err)
 			return
 		}
 		if err != nil {
@@ -739,28 +2675,14 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 		if hdr.Typeflag != tar.TypeReg {
 			continue
 		}
+		filesSize += hdr.Size
 
 		fullname := path.Join("/", hdr.Name)
 		basename := path.Base(fullname)
-		dirname := path.Dir(fullname)
-		if hasPrefix && dirname != "/" {
-			rootDirname := path.Join("/", strings.SplitN(dirname, "/", 3)[1])
-			if tarPrefix == "" {
-				tarPrefix = rootDirname
-			} else if tarPrefix != rootDirname {
-				hasPrefix = false
-			}
-		} else {
-			hasPrefix = false
-		}
+		filenames = append(filenames, fullname)
 
-		if appType == "" &&
-			(basename == "manifest.webapp" || basename == "manifest.konnector") {
-			if basename == "manifest.webapp" {
-				appType = "webapp"
-			} else if basename == "manifest.konnector" {
-				appType = "konnector"
-			}
+		if stringInArray(basename, ManifestFilenames) && isPreferredManifest(fullname, manifestPath) {
+			manifestPath = fullname
 			manifestContent, err = ioutil.ReadAll(tr)
 			if err != nil {
 				err = errshttp.NewError(http.StatusUnprocessableEntity,
@@ -789,9 +2711,7 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 		}
 	}
 
-	if !hasPrefix {
-		tarPrefix = ""
-	}
+	tarPrefix = findTarPrefix(filenames)
 
 	if len(manifestContent) == 0 {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
@@ -805,6 +2725,9 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 			"Content of the manifest is not JSON valid: %s", err)
 		return
 	}
+	if appType, err = manifestAppType(path.Base(manifestPath), manifest); err != nil {
+		return
+	}
 
 	var parsedManifest Manifest
 	if err = json.Unmarshal(manifestContent, &parsedManifest); err != nil {
@@ -846,12 +2769,70 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 			}
 		}
 	}
+	if declared := parsedManifest.UncompressedSize; declared > 0 {
+		diff := math.Abs(float64(filesSize-declared)) / float64(declared)
+		if diff > ManifestSizeThreshold {
+			if ManifestSizeStrict {
+				errm = multierror.Append(errm,
+					fmt.Errorf("%q field does not match (%d != %d)",
+						"uncompressed_size", declared, filesSize))
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"nspace":        "registry",
+					"slug":          slug,
+					"version":       opts.Version,
+					"declared_size": declared,
+					"files_size":    filesSize,
+				}).Warn("Size declared in the manifest does not match the tarball content")
+			}
+		}
+	}
+	cozyVersion, cozyVersionField := parsedManifest.cozyVersionConstraint()
+	if cozyVersion != "" {
+		if _, errc := parseVersionConstraint(cozyVersion); errc != nil {
+			errm = multierror.Append(errm,
+				fmt.Errorf("%q field is invalid: %s", cozyVersionField, errc))
+		}
+	}
 	if errm != nil {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Content of the manifest does not match: %s", errm)
 		return
 	}
 
+	var overridden []string
+	if len(opts.ManifestOverrides) > 0 {
+		manifestContent, overridden, err = applyManifestOverrides(manifest, opts.ManifestOverrides)
+		if err != nil {
+			return
+		}
+		parsedManifest = Manifest{}
+		if err = json.Unmarshal(manifestContent, &parsedManifest); err != nil {
+			err = errshttp.NewError(http.StatusUnprocessableEntity,
+				"Overrides of the manifest are not valid: %s", err)
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"nspace":     "registry",
+			"slug":       slug,
+			"version":    opts.Version,
+			"overridden": overridden,
+		}).Info("Fields of the manifest overridden at publication")
+	}
+
+	for name, perm := range parsedManifest.Permissions {
+		if len(perm.ignoredVerbs) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"nspace":     "registry",
+				"slug":       slug,
+				"version":    opts.Version,
+				"permission": name,
+				"verbs":      perm.ignoredVerbs,
+			}).Warn("Unknown verbs ignored in the permissions of the manifest")
+		}
+	}
+
+	var screenshots []Screenshot
 	{
 		var iconPath string
 		if opts.Icon != "" {
@@ -865,19 +2846,20 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 
 		var screenshotPaths []string
 		if opts.Screenshots != nil {
-			screenshotPaths = opts.Screenshots
-			for i, shot := range screenshotPaths {
-				screenshotPaths[i] = path.Join("/", shot)
+			screenshots = sortScreenshots(opts.Screenshots)
+			for _, shot := range screenshots {
+				screenshotPaths = append(screenshotPaths, path.Join("/", shot.URL))
 			}
 		} else {
-			for _, shot := range parsedManifest.Screenshots {
-				screenshotPaths = append(screenshotPaths, path.Join("/", shot))
+			screenshots = sortScreenshots(parsedManifest.Screenshots)
+			for _, shot := range screenshots {
+				screenshotPaths = append(screenshotPaths, path.Join("/", shot.URL))
 			}
 			for _, locale := range parsedManifest.Locales {
 				for _, shot := range locale.Screenshots {
-					shot = path.Join("/", shot)
-					if !stringInArray(shot, screenshotPaths) {
-						screenshotPaths = append(screenshotPaths, shot)
+					shotPath := path.Join("/", shot.URL)
+					if !stringInArray(shotPath, screenshotPaths) {
+						screenshotPaths = append(screenshotPaths, shotPath)
 					}
 				}
 			}
@@ -885,7 +2867,7 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 
 		if len(screenshotPaths) > 0 || iconPath != "" {
 			buf.Seek(0, io.SeekStart)
-			tr, err = tarReader(buf, contentType)
+			tr, err = tarReader(buf)
 			if err != nil {
 				err = errshttp.NewError(http.StatusUnprocessableEntity,
 					"Could not reach version on specified url %s: %s", url, err)
@@ -901,7 +2883,7 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 				}
 				if err == io.ErrUnexpectedEOF {
 					err = errshttp.NewError(http.StatusUnprocessableEntity,
-						"Could not reach version on specified url %s: file is too big %s", url, err)
+						"Could not reach version on specified url %s: file is too big (limit is %d bytes): %s", url, maxSize, err)
 					return
 				}
 				if err != nil {
@@ -943,7 +2925,12 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 				} else {
 					panic("unreachable")
 				}
-				mime := magic.MIMEType(name, data)
+				mime, allowed := attachmentMIMEType(name, data)
+				if !allowed {
+					err = errshttp.NewError(http.StatusUnprocessableEntity,
+						"File %s has a type that is not allowed for an icon or a screenshot: %q", name, mime)
+					return
+				}
 				body := ioutil.NopCloser(bytes.NewReader(data))
 				attachments = append(attachments, &kivik.Attachment{
 					Content:     body,
@@ -970,14 +2957,135 @@ func downloadVersion(opts *VersionOptions) (ver *Version, attachments []*kivik.A
 	ver.Type = appType
 	ver.URL = opts.URL
 	ver.Sha256 = opts.Sha256
+	ver.Sha512 = opts.Sha512
 	ver.Editor = editorName
 	ver.Manifest = manifestContent
 	ver.Size = counter.Written()
 	ver.TarPrefix = tarPrefix
+	ver.ManifestPath = manifestPath
+	ver.Permissions = parsedManifest.Permissions
+	ver.CozyVersion = cozyVersion
+	if len(screenshots) > 0 {
+		ver.Screenshots = screenshots
+	}
+	ver.OverriddenFields = overridden
+	ver.Signature = opts.Signature
+	ver.SignatureKeyID = opts.SignatureKeyID
 	ver.CreatedAt = time.Now().UTC()
 	return
 }
 
+// isPreferredManifest returns true if the manifest at the given path should
+// be preferred to the current one, if any. The manifests are ordered by the
+// priority of their name in ManifestFilenames, and then by their depth in the
+// tarball, so that the manifest.json of a PWA or of a dependency is not taken
+// for the manifest of the application.
+func isPreferredManifest(name, current string) bool {
+	if current == "" {
+		return true
+	}
+	priority := manifestPriority(path.Base(name))
+	currentPriority := manifestPriority(path.Base(current))
+	if priority != currentPriority {
+		return priority < currentPriority
+	}
+	return strings.Count(name, "/") < strings.Count(current, "/")
+}
+
+// manifestPriority returns the index of the given name in ManifestFilenames.
+func manifestPriority(basename string) int {
+	for i, name := range ManifestFilenames {
+		if name == basename {
+			return i
+		}
+	}
+	return len(ManifestFilenames)
+}
+
+// manifestAppType returns the type of the application of the given manifest,
+// from its filename for manifest.webapp and manifest.konnector, or else from
+// its "type" field.
+func manifestAppType(filename string, manifest map[string]interface{}) (string, error) {
+	switch filename {
+	case "manifest.webapp":
+		return "webapp", nil
+	case "manifest.konnector":
+		return "konnector", nil
+	}
+	appType, _ := manifest["type"].(string)
+	if !stringInArray(appType, validAppTypes) {
+		return "", errshttp.NewError(http.StatusUnprocessableEntity,
+			"Content of the manifest does not match: %q field of %s must be one of these: %s",
+			"type", filename, strings.Join(validAppTypes, ", "))
+	}
+	return appType, nil
+}
+
+// checkManifestOverrides returns an error naming the first field of the given
+// overrides that can not be overridden.
+func checkManifestOverrides(overrides map[string]interface{}) error {
+	fields := make([]string, 0, len(overrides))
+	for field := range overrides {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if !stringInArray(field, ManifestOverridableFields) {
+			return fmt.Errorf("field %q can not be overridden", field)
+		}
+	}
+	return nil
+}
+
+// applyManifestOverrides merges the overrides over the given manifest, and
+// returns its new content with the sorted list of the overridden fields.
+func applyManifestOverrides(manifest, overrides map[string]interface{}) ([]byte, []string, error) {
+	if err := checkManifestOverrides(overrides); err != nil {
+		return nil, nil, errshttp.NewError(http.StatusBadRequest,
+			"Overrides of the manifest are not valid: %s", err)
+	}
+	fields := make([]string, 0, len(overrides))
+	for field, value := range overrides {
+		manifest[field] = value
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, fields, nil
+}
+
+// findTarPrefix returns the longest directory shared by all the given files
+// of a tarball, or the empty string if there is none. The files added by some
+// archivers, like __MACOSX/ or the dotfiles at the root (.DS_Store), are
+// ignored.
+func findTarPrefix(filenames []string) string {
+	var prefix string
+	found := false
+	for _, name := range filenames {
+		dirname := path.Dir(name)
+		if dirname == "/" && strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if dirname == "/__MACOSX" || strings.HasPrefix(dirname, "/__MACOSX/") {
+			continue
+		}
+		if !found {
+			prefix, found = dirname, true
+			continue
+		}
+		for prefix != "/" && prefix != dirname && !strings.HasPrefix(dirname, prefix+"/") {
+			prefix = path.Dir(prefix)
+		}
+	}
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
 func VersionMatch(ver1, ver2 string) bool {
 	v1 := SplitVersion(ver1)
 	v2 := SplitVersion(ver2)
@@ -991,6 +3099,9 @@ func GetVersionChannel(version string) Channel {
 	if strings.Contains(version, betaSuffix) {
 		return Beta
 	}
+	if strings.Contains(version, patchSuffix) {
+		return Patch
+	}
 	return Stable
 }
 
@@ -1000,6 +3111,8 @@ func SplitVersion(version string) (v [3]string) {
 		version = version[:strings.Index(version, betaSuffix)]
 	case Dev:
 		version = version[:strings.Index(version, devSuffix)]
+	case Patch:
+		version = version[:strings.Index(version, patchSuffix)]
 	}
 	s := strings.SplitN(version, ".", 3)
 	if len(s) == 3 {
@@ -1010,16 +3123,61 @@ func SplitVersion(version string) (v [3]string) {
 	return
 }
 
+// VersionLess returns true if ver1 has a lower precedence than ver2. Versions
+// are first compared on their numeric "major.minor.patch" part. For the same
+// numbers, a stable version has precedence over a patch one, a patch version
+// over a beta one, and a beta version over a dev one. Patch and beta counters
+// are compared numerically, and dev hashes lexically.
+func VersionLess(ver1, ver2 string) bool {
+	v1 := SplitVersion(ver1)
+	v2 := SplitVersion(ver2)
+	for i := 0; i < 3; i++ {
+		if v1[i] != v2[i] {
+			return versionNumberLess(v1[i], v2[i])
+		}
+	}
+
+	c1 := GetVersionChannel(ver1)
+	c2 := GetVersionChannel(ver2)
+	if c1 != c2 {
+		return c1 > c2
+	}
+
+	p1 := versionPrerelease(ver1)
+	p2 := versionPrerelease(ver2)
+	if c1 == Patch || c1 == Beta {
+		return versionNumberLess(p1, p2)
+	}
+	return p1 < p2
+}
+
+// versionPrerelease returns the part of the version following the dev, beta
+// or patch suffix, or an empty string for a stable version.
+func versionPrerelease(version string) string {
+	switch GetVersionChannel(version) {
+	case Patch:
+		return version[strings.Index(version, patchSuffix)+len(patchSuffix):]
+	case Beta:
+		return version[strings.Index(version, betaSuffix)+len(betaSuffix):]
+	case Dev:
+		return version[strings.Index(version, devSuffix)+len(devSuffix):]
+	}
+	return ""
+}
+
+func versionNumberLess(a, b string) bool {
+	na, erra := strconv.Atoi(a)
+	nb, errb := strconv.Atoi(b)
+	if erra != nil || errb != nil {
+		return a < b
+	}
+	return na < nb
+}
+
 func calculateAppLabel(app *App, ver *Version) Label {
 	hasRemoteDoctypes := false
 	if ver != nil {
-		var man struct {
-			Permissions map[string]struct {
-				Remote bool `json:"remote"`
-			} `json:"permissions"`
-		}
-		err := json.Unmarshal(ver.Manifest, &man)
-		if err == nil {
+		if man, err := ver.ParsedManifest(); err == nil {
 			for _, p := range man.Permissions {
 				if p.Remote {
 					hasRemoteDoctypes = true
@@ -1074,6 +3232,8 @@ func StrToChannel(channel string) (Channel, error) {
 	switch channel {
 	case "stable":
 		return Stable, nil
+	case "patch":
+		return Patch, nil
 	case "beta":
 		return Beta, nil
 	case "dev":
@@ -1087,6 +3247,8 @@ func channelToStr(channel Channel) string {
 	switch channel {
 	case Stable:
 		return "stable"
+	case Patch:
+		return "patch"
 	case Beta:
 		return "beta"
 	case Dev:
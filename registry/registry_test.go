@@ -0,0 +1,2500 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/lru"
+	"github.com/cozy/cozy-apps-registry/magic"
+	"github.com/go-kivik/kivik"
+)
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		v1   string
+		v2   string
+		less bool
+	}{
+		{"1.2.0", "1.2.1", true},
+		{"1.2.1", "1.2.0", false},
+		{"1.2.0", "1.10.0", true},
+		{"1.2.0", "1.2.0", false},
+
+		// beta vs beta
+		{"1.2.0-beta.1", "1.2.0-beta.2", true},
+		{"1.2.0-beta.2", "1.2.0-beta.1", false},
+		{"1.2.0-beta.2", "1.2.0-beta.10", true},
+		{"1.2.0-beta.1", "1.2.0-beta.1", false},
+		{"1.1.0-beta.9", "1.2.0-beta.1", true},
+
+		// beta vs stable
+		{"1.2.0-beta.1", "1.2.0", true},
+		{"1.2.0", "1.2.0-beta.1", false},
+		{"1.1.0", "1.2.0-beta.1", true},
+		{"1.2.0-beta.1", "1.1.0", false},
+
+		// patch vs others
+		{"1.2.0-patch.1", "1.2.0-patch.2", true},
+		{"1.2.0-patch.1", "1.2.0", true},
+		{"1.2.0", "1.2.0-patch.1", false},
+		{"1.2.0-beta.3", "1.2.0-patch.1", true},
+		{"1.2.0-patch.1", "1.2.0-beta.3", false},
+
+		// dev vs dev
+		{"1.2.0-dev.abc", "1.2.0-dev.abd", true},
+		{"1.2.0-dev.abd", "1.2.0-dev.abc", false},
+		{"1.2.0-dev.abc", "1.2.0-dev.abc", false},
+		{"1.1.0-dev.fff", "1.2.0-dev.000", true},
+
+		// dev vs others
+		{"1.2.0-dev.abc", "1.2.0-beta.1", true},
+		{"1.2.0-beta.1", "1.2.0-dev.abc", false},
+		{"1.2.0-dev.abc", "1.2.0", true},
+		{"1.2.0", "1.2.0-dev.abc", false},
+	}
+
+	for _, test := range tests {
+		if got := VersionLess(test.v1, test.v2); got != test.less {
+			t.Errorf("VersionLess(%q, %q) = %t, expected %t",
+				test.v1, test.v2, got, test.less)
+		}
+	}
+}
+
+func TestVersionSortOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+	}{
+		{"stable", []string{"0.9.9", "1.0.0", "1.0.10", "1.2.0", "1.10.0", "2.0.0"}},
+		{"prereleases", []string{
+			"1.0.0",
+			"1.1.0-dev.0a1",
+			"1.1.0-dev.b2c",
+			"1.1.0-beta.2",
+			"1.1.0-beta.10",
+			"1.1.0-patch.1",
+			"1.1.0-patch.9",
+			"1.1.0-patch.10",
+			"1.1.0",
+			"1.1.1-dev.000",
+			"1.1.1-beta.1",
+			"1.1.1",
+		}},
+	}
+
+	for _, test := range tests {
+		for i := 1; i < len(test.versions); i++ {
+			if !VersionLess(test.versions[i-1], test.versions[i]) {
+				t.Errorf("%s: expected %q before %q", test.name, test.versions[i-1], test.versions[i])
+			}
+		}
+		sorted := make([]string, len(test.versions))
+		for i, v := range test.versions {
+			sorted[len(sorted)-1-i] = v
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return VersionLess(sorted[i], sorted[j])
+		})
+		if !reflect.DeepEqual(sorted, test.versions) {
+			t.Errorf("%s: unexpected sort order %v", test.name, sorted)
+		}
+	}
+}
+
+func TestSearchRegexp(t *testing.T) {
+	tests := []struct {
+		search string
+		value  string
+		match  bool
+	}{
+		{"ank", "bank", true},
+		{"ank", "my-bank-app", true},
+		{"ANK", "My-Bank-App", true},
+		{"bank", "ban", false},
+		{"a.c", "abc", false},
+		{"a.c", "xa.cx", true},
+	}
+
+	for _, test := range tests {
+		re := regexp.MustCompile(searchRegexp(test.search))
+		if got := re.MatchString(test.value); got != test.match {
+			t.Errorf("search %q on %q = %t, expected %t",
+				test.search, test.value, got, test.match)
+		}
+	}
+}
+
+func TestSearchSelectorWithFiltersAndCursor(t *testing.T) {
+	defer func(locales []string) { SearchLocales = locales }(SearchLocales)
+	SearchLocales = []string{"de"}
+
+	opts := &AppsListOptions{
+		Filters: map[string]string{"type": "webapp", "tags": "bank,money"},
+		Search:  "ban",
+	}
+	cursor := &Cursor{Sort: "slug", Slug: "bank"}
+	raw := "{" + appsListSelector("slug", filtersSelector(opts), opts) + "," + cursorSelector(cursor, "asc") + "}"
+
+	var selector map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &selector); err != nil {
+		t.Fatalf("invalid selector %s: %s", raw, err)
+	}
+	for _, key := range []string{"slug", "type", "tags", "$or", "$nor", "$and"} {
+		if _, ok := selector[key]; !ok {
+			t.Errorf("expected %q in the selector %s", key, raw)
+		}
+	}
+
+	var search []map[string]map[string]string
+	if err := json.Unmarshal(selector["$or"], &search); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, cond := range search {
+		for field, op := range cond {
+			fields = append(fields, field)
+			if op["$regex"] != searchRegexp("ban") {
+				t.Errorf("unexpected condition on %s: %v", field, op)
+			}
+		}
+	}
+	if strings.Join(fields, ",") != "slug,name.de" {
+		t.Errorf("unexpected searched fields %v", fields)
+	}
+	if string(selector["$and"]) != `[{"slug": {"$gt": "bank"}}]` {
+		t.Errorf("unexpected cursor selector %s", selector["$and"])
+	}
+}
+
+func TestSearchCoveredByIndex(t *testing.T) {
+	tests := []struct {
+		sort    string
+		filters map[string]string
+		covered bool
+	}{
+		{"slug", nil, false},
+		{"category", nil, false},
+		{"category", map[string]string{"category": "finance"}, true},
+		{"category", map[string]string{"category": "finance,partners"}, false},
+		{"created_at", map[string]string{"category": "finance"}, false},
+		{"type", map[string]string{"type": "konnector", "tags": "bank"}, true},
+	}
+	for _, test := range tests {
+		opts := &AppsListOptions{Search: "ban", Filters: test.filters}
+		if got := searchCoveredByIndex(test.sort, opts); got != test.covered {
+			t.Errorf("sort %q with filters %v: expected covered to be %t", test.sort, test.filters, test.covered)
+		}
+	}
+}
+
+func TestLatestVersionSortSelector(t *testing.T) {
+	publishedAt := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	released := &App{Slug: "bank"}
+	setAppLatestVersion(released, &Version{Version: "1.0.0", PublishedAt: &publishedAt})
+	betaOnly := &App{Slug: "drive"}
+
+	opts := &AppsListOptions{Sort: "-latest_version_created_at"}
+	cursor := appCursor(released, "latest_version_created_at")
+	raw := "{" + appsListSelector("latest_version_created_at", filtersSelector(opts), opts) + "," + cursorSelector(cursor, "desc") + "}"
+	var selector map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &selector); err != nil {
+		t.Fatalf("invalid selector %s: %s", raw, err)
+	}
+	if string(selector["latest_version_created_at"]) != `{"$gt": null}` {
+		t.Fatalf("expected the selector to require the sorted field, got %s", raw)
+	}
+	if !strings.Contains(string(selector["$and"]), `"2019-03-01T12:00:00Z"`) {
+		t.Errorf("expected the cursor on the date of the latest version, got %s", selector["$and"])
+	}
+
+	// The applications without a stable version do not have the field, and
+	// are not matched by the selector: they are left out of this sort.
+	for _, app := range []*App{released, betaOnly} {
+		doc, err := json.Marshal(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(doc, &fields); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := fields["latest_version_created_at"]
+		if expected := app == released; ok != expected {
+			t.Errorf("%s: expected the sorted field to be present: %t, got %s", app.Slug, expected, doc)
+		}
+	}
+}
+
+func TestPaginateForwardBackward(t *testing.T) {
+	var all []*App
+	for _, slug := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		all = append(all, &App{Slug: slug})
+	}
+
+	fetch := func(skip, limit int, reverse bool) []*App {
+		list := make([]*App, len(all))
+		copy(list, all)
+		if reverse {
+			for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+				list[i], list[j] = list[j], list[i]
+			}
+		}
+		if skip > len(list) {
+			skip = len(list)
+		}
+		end := skip + limit
+		if end > len(list) {
+			end = len(list)
+		}
+		return list[skip:end]
+	}
+
+	slugs := func(apps []*App) (s string) {
+		for _, app := range apps {
+			s += app.Slug
+		}
+		return
+	}
+
+	limit := 3
+
+	var forward []string
+	var starts []int
+	cursor := 0
+	for cursor >= 0 {
+		starts = append(starts, cursor)
+		var page []*App
+		page, cursor = paginate(fetch(cursor, limit+1, false), limit, cursor, false)
+		forward = append(forward, slugs(page))
+	}
+	if len(forward) != 3 || forward[0] != "abc" || forward[1] != "def" || forward[2] != "g" {
+		t.Fatalf("unexpected forward pages: %v", forward)
+	}
+
+	var backward []string
+	cursor = starts[len(starts)-1]
+	for cursor >= 0 {
+		var page []*App
+		page, cursor = paginate(fetch(reverseSkip(cursor, len(all)), limit+1, true), limit, cursor, true)
+		backward = append(backward, slugs(page))
+	}
+	if len(backward) != 2 || backward[0] != "def" || backward[1] != "abc" {
+		t.Fatalf("unexpected backward pages: %v", backward)
+	}
+}
+
+func TestCreateVersionTypeMismatch(t *testing.T) {
+	app := &App{Slug: "bank", Type: "konnector", Editor: "cozy"}
+	ver := &Version{Slug: "bank", Type: "webapp", Editor: "cozy", Version: "1.0.0"}
+	if err := CreateReleaseVersion(&Space{}, ver, nil, app, false); err != ErrVersionTypeMismatch {
+		t.Fatalf("expected ErrVersionTypeMismatch, got %v", err)
+	}
+	if err := CreatePendingVersion(&Space{}, ver, nil, app); err != ErrVersionTypeMismatch {
+		t.Fatalf("expected ErrVersionTypeMismatch, got %v", err)
+	}
+}
+
+func TestCreateVersionManifestMismatch(t *testing.T) {
+	app := &App{Slug: "bank", Type: "konnector", Editor: "cozy"}
+
+	ver := &Version{Slug: "other", Type: "konnector", Editor: "cozy", Version: "1.0.0"}
+	if err := CreateReleaseVersion(&Space{}, ver, nil, app, false); err != ErrVersionSlugMismatch {
+		t.Fatalf("expected ErrVersionSlugMismatch, got %v", err)
+	}
+
+	ver = &Version{Slug: "bank", Type: "konnector", Editor: "someone", Version: "1.0.0"}
+	if err := CreateReleaseVersion(&Space{}, ver, nil, app, false); err != ErrVersionEditorMismatch {
+		t.Fatalf("expected ErrVersionEditorMismatch, got %v", err)
+	}
+}
+
+func TestTarReaderDetectsGzip(t *testing.T) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	content := []byte(`{"slug": "bank"}`)
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.konnector", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write(tarball.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{tarball.Bytes(), gzipped.Bytes()} {
+		tr, err := tarReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "manifest.konnector" {
+			t.Errorf("unexpected entry %q", hdr.Name)
+		}
+	}
+}
+
+func TestFindTarPrefix(t *testing.T) {
+	tests := []struct {
+		files  []string
+		prefix string
+	}{
+		{[]string{"/manifest.webapp", "/index.html"}, ""},
+		{[]string{"/app/manifest.webapp", "/app/index.html"}, "/app"},
+		{[]string{"/app/manifest.webapp", "/other/index.html"}, ""},
+		{[]string{"/app/build/manifest.webapp", "/app/build/js/app.js"}, "/app/build"},
+		{[]string{"/app/build/js/app.js", "/app/build/manifest.webapp"}, "/app/build"},
+		{[]string{"/app/build/manifest.webapp", "/app/src/index.js"}, "/app"},
+		{[]string{"/app/manifest.webapp", "/app-v2/index.html"}, ""},
+		{[]string{
+			"/.DS_Store",
+			"/app/manifest.webapp",
+			"/app/index.html",
+			"/__MACOSX/._app",
+			"/__MACOSX/app/._index.html",
+		}, "/app"},
+		{[]string{"/.DS_Store", "/manifest.webapp"}, ""},
+	}
+
+	for _, test := range tests {
+		if got := findTarPrefix(test.files); got != test.prefix {
+			t.Errorf("findTarPrefix(%v) = %q, expected %q", test.files, got, test.prefix)
+		}
+	}
+}
+
+func TestValidateTarballMacOSArchive(t *testing.T) {
+	manifest := `{"slug": "bank", "editor": "cozy", "version": "1.0.0", "icon": "icon.svg"}`
+	files := []struct {
+		name    string
+		content string
+	}{
+		{".DS_Store", "\x00\x00\x00\x01Bud1"},
+		{"__MACOSX/._bank", "\x00\x05\x16\x07"},
+		{"bank/manifest.webapp", manifest},
+		{"bank/icon.svg", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`},
+		{"__MACOSX/bank/._icon.svg", "\x00\x05\x16\x07"},
+	}
+
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &VersionOptions{Version: "1.0.0", URL: "http://example.org/bank.tar"}
+	ver, attachments, err := validateTarball(bytes.NewReader(tarball.Bytes()), opts, defaultMaxApplicationSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.TarPrefix != "/bank" {
+		t.Errorf("expected tar prefix /bank, got %q", ver.TarPrefix)
+	}
+	if len(attachments) != 1 || attachments[0].Filename != "icon" {
+		t.Errorf("expected the icon as attachment, got %v", attachments)
+	}
+}
+
+func TestManifestPermissions(t *testing.T) {
+	content := `{
+  "slug": "bank",
+  "permissions": {
+    "bank-operations": {
+      "type": "io.cozy.bank.operations",
+      "description": "Required to display the operations",
+      "verbs": ["GET", "PUT"]
+    },
+    "accounts": {
+      "type": "io.cozy.accounts",
+      "description": {"en": "Required to get the account", "fr": "Pour le compte"},
+      "verbs": "GET"
+    },
+    "files": {
+      "type": "io.cozy.files"
+    },
+    "contacts": {
+      "type": "io.cozy.contacts",
+      "verbs": ["GET", "GTE", 42, "post"]
+    },
+    "settings": {
+      "type": "io.cozy.settings",
+      "verbs": {"GET": true}
+    }
+  }
+}`
+	var manifest Manifest
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	perms := manifest.Permissions
+	if len(perms) != 5 {
+		t.Fatalf("expected 5 permissions, got %d", len(perms))
+	}
+	if p := perms["bank-operations"]; p.Type != "io.cozy.bank.operations" ||
+		p.Description != "Required to display the operations" ||
+		len(p.Verbs) != 2 || p.Verbs[1] != "PUT" {
+		t.Errorf("unexpected permission %+v", p)
+	}
+	if p := perms["accounts"]; p.Type != "io.cozy.accounts" ||
+		p.Description != "" || len(p.Verbs) != 1 || p.Verbs[0] != "GET" {
+		t.Errorf("unexpected permission %+v", p)
+	}
+	if p := perms["files"]; p.Type != "io.cozy.files" || p.Verbs != nil {
+		t.Errorf("unexpected permission %+v", p)
+	}
+	if p := perms["contacts"]; strings.Join(p.Verbs, ",") != "GET,post" ||
+		strings.Join(p.ignoredVerbs, ",") != "GTE,42" {
+		t.Errorf("expected the unknown verbs to be ignored, got %+v", p)
+	}
+	if p := perms["settings"]; p.Type != "io.cozy.settings" || p.Verbs != nil || len(p.ignoredVerbs) != 1 {
+		t.Errorf("expected the invalid verbs to be ignored, got %+v", p)
+	}
+}
+
+func TestLocalizedName(t *testing.T) {
+	app := &App{
+		AppName:        map[string]string{"en": "Bank", "fr": "Banque", "de": "Bank DE"},
+		AppDescription: map[string]string{"fr": "Une banque", "de": "Eine Bank"},
+	}
+	tests := []struct {
+		locale string
+		name   string
+		desc   string
+	}{
+		{"fr", "Banque", "Une banque"},
+		{"en", "Bank", "Eine Bank"},
+		{"es", "Bank", "Eine Bank"},
+		{"", "Bank", "Eine Bank"},
+	}
+	for _, test := range tests {
+		if got := app.LocalizedName(test.locale); got != test.name {
+			t.Errorf("LocalizedName(%q) = %q, expected %q", test.locale, got, test.name)
+		}
+		if got := app.LocalizedDescription(test.locale); got != test.desc {
+			t.Errorf("LocalizedDescription(%q) = %q, expected %q", test.locale, got, test.desc)
+		}
+	}
+
+	empty := &App{}
+	if got := empty.LocalizedName("fr"); got != "" {
+		t.Errorf("expected empty name, got %q", got)
+	}
+}
+
+func TestIsMaintenanceActive(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	tests := []struct {
+		activated bool
+		opts      *MaintenanceOptions
+		active    bool
+	}{
+		{false, nil, false},
+		{true, nil, true},
+		{true, &MaintenanceOptions{}, true},
+		{false, &MaintenanceOptions{Start: &before, End: &after}, false},
+		{true, &MaintenanceOptions{Start: &before, End: &after}, true},
+		{true, &MaintenanceOptions{Start: &after}, false},
+		{true, &MaintenanceOptions{End: &before}, false},
+		{true, &MaintenanceOptions{Start: &before}, true},
+		{true, &MaintenanceOptions{End: &now}, false},
+	}
+	for i, test := range tests {
+		app := &App{MaintenanceActivated: test.activated, MaintenanceOptions: test.opts}
+		if got := app.IsMaintenanceActive(now); got != test.active {
+			t.Errorf("test %d: expected %t, got %t", i, test.active, got)
+		}
+	}
+}
+
+func TestIsValidAppStoreURLs(t *testing.T) {
+	tests := []struct {
+		urls  map[string]string
+		valid bool
+	}{
+		{nil, true},
+		{map[string]string{"ios": "https://itunes.apple.com/app/cozy-drive/id1224102389"}, true},
+		{map[string]string{"android": "https://play.google.com/store/apps/details?id=io.cozy.drive.mobile"}, true},
+		{map[string]string{"windows": "https://www.microsoft.com/store/apps/9nblggh4nns1"}, false},
+		{map[string]string{"ios": "not an url"}, false},
+		{map[string]string{"android": ""}, false},
+	}
+	for _, test := range tests {
+		opts := &AppOptions{Slug: "drive", Editor: "cozy", Type: "webapp", AppStoreURLs: test.urls}
+		err := IsValidApp(opts)
+		if test.valid && err != nil {
+			t.Errorf("expected %v to be valid, got %s", test.urls, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected %v to be invalid", test.urls)
+		}
+	}
+}
+
+func TestSetAppLatestVersion(t *testing.T) {
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	published := created.Add(24 * time.Hour)
+
+	app := &App{Slug: "bank"}
+	if !setAppLatestVersion(app, &Version{Version: "1.0.0", CreatedAt: created}) {
+		t.Fatal("expected the first version to be set")
+	}
+	if app.LatestStableVersion != "1.0.0" || !app.LatestStableCreatedAt.Equal(created) {
+		t.Fatalf("unexpected latest version %s at %v", app.LatestStableVersion, app.LatestStableCreatedAt)
+	}
+
+	if setAppLatestVersion(app, &Version{Version: "0.9.0", CreatedAt: published}) {
+		t.Fatal("expected an older version to be ignored")
+	}
+
+	if !setAppLatestVersion(app, &Version{Version: "1.1.0", CreatedAt: created, PublishedAt: &published}) {
+		t.Fatal("expected a newer version to be set")
+	}
+	if app.LatestStableVersion != "1.1.0" || !app.LatestStableCreatedAt.Equal(published) {
+		t.Fatalf("unexpected latest version %s at %v", app.LatestStableVersion, app.LatestStableCreatedAt)
+	}
+
+	// After a deletion, the latest version can go back to an older one.
+	if resetAppLatestVersion(app, &Version{Version: "1.1.0", CreatedAt: created, PublishedAt: &published}) {
+		t.Fatal("expected the same version to be ignored")
+	}
+	if !resetAppLatestVersion(app, &Version{Version: "1.0.0", CreatedAt: created}) {
+		t.Fatal("expected an older version to be set")
+	}
+	if app.LatestStableVersion != "1.0.0" || !app.LatestStableCreatedAt.Equal(created) {
+		t.Fatalf("unexpected latest version %s at %v", app.LatestStableVersion, app.LatestStableCreatedAt)
+	}
+	if !resetAppLatestVersion(app, nil) || app.LatestStableVersion != "" || app.LatestStableCreatedAt != nil {
+		t.Fatalf("expected the latest version to be removed, got %s", app.LatestStableVersion)
+	}
+	if resetAppLatestVersion(app, nil) {
+		t.Fatal("expected an application without version to be unchanged")
+	}
+}
+
+func TestMaintenanceAppsQueryUsesIndex(t *testing.T) {
+	var query struct {
+		UseIndex string                   `json:"use_index"`
+		Selector map[string]interface{}   `json:"selector"`
+		Sort     []map[string]interface{} `json:"sort"`
+	}
+	if err := json.Unmarshal([]byte(maintenanceAppsQuery), &query); err != nil {
+		t.Fatal(err)
+	}
+
+	index, ok := appsIndexes[strings.TrimPrefix(query.UseIndex, "apps-index-")]
+	if !ok {
+		t.Fatalf("index %q is not declared in appsIndexes", query.UseIndex)
+	}
+	fields := index["fields"].([]string)
+
+	// The selector and the sort must only use the fields of the index, in
+	// the same order, for CouchDB to use it instead of a full scan.
+	for field := range query.Selector {
+		if field != fields[0] {
+			t.Errorf("selector field %q is not the first field of the index", field)
+		}
+	}
+	if len(query.Sort) > len(fields) {
+		t.Fatalf("sort has more fields than the index")
+	}
+	for i, sort := range query.Sort {
+		if _, ok := sort[fields[i]]; !ok {
+			t.Errorf("sort field %d should be %q", i, fields[i])
+		}
+	}
+}
+
+func TestVersViewMap(t *testing.T) {
+	for name, v := range versionsViews {
+		if v.Value != "" {
+			continue
+		}
+		code := versViewMap(v, "bank")
+		if strings.Contains(code, "%!") {
+			t.Errorf("view %s: bad format: %s", name, code)
+		}
+		if !strings.Contains(code, "if (doc.slug != \"bank\") {\n    return\n  }") ||
+			!strings.Contains(code, "emit(key, doc.version);") {
+			t.Errorf("view %s: unexpected code for an app: %s", name, code)
+		}
+
+		shared := versViewMap(v, "")
+		if strings.Contains(shared, "%!") || strings.Contains(shared, "bank") {
+			t.Errorf("view %s: bad shared code: %s", name, shared)
+		}
+		if !strings.Contains(shared, "emit([doc.slug].concat(key), doc.version);") {
+			t.Errorf("view %s: unexpected shared code: %s", name, shared)
+		}
+	}
+
+	code := versViewMap(versionsViews["stable-date"], "bank")
+	if !strings.Contains(code, "emit(key, doc.created_at);") {
+		t.Errorf("unexpected code for the date view: %s", code)
+	}
+}
+
+func TestFindVersionsForChannelRange(t *testing.T) {
+	_, err := FindVersionsForChannelRange(context.Background(), NewSpace(""), "bank", Channel(42), "1.0.0", "", true)
+	if err != ErrChannelInvalid {
+		t.Fatalf("expected ErrChannelInvalid, got %v", err)
+	}
+
+	tests := []struct {
+		channel   Channel
+		min, max  string
+		inclusive bool
+		start     string
+		end       string
+		endIncl   bool
+	}{
+		{Stable, "1.0.0", "2.0.0", true, `[1,0,0]`, `[2,0,0,{}]`, true},
+		{Stable, "1.0.0", "2.0.0", false, `[1,0,0,{}]`, `[2,0,0]`, false},
+		{Stable, "", "2.0.0", true, ``, `[2,0,0,{}]`, true},
+		// A beta bound is not in the stable view: it is placed before the
+		// stable version with the same number, which is excluded from the
+		// start and included at the end.
+		{Stable, "1.0.0-beta.1", "2.0.0-beta.1", true, `[1,0,0]`, `[2,0,0]`, false},
+		{Beta, "1.0.0-beta.1", "1.0.0-beta.3", false, `[1,0,0,0,1,{}]`, `[1,0,0,0,3]`, false},
+		// The dev versions with the same number are grouped, as their keys
+		// only differ by their creation date.
+		{Dev, "1.0.0-dev.abc", "1.0.1-dev.def", true, `[1,0,0,0]`, `[1,0,1,0,{}]`, true},
+		{Dev, "1.0.0-dev.abc", "1.0.1-dev.def", false, `[1,0,0,0,{}]`, `[1,0,1,0]`, false},
+	}
+	for _, test := range tests {
+		opts := channelRangeOptions(test.channel, test.min, test.max, test.inclusive)
+		var start, end []byte
+		if key, ok := opts["startkey"]; ok {
+			start, _ = json.Marshal(key)
+		}
+		if key, ok := opts["endkey"]; ok {
+			end, _ = json.Marshal(key)
+		}
+		_, exclusiveEnd := opts["inclusive_end"]
+		if string(start) != test.start || string(end) != test.end || exclusiveEnd == test.endIncl {
+			t.Errorf("%s %s..%s (inclusive=%t): got %s..%s (inclusive_end=%t)",
+				channelToStr(test.channel), test.min, test.max, test.inclusive, start, end, !exclusiveEnd)
+		}
+	}
+}
+
+func TestValidateTarballTooBig(t *testing.T) {
+	c := NewSpace("")
+	c.MaxAppSize = 16
+	opts := &VersionOptions{Version: "1.0.0", URL: "http://example.org/bank.tar"}
+	_, err := ValidateTarball(c, bytes.NewReader(make([]byte, 17)), opts)
+	if err == nil || !strings.Contains(err.Error(), "file is too big") {
+		t.Fatalf("expected a size error, got %v", err)
+	}
+}
+
+func TestSharedViewOptions(t *testing.T) {
+	opts := sharedViewOptions("bank", map[string]interface{}{
+		"limit":      1,
+		"descending": true,
+	})
+	start, _ := json.Marshal(opts["startkey"])
+	end, _ := json.Marshal(opts["endkey"])
+	if string(start) != `["bank",{}]` || string(end) != `["bank"]` || opts["limit"] != 1 {
+		t.Errorf("unexpected descending options %s %s %v", start, end, opts)
+	}
+
+	opts = sharedViewOptions("bank", map[string]interface{}{
+		"startkey": []interface{}{1, 2, 0},
+	})
+	start, _ = json.Marshal(opts["startkey"])
+	end, _ = json.Marshal(opts["endkey"])
+	if string(start) != `["bank",1,2,0]` || string(end) != `["bank",{}]` {
+		t.Errorf("unexpected range options %s %s", start, end)
+	}
+}
+
+func TestPartitionVersions(t *testing.T) {
+	all := []string{"1.0.0", "1.0.1-beta.1", "1.0.1-dev.abc", "1.0.1"}
+	versions := partitionVersions(Dev, all)
+
+	check := func(name string, got []string, expected ...string) {
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+	}
+	check("stable", versions.Stable, "1.0.0", "1.0.1")
+	check("patch", versions.Patch, "1.0.0", "1.0.1")
+	check("beta", versions.Beta, "1.0.0", "1.0.1-beta.1", "1.0.1")
+	check("dev", versions.Dev, all...)
+
+	versions = partitionVersions(Beta, []string{"1.0.0", "1.0.1-beta.1"})
+	check("beta stable", versions.Stable, "1.0.0")
+	check("beta beta", versions.Beta, "1.0.0", "1.0.1-beta.1")
+	check("beta dev", versions.Dev)
+}
+
+func TestFindAllAppVersions(t *testing.T) {
+	tests := []struct {
+		versions []string
+		expected AppVersions
+	}{
+		{nil, AppVersions{}},
+		{
+			[]string{"1.0.0", "1.0.1-patch.1", "1.0.1-beta.1", "1.0.1-dev.abc", "1.0.1"},
+			AppVersions{
+				Stable: []string{"1.0.0", "1.0.1"},
+				Patch:  []string{"1.0.1-patch.1"},
+				Beta:   []string{"1.0.1-beta.1"},
+				Dev:    []string{"1.0.1-dev.abc"},
+			},
+		},
+		{
+			[]string{"2.0.0-dev.1", "2.0.0-dev.2"},
+			AppVersions{Dev: []string{"2.0.0-dev.1", "2.0.0-dev.2"}},
+		},
+	}
+	for _, test := range tests {
+		if got := splitVersionsByChannel(test.versions); !reflect.DeepEqual(*got, test.expected) {
+			t.Errorf("splitVersionsByChannel(%v) = %+v, expected %+v", test.versions, *got, test.expected)
+		}
+	}
+
+	// The lists are served from the cache, filled without database here, and
+	// removed from it with the lists of the channels.
+	InitCaches(CacheConfig{})
+	data, _ := json.Marshal(splitVersionsByChannel(tests[1].versions))
+	cacheVersionsList.Add(lru.Key("bank/all"), lru.Value(data))
+	versions, err := FindAllAppVersions(context.Background(), NewSpace(""), "bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*versions, tests[1].expected) {
+		t.Errorf("unexpected cached versions %+v", *versions)
+	}
+	InvalidateVersionsCache("bank")
+	if _, ok := cacheVersionsList.Get(lru.Key("bank/all")); ok {
+		t.Error("expected the list of all the versions to be invalidated")
+	}
+}
+
+type fakeVersionRows struct {
+	versions []string
+	index    int
+	err      error
+}
+
+func (r *fakeVersionRows) Next() bool {
+	r.index++
+	return r.index <= len(r.versions)
+}
+
+func (r *fakeVersionRows) ScanValue(dest interface{}) error {
+	*dest.(*string) = r.versions[r.index-1]
+	return nil
+}
+
+func (r *fakeVersionRows) TotalRows() int64 {
+	return int64(len(r.versions))
+}
+
+func (r *fakeVersionRows) Err() error {
+	return r.err
+}
+
+func TestScanVersionsNoEmptyStrings(t *testing.T) {
+	rows := &fakeVersionRows{versions: []string{"1.0.0", "1.0.1-beta.1", "1.0.1"}}
+	all, err := scanVersions(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := partitionVersions(Dev, all)
+	for _, list := range [][]string{versions.Stable, versions.Patch, versions.Beta, versions.Dev} {
+		for _, v := range list {
+			if v == "" {
+				t.Fatalf("unexpected empty version in %v", versions)
+			}
+		}
+	}
+	if len(versions.Dev) != 3 {
+		t.Fatalf("expected 3 dev versions, got %v", versions.Dev)
+	}
+
+	interrupted := errors.New("stream interrupted")
+	rows = &fakeVersionRows{versions: []string{"1.0.0"}, err: interrupted}
+	if all, err = scanVersions(rows); err != interrupted || all != nil {
+		t.Fatalf("expected the error of the rows, got %v, %v", all, err)
+	}
+}
+
+func TestCheckCategory(t *testing.T) {
+	defer func() { ValidCategories = nil }()
+
+	ValidCategories = nil
+	if category, err := checkCategory("Whatever "); err != nil || category != "whatever" {
+		t.Fatalf("expected any category to be accepted, got %q, %v", category, err)
+	}
+
+	ValidCategories = []string{"finance", "productivity"}
+	if category, err := checkCategory(" Productivity"); err != nil || category != "productivity" {
+		t.Fatalf("expected a normalized valid category, got %q, %v", category, err)
+	}
+	if _, err := checkCategory("productivty"); err == nil {
+		t.Fatal("expected an unknown category to be rejected")
+	}
+	if category, err := checkCategory(""); err != nil || category != "" {
+		t.Fatalf("expected an empty category to be accepted, got %q, %v", category, err)
+	}
+
+	ValidCategories = []string{"Finance", " Productivity "}
+	if category, err := checkCategory("finance"); err != nil || category != "finance" {
+		t.Fatalf("expected the configured categories to be normalized, got %q, %v", category, err)
+	}
+
+	opts := &AppOptions{Slug: "bank", Editor: "cozy", Type: "webapp", Category: "Finance"}
+	if err := IsValidApp(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Category != "finance" {
+		t.Fatalf("expected the category to be normalized, got %q", opts.Category)
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	tags, err := checkTags([]string{" Banking ", "open-source", "2fa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "banking,open-source,2fa" {
+		t.Fatalf("unexpected normalized tags %v", tags)
+	}
+
+	for _, tag := range []string{"", "two words", "émoji", "-dash", "under_score"} {
+		if _, err := checkTags([]string{tag}); err == nil {
+			t.Errorf("expected tag %q to be rejected", tag)
+		}
+	}
+
+	tooMany := make([]string, MaxTags+1)
+	for i := range tooMany {
+		tooMany[i] = "tag"
+	}
+	if _, err := checkTags(tooMany); err == nil {
+		t.Fatal("expected too many tags to be rejected")
+	}
+}
+
+func TestVersionWithSha256DevSuffix(t *testing.T) {
+	version := "1.2.3-dev." + strings.Repeat("0123456789abcdef", 4)
+	if !validVersionReg.MatchString(version) {
+		t.Fatalf("expected %s to be a valid version", version)
+	}
+	if _, err := findVersion(ctx, "drive", version); err != ErrVersionNotFound {
+		t.Fatalf("expected %s to pass the validation, got %v", version, err)
+	}
+	if GetVersionChannel(version) != Dev {
+		t.Fatalf("expected %s to be in the dev channel", version)
+	}
+	if v := SplitVersion(version); v != [3]string{"1", "2", "3"} {
+		t.Fatalf("unexpected split version %v", v)
+	}
+
+	if validVersionReg.MatchString(version + "0") {
+		t.Fatal("expected a dev suffix longer than 64 characters to be rejected")
+	}
+}
+
+func TestIsAppUpdated(t *testing.T) {
+	old := &App{Slug: "bank", Type: "webapp", Editor: "cozy", UpdatedAt: time.Now().UTC()}
+	if !isAppUpdated(nil, old) {
+		t.Fatal("expected a new application to be an update")
+	}
+
+	same := *old
+	same.UpdatedAt = old.UpdatedAt.Add(time.Minute)
+	if isAppUpdated(old, &same) {
+		t.Fatal("expected the modification date alone not to be an update")
+	}
+
+	changed := same
+	changed.Category = "finance"
+	if !isAppUpdated(old, &changed) {
+		t.Fatal("expected a new category to be an update")
+	}
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	err := IsValidVersion(&VersionOptions{Version: "1.0", URL: "", Sha256: "abc"})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %#v", err)
+	}
+	if verr.Error() != "Invalid version: the following fields are missing or erroneous: version, url, sha256" {
+		t.Fatalf("unexpected message %q", verr.Error())
+	}
+	for _, field := range []string{"version", "url", "sha256"} {
+		if verr.Fields[field] == "" {
+			t.Errorf("expected a reason for the field %s", field)
+		}
+	}
+
+	err = IsValidApp(&AppOptions{Slug: "bank", Type: "webapp"})
+	verr, ok = err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %#v", err)
+	}
+	if _, ok := verr.Fields["editor"]; !ok || len(verr.Fields) != 1 {
+		t.Fatalf("unexpected fields %v", verr.Fields)
+	}
+}
+
+func TestCheckDigests(t *testing.T) {
+	content := []byte("tarball content")
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	hex256 := hex.EncodeToString(sum256[:])
+	hex512 := hex.EncodeToString(sum512[:])
+	other512 := sha512.Sum512([]byte("other content"))
+
+	tests := []struct {
+		expected digests
+		ok       bool
+	}{
+		{digests{}, true},
+		{digests{sha256: hex256}, true},
+		{digests{sha512: hex512}, true},
+		{digests{sha512: strings.ToUpper(hex512)}, true},
+		{digests{sha256: hex256, sha512: hex512}, true},
+		{digests{sha512: hex.EncodeToString(other512[:])}, false},
+		{digests{sha256: hex256, sha512: hex.EncodeToString(other512[:])}, false},
+		{digests{sha512: "not an hexadecimal checksum"}, false},
+	}
+	for _, test := range tests {
+		computed, err := checkDigests(content, test.expected)
+		if (err == nil) != test.ok {
+			t.Errorf("checkDigests(%+v) = %v, expected ok=%t", test.expected, err, test.ok)
+		}
+		if computed.sha256 != hex256 || computed.sha512 != hex512 {
+			t.Errorf("unexpected computed digests %+v", computed)
+		}
+	}
+
+	for _, sha := range []string{"zz" + hex512[2:], hex512[2:], hex256} {
+		err := IsValidVersion(&VersionOptions{Version: "1.0.0", URL: "https://example.org/bank.tar.gz", Sha512: sha})
+		verr, ok := err.(*ValidationError)
+		if !ok || verr.Fields["sha512"] == "" {
+			t.Errorf("expected the sha512 %q to be rejected, got %v", sha, err)
+		}
+	}
+}
+
+func TestDevVersionsToPrune(t *testing.T) {
+	var versions []*Version
+	for i := 0; i < 10; i++ {
+		versions = append(versions, &Version{Version: fmt.Sprintf("1.0.%d-dev.%040x", i, i)})
+		if i%3 == 0 {
+			versions = append(versions, &Version{Version: fmt.Sprintf("1.0.%d-beta.1", i)})
+			versions = append(versions, &Version{Version: fmt.Sprintf("1.0.%d", i)})
+		}
+	}
+
+	pruned := devVersionsToPrune(versions, 3)
+	if len(pruned) != 7 {
+		t.Fatalf("expected 7 versions to be pruned, got %d", len(pruned))
+	}
+	for i, ver := range pruned {
+		if GetVersionChannel(ver.Version) != Dev {
+			t.Fatalf("unexpected pruned version %s", ver.Version)
+		}
+		if !strings.HasPrefix(ver.Version, fmt.Sprintf("1.0.%d-dev.", i)) {
+			t.Fatalf("expected the oldest versions to be pruned, got %s", ver.Version)
+		}
+	}
+
+	if pruned := devVersionsToPrune(versions, 20); len(pruned) != 0 {
+		t.Fatalf("expected no version to be pruned, got %d", len(pruned))
+	}
+}
+
+func TestMarkImportedVersion(t *testing.T) {
+	createdAt := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc, err := json.Marshal(&Version{Slug: "bank", Version: "1.0.0", CreatedAt: createdAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err = markImportedVersion(doc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ver *Version
+	if err = json.Unmarshal(doc, &ver); err != nil {
+		t.Fatal(err)
+	}
+	if !ver.CreatedAt.Equal(createdAt) {
+		t.Fatalf("expected the creation date to be kept, got %v", ver.CreatedAt)
+	}
+	if ver.PublishedAt == nil || !ver.PublishedAt.Equal(now) {
+		t.Fatalf("expected the publication date to be the import date, got %v", ver.PublishedAt)
+	}
+
+	later := now.Add(24 * time.Hour)
+	doc, err = markImportedVersion(doc, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver = nil
+	if err = json.Unmarshal(doc, &ver); err != nil {
+		t.Fatal(err)
+	}
+	if ver.PublishedAt == nil || !ver.PublishedAt.Equal(now) {
+		t.Fatalf("expected the existing publication date to be kept, got %v", ver.PublishedAt)
+	}
+}
+
+func TestDownloadClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	client := newDownloadClient(DownloadConfig{Timeout: 50 * time.Millisecond, AllowedHosts: []string{"127.0.0.1"}})
+	start := time.Now()
+	_, err := client.Get(ts.URL)
+	if err == nil {
+		t.Fatal("expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the configured timeout to be honored, took %s", elapsed)
+	}
+}
+
+func TestDownloadClientMaxRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/0" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		var n int
+		fmt.Sscanf(r.URL.Path, "/%d", &n)
+		http.Redirect(w, r, fmt.Sprintf("/%d", n-1), http.StatusFound)
+	}))
+	defer ts.Close()
+
+	maxRedirects := 2
+	client := newDownloadClient(DownloadConfig{MaxRedirects: &maxRedirects, AllowedHosts: []string{"127.0.0.1"}})
+	resp, err := client.Get(ts.URL + "/2")
+	if err != nil {
+		t.Fatalf("expected 2 redirects to be followed, got %s", err)
+	}
+	resp.Body.Close()
+	if _, err = client.Get(ts.URL + "/3"); err == nil {
+		t.Fatal("expected 3 redirects to be rejected")
+	}
+
+	noRedirects := 0
+	client = newDownloadClient(DownloadConfig{MaxRedirects: &noRedirects, AllowedHosts: []string{"127.0.0.1"}})
+	if _, err = client.Get(ts.URL + "/1"); err == nil {
+		t.Fatal("expected the redirects to be forbidden")
+	}
+	resp, err = client.Get(ts.URL + "/0")
+	if err != nil {
+		t.Fatalf("expected a request without redirect to succeed, got %s", err)
+	}
+	resp.Body.Close()
+
+	client = newDownloadClient(DownloadConfig{AllowedHosts: []string{"127.0.0.1"}})
+	resp, err = client.Get(ts.URL + "/10")
+	if err != nil {
+		t.Fatalf("expected the default of 10 redirects, got %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestDownloadClientRejectsInternalRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/target" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "http://"+r.Host+"/target", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	client := newDownloadClient(DownloadConfig{})
+	_, err := client.Get(ts.URL + "/redirect")
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1") {
+		t.Fatalf("expected the redirect to 127.0.0.1 to be rejected, got %v", err)
+	}
+
+	// The address is checked when dialing, whatever the host name used.
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	_, err = client.Get("http://localhost:" + port + "/target")
+	if err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Fatalf("expected the internal address of localhost to be rejected, got %v", err)
+	}
+
+	client = newDownloadClient(DownloadConfig{AllowedHosts: []string{"127.0.0.1"}})
+	resp, err := client.Get(ts.URL + "/redirect")
+	if err != nil {
+		t.Fatalf("expected the redirect to an allowed host to be followed, got %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestValidateDownloadURL(t *testing.T) {
+	defer func() { downloadConfig = DownloadConfig{} }()
+
+	downloadConfig = DownloadConfig{}
+	for _, rawurl := range []string{
+		"ftp://93.184.216.34/app.tar.gz",
+		"http://93.184.216.34/app.tar.gz",
+		"https://127.0.0.1/app.tar.gz",
+		"https://10.0.0.1/app.tar.gz",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]/app.tar.gz",
+		"https:///app.tar.gz",
+	} {
+		if err := validateDownloadURL(rawurl); err == nil {
+			t.Errorf("expected %s to be rejected", rawurl)
+		}
+	}
+	if err := validateDownloadURL("https://93.184.216.34/app.tar.gz"); err != nil {
+		t.Errorf("expected a public address to be accepted, got %s", err)
+	}
+
+	// The validation of the fields only checks the syntax of the URL: a host
+	// that can not be resolved is not a field error.
+	opts := &VersionOptions{Version: "1.0.0", URL: "https://registry.invalid/app.tar.gz", Sha256: strings.Repeat("a", 64)}
+	if err := IsValidVersion(opts); err != nil {
+		t.Errorf("expected the host not to be resolved, got %s", err)
+	}
+	opts.URL = "https://10.0.0.1/app.tar.gz"
+	if err := IsValidVersion(opts); err == nil {
+		t.Error("expected an internal address to be rejected")
+	}
+	if err := validateDownloadURL("https://registry.invalid/app.tar.gz"); err == nil {
+		t.Error("expected a host that can not be resolved to be rejected before downloading")
+	}
+
+	downloadConfig = DownloadConfig{AllowHTTP: true, AllowedHosts: []string{"10.0.0.1"}}
+	if err := validateDownloadURL("http://10.0.0.1/app.tar.gz"); err != nil {
+		t.Errorf("expected an allowed host to be accepted, got %s", err)
+	}
+	if err := validateDownloadURL("https://93.184.216.34/app.tar.gz"); err == nil {
+		t.Error("expected a host that is not allowed to be rejected")
+	}
+}
+
+func TestDownloadWithRetries(t *testing.T) {
+	defer InitDownloadClient(DownloadConfig{})
+	InitDownloadClient(DownloadConfig{
+		AllowHTTP:    true,
+		AllowedHosts: []string{"127.0.0.1"},
+		RetryDelay:   time.Millisecond,
+	})
+
+	content := []byte("tarball content")
+	sum := sha256.Sum256(content)
+	expected := digests{sha256: hex.EncodeToString(sum[:])}
+
+	failures := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			if failures < 2 {
+				failures++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(content)
+		default:
+			failures++
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	reader, _, err := downloadWithRetries(context.Background(), ts.URL+"/flaky", expected, 1024)
+	if err != nil {
+		t.Fatalf("expected the download to succeed after 2 failures, got %s", err)
+	}
+	if reader.Len() != len(content) {
+		t.Fatalf("unexpected content length %d", reader.Len())
+	}
+
+	failures = 0
+	if _, _, err = downloadWithRetries(context.Background(), ts.URL+"/missing", expected, 1024); err == nil {
+		t.Fatal("expected a missing tarball to fail")
+	}
+	if failures != 1 {
+		t.Fatalf("expected a 404 not to be retried, got %d requests", failures)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failures = 0
+	if _, _, err = downloadWithRetries(ctx, ts.URL+"/flaky", expected, 1024); err == nil {
+		t.Fatal("expected a canceled download to fail")
+	}
+}
+
+func TestDownloadResumable(t *testing.T) {
+	defer InitDownloadClient(DownloadConfig{})
+	InitDownloadClient(DownloadConfig{
+		AllowHTTP:    true,
+		AllowedHosts: []string{"127.0.0.1"},
+		RetryDelay:   time.Millisecond,
+		Resumable:    true,
+	})
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+	expected := digests{sha256: hex.EncodeToString(sum[:])}
+
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Send the first half of the tarball, and abort the connection
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "app.tar.gz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	reader, _, err := downloadWithRetries(context.Background(), ts.URL, expected, int64(len(content)))
+	if err != nil {
+		t.Fatalf("expected the download to be resumed, got %s", err)
+	}
+	if reader.Len() != len(content) {
+		t.Fatalf("unexpected content length %d", reader.Len())
+	}
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", len(content)/2) {
+		t.Fatalf("unexpected ranges %q", ranges)
+	}
+}
+
+func TestDownloadOversizedContentLength(t *testing.T) {
+	defer InitDownloadClient(DownloadConfig{})
+	InitDownloadClient(DownloadConfig{
+		AllowHTTP:    true,
+		AllowedHosts: []string{"127.0.0.1"},
+		Retries:      -1,
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.Write(make([]byte, 1024))
+	}))
+	defer ts.Close()
+
+	_, _, err := downloadWithRetries(context.Background(), ts.URL, digests{}, 1024)
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("expected the oversized tarball to be rejected, got %v", err)
+	}
+	herr, ok := err.(*errshttp.Error)
+	if !ok || herr.StatusCode() != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a 422 error, got %#v", err)
+	}
+}
+
+type publishObserverFunc func(c *Space, ver *Version)
+
+func (f publishObserverFunc) OnVersionPublished(c *Space, ver *Version) {
+	f(c, ver)
+}
+
+func TestNotifyVersionPublished(t *testing.T) {
+	defer func() { publishObservers = nil }()
+
+	published := make(chan *Version, 1)
+	RegisterPublishObserver(publishObserverFunc(func(c *Space, ver *Version) {
+		panic("observer failure")
+	}))
+	RegisterPublishObserver(publishObserverFunc(func(c *Space, ver *Version) {
+		published <- ver
+	}))
+
+	ver := &Version{ID: "bank-1.0.0", Slug: "bank", Version: "1.0.0"}
+	notifyVersionPublished(nil, ver)
+	ver.ID = ""
+	select {
+	case v := <-published:
+		if v == ver || v.Version != "1.0.0" || v.ID != "bank-1.0.0" {
+			t.Fatalf("expected a copy of the version, got %+v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the observer to be notified")
+	}
+}
+
+func TestAppsListETag(t *testing.T) {
+	updated := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	apps := []*App{
+		{ID: "bank", Rev: "1-a", UpdatedAt: updated},
+		{ID: "drive", Rev: "2-b", UpdatedAt: updated},
+	}
+	opts := &AppsListOptions{LatestVersionChannel: Stable, VersionsChannel: Dev}
+
+	etag := appsListETag(apps, -1, opts)
+	if !strings.HasPrefix(etag, `W/"`) || etag != appsListETag(apps, -1, opts) {
+		t.Fatalf("unexpected etag %s", etag)
+	}
+	if !etagMatches(`"other", `+etag, etag) || etagMatches("", etag) {
+		t.Fatal("unexpected if-none-match matching")
+	}
+
+	apps[1].Rev = "3-c"
+	if appsListETag(apps, -1, opts) == etag {
+		t.Fatal("expected the etag to change with the applications")
+	}
+	apps[1].Rev = "2-b"
+	apps[1].LatestVersion = &Version{ID: "drive-1.0.0", CreatedAt: updated}
+	if appsListETag(apps, -1, opts) == etag {
+		t.Fatal("expected the etag to change with the latest version")
+	}
+	withLatest := appsListETag(apps, -1, opts)
+	apps[1].LatestVersion = &Version{ID: "drive-1.0.1", CreatedAt: updated.Add(time.Hour)}
+	if appsListETag(apps, -1, opts) == withLatest {
+		t.Fatal("expected the etag to change with a new latest version")
+	}
+	apps[1].LatestVersion = nil
+	if appsListETag(apps, 2, opts) == etag {
+		t.Fatal("expected the etag to change with the next cursor")
+	}
+	opts.NextToken = "token"
+	if appsListETag(apps, -1, opts) == etag {
+		t.Fatal("expected the etag to change with the next token")
+	}
+	opts.NextToken = ""
+	opts.WithTotal = true
+	opts.Total = 2
+	withTotal := appsListETag(apps, -1, opts)
+	if withTotal == etag {
+		t.Fatal("expected the etag to change with the total")
+	}
+	opts.Total = 3
+	if appsListETag(apps, -1, opts) == withTotal {
+		t.Fatal("expected the etag to change with a new total")
+	}
+	opts.WithTotal = false
+	opts.Total = 0
+	opts.SummaryOnly = true
+	if appsListETag(apps, -1, opts) == etag {
+		t.Fatal("expected the etag to change with the options")
+	}
+}
+
+func TestExclusionSelector(t *testing.T) {
+	tests := []struct {
+		opts     AppsListOptions
+		selector string
+	}{
+		{AppsListOptions{}, `"$nor": [{"archived": true},{"private": true}]`},
+		{AppsListOptions{IncludeArchived: true}, `"$nor": [{"private": true}]`},
+		{AppsListOptions{IncludePrivate: true}, `"$nor": [{"archived": true}]`},
+		{AppsListOptions{IncludeArchived: true, IncludePrivate: true}, ``},
+	}
+	for _, test := range tests {
+		selector := exclusionSelector(&test.opts)
+		if selector != test.selector {
+			t.Errorf("expected %s, got %s", test.selector, selector)
+		}
+		if selector != "" {
+			var v map[string]interface{}
+			if err := json.Unmarshal([]byte("{"+selector+"}"), &v); err != nil {
+				t.Errorf("invalid selector %s: %s", selector, err)
+			}
+		}
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	from := &Version{Manifest: json.RawMessage(`{
+  "name": "Bank",
+  "version": "1.0.0",
+  "license": "AGPL-3.0",
+  "permissions": {
+    "accounts": {"type": "io.cozy.bank.accounts", "verbs": ["GET", "POST"]},
+    "settings": {"type": "io.cozy.settings"},
+    "files": {"type": "io.cozy.files"}
+  },
+  "routes": {"/": {"folder": "/", "index": "index.html"}}
+}`)}
+	to := &Version{Manifest: json.RawMessage(`{
+  "name": "Bank",
+  "version": "1.1.0",
+  "permissions": {
+    "accounts": {"type": "io.cozy.bank.accounts", "verbs": ["POST", "GET"]},
+    "settings": {"type": "io.cozy.settings", "verbs": ["GET"]},
+    "contacts": {"type": "io.cozy.contacts"}
+  },
+  "routes": {"/": {"folder": "/", "index": "index.html"}, "/public": {"folder": "/public", "public": true}}
+}`)}
+
+	diff, err := diffManifests(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, got []string, expected ...string) {
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+	}
+	check("permissions added", diff.PermissionsAdded, "contacts")
+	check("permissions removed", diff.PermissionsRemoved, "files")
+	check("permissions changed", diff.PermissionsChanged, "settings")
+	check("routes added", diff.RoutesAdded, "/public")
+	check("routes removed", diff.RoutesRemoved)
+
+	if len(diff.Fields) != 2 {
+		t.Fatalf("unexpected fields changes %v", diff.Fields)
+	}
+	if v := diff.Fields["version"]; string(v.From) != `"1.0.0"` || string(v.To) != `"1.1.0"` {
+		t.Errorf("unexpected version change %s -> %s", v.From, v.To)
+	}
+	if v := diff.Fields["license"]; string(v.From) != `"AGPL-3.0"` || v.To != nil {
+		t.Errorf("unexpected license change %s -> %s", v.From, v.To)
+	}
+
+	again, err := diffManifests(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, _ := json.Marshal(diff)
+	b2, _ := json.Marshal(again)
+	if !bytes.Equal(b1, b2) {
+		t.Fatalf("expected a deterministic diff, got %s and %s", b1, b2)
+	}
+}
+
+func TestPublishRateLimiter(t *testing.T) {
+	l := newPublishRateLimiter(PublishRateConfig{PerMinute: 6, Burst: 2})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.allow("cozy", now); err != nil {
+			t.Fatalf("expected the burst to be allowed, got %s", err)
+		}
+	}
+	if err := l.allow("cozy", now); err != ErrPublishRateExceeded {
+		t.Fatalf("expected ErrPublishRateExceeded, got %v", err)
+	}
+	if err := l.allow("other", now); err != nil {
+		t.Fatalf("expected the buckets to be per editor, got %s", err)
+	}
+	if err := l.allow("cozy", now.Add(10*time.Second)); err != nil {
+		t.Fatalf("expected the bucket to be refilled, got %s", err)
+	}
+	if err := l.allow("cozy", now.Add(10*time.Second)); err != ErrPublishRateExceeded {
+		t.Fatalf("expected ErrPublishRateExceeded, got %v", err)
+	}
+}
+
+func TestIsValidAppRejectsUppercaseSlug(t *testing.T) {
+	for _, slug := range []string{"MyApp", "My_App"} {
+		err := IsValidApp(&AppOptions{Slug: slug, Editor: "cozy", Type: "webapp"})
+		verr, ok := err.(*ValidationError)
+		if !ok || verr.Fields["slug"] == "" {
+			t.Fatalf("expected a validation error on the slug of %q, got %v", slug, err)
+		}
+	}
+	if err := IsValidApp(&AppOptions{Slug: "my-app", Editor: "cozy", Type: "webapp"}); err != nil {
+		t.Fatalf("expected %q to be valid, got %s", "my-app", err)
+	}
+}
+
+func TestWriteAppWithRetries(t *testing.T) {
+	conflict := errshttp.NewError(http.StatusConflict, "Document update conflict")
+
+	// The stored document is updated concurrently between the first read
+	// and the first write: the merge is done again on the new revision.
+	stored := &App{ID: "drive", Rev: "1-a", Tags: []string{"files"}}
+	reads := 0
+	prepare := func() (*App, bool, error) {
+		reads++
+		app := *stored
+		app.Category = "cozy"
+		return &app, true, nil
+	}
+	write := func(app *App) error {
+		if reads == 1 {
+			stored = &App{ID: "drive", Rev: "2-b", Tags: []string{"files", "sync"}}
+		}
+		if app.Rev != stored.Rev {
+			return conflict
+		}
+		app.Rev = "3-c"
+		stored = app
+		return nil
+	}
+	app, err := writeAppWithRetries(prepare, write)
+	if err != nil {
+		t.Fatalf("expected the write to succeed, got %s", err)
+	}
+	if reads != 2 {
+		t.Fatalf("expected the application to be read twice, got %d", reads)
+	}
+	if app.Rev != "3-c" || app.Category != "cozy" || len(app.Tags) != 2 {
+		t.Fatalf("expected the concurrent update to be kept, got %+v", app)
+	}
+
+	// The conflicts are reported once the retries are exhausted.
+	writes := 0
+	_, err = writeAppWithRetries(prepare, func(*App) error {
+		writes++
+		return conflict
+	})
+	if err != ErrAppUpdateConflict {
+		t.Fatalf("expected ErrAppUpdateConflict, got %v", err)
+	}
+	if writes != maxAppWriteRetries+1 {
+		t.Fatalf("expected %d writes, got %d", maxAppWriteRetries+1, writes)
+	}
+
+	// The other errors are not retried.
+	writes = 0
+	_, err = writeAppWithRetries(prepare, func(*App) error {
+		writes++
+		return ErrAppNotFound
+	})
+	if err != ErrAppNotFound || writes != 1 {
+		t.Fatalf("expected ErrAppNotFound after one write, got %v after %d", err, writes)
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		stack      string
+		compatible bool
+	}{
+		{">=1.5.0", "1.5.0", true},
+		{">=1.5.0", "1.10.2", true},
+		{">=1.5.0", "1.4.9", false},
+		{">= 1.5.0", "2.0.0", true},
+		{">=1.5.0 <2.0.0", "2.0.0", false},
+		{">=1.5.0, <2.0.0", "1.9.0", true},
+		{"<1.0.0 || >=1.5", "0.9.0", true},
+		{"<1.0.0 || >=1.5", "1.2.0", false},
+		{"1.5.0", "1.5.0", true},
+		{"==1.5.0", "1.5.1", false},
+		{">1.5.0", "v1.5.1-beta.1", true},
+		{"", "1.0.0", true},
+		{"^1.5.0", "1.9.3", true},
+		{"^1.5.0", "2.0.0", false},
+		{"^ 1.5.0", "1.4.0", false},
+		{"^0.5.2", "0.5.9", true},
+		{"^0.5.2", "0.6.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"^0.0", "0.0.9", true},
+		{"^0.0", "0.1.0", false},
+		{"~1.5.0", "1.5.7", true},
+		{"~1.5.0", "1.6.0", false},
+		{"~1", "1.9.0", true},
+		{"~1", "2.0.0", false},
+		{"~0.0.0-beta.1", "0.0.9", true},
+	}
+	for _, test := range tests {
+		stack, err := parseStackVersion(test.stack)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", test.stack, err)
+		}
+		ver := &Version{CozyVersion: test.constraint}
+		if got := ver.isCompatibleWith(stack); got != test.compatible {
+			t.Errorf("expected %q compatible with %q to be %t", test.constraint, test.stack, test.compatible)
+		}
+	}
+
+	for _, constraint := range []string{">=", ">=1.a.0", ">=1.5.0 ||", "^1.x", "1.2.3.4"} {
+		if _, err := parseVersionConstraint(constraint); err == nil {
+			t.Errorf("expected %q to be invalid", constraint)
+		}
+	}
+
+	m := &Manifest{MinCozy: "1.5.0"}
+	if c, field := m.cozyVersionConstraint(); c != ">=1.5.0" || field != "min_cozy" {
+		t.Errorf("expected min_cozy to be converted to a constraint, got %q from %q", c, field)
+	}
+	m.CozyVersion = ">=1.6.0 <2.0.0"
+	if c, field := m.cozyVersionConstraint(); c != m.CozyVersion || field != "cozy_version" {
+		t.Errorf("expected cozy_version to have precedence, got %q from %q", c, field)
+	}
+}
+
+func TestVersionIsImmutable(t *testing.T) {
+	ver := &Version{Slug: "drive", Version: "1.0.0"}
+	if !ver.IsImmutable() {
+		t.Fatalf("expected a published version to be immutable")
+	}
+	ver.pending = true
+	if ver.IsImmutable() {
+		t.Fatalf("expected a pending version not to be immutable")
+	}
+	if clone := ver.Clone(); clone.IsImmutable() {
+		t.Fatalf("expected the clone of a pending version not to be immutable")
+	}
+}
+
+func TestParsedManifest(t *testing.T) {
+	ver := &Version{Manifest: json.RawMessage(`{
+  "name": "Drive",
+  "slug": "drive",
+  "version": "1.0.0",
+  "icon": "icon.svg",
+  "categories": ["cozy"],
+  "routes": {"/": {"folder": "/", "index": "index.html", "public": false}}
+}`)}
+	m, err := ver.ParsedManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "Drive" || m.Icon != "icon.svg" || len(m.Categories) != 1 || m.Routes["/"].Index != "index.html" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	if again, _ := ver.ParsedManifest(); again != m {
+		t.Fatalf("expected the parsed manifest to be cached")
+	}
+
+	ver.Manifest = json.RawMessage(`{"name": "Drive 2"}`)
+	if m, err = ver.ParsedManifest(); err != nil || m.Name != "Drive 2" {
+		t.Fatalf("expected the replaced manifest to be parsed again, got %+v, %v", m, err)
+	}
+}
+
+func TestSameVersionsViews(t *testing.T) {
+	views := make(map[string]view)
+	for name, v := range versionsViews {
+		views[name] = view{Map: versViewMap(v, "drive"), Reduce: v.Reduce}
+	}
+	if !sameVersionsViews(views, "drive") {
+		t.Fatalf("expected the current views to be up-to-date")
+	}
+	if sameVersionsViews(views, "banks") {
+		t.Fatalf("expected the views of another application to be outdated")
+	}
+	views["dev"] = view{Map: "function(doc) {}", Reduce: "_count"}
+	if sameVersionsViews(views, "drive") {
+		t.Fatalf("expected a modified view to be outdated")
+	}
+	if sameVersionsViews(nil, "drive") {
+		t.Fatalf("expected a missing design document to be outdated")
+	}
+}
+
+func TestSniffAttachment(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR\x00\x00\x00\x01")
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`)
+	html := []byte(`<html><body><script>alert(1)</script></body></html>`)
+	longSVG := []byte(longPrologSVG)
+
+	tests := []struct {
+		filename string
+		content  []byte
+		mime     string
+		download bool
+	}{
+		{"screenshots/shot.png", png, "image/png", false},
+		{"icon", svg, "image/svg+xml", false},
+		{"icon", longSVG, "image/svg+xml", false},
+		{"screenshots/shot.png", html, "application/octet-stream", true},
+	}
+	for _, test := range tests {
+		att := &Attachment{Attachment: &kivik.Attachment{
+			Content:     ioutil.NopCloser(bytes.NewReader(test.content)),
+			ContentType: "image/png",
+		}}
+		sniffAttachment(att, test.filename)
+		if att.ContentType != test.mime || att.Download != test.download {
+			t.Errorf("%s: expected %q (download: %t), got %q (download: %t)",
+				test.filename, test.mime, test.download, att.ContentType, att.Download)
+		}
+		content, err := ioutil.ReadAll(att.Content)
+		if err != nil || !bytes.Equal(content, test.content) {
+			t.Errorf("%s: expected the content to be kept, got %q, %v", test.filename, content, err)
+		}
+	}
+}
+
+// longPrologSVG is an SVG image whose comments and doctype, as exported by
+// Illustrator, are longer than the header used by magic.MIMEType.
+var longPrologSVG = `<?xml version="1.0" encoding="utf-8"?>
+<!-- Generator: Adobe Illustrator 22.0.1, SVG Export Plug-In . SVG Version: 6.00 Build 0)  -->
+<!-- ` + strings.Repeat("Exported for the Cozy store. ", 30) + ` -->
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd" [
+	<!ENTITY ns_extend "http://ns.adobe.com/Extensibility/1.0/">
+	<!ENTITY ns_ai "http://ns.adobe.com/AdobeIllustrator/10.0/">
+]>
+<svg version="1.1" xmlns="http://www.w3.org/2000/svg" width="32" height="32"></svg>`
+
+func TestValidateTarballLongPrologSVG(t *testing.T) {
+	if len(longPrologSVG) <= magic.HeaderBytesNeeded() {
+		t.Fatalf("expected a prolog longer than %d bytes", magic.HeaderBytesNeeded())
+	}
+	manifest := `{"slug": "bank", "editor": "cozy", "version": "1.0.0", "icon": "icon.svg"}`
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, f := range []struct{ name, content string }{
+		{"bank/manifest.webapp", manifest},
+		{"bank/icon.svg", longPrologSVG},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &VersionOptions{Version: "1.0.0", URL: "http://example.org/bank.tar"}
+	_, attachments, err := validateTarball(bytes.NewReader(tarball.Bytes()), opts, defaultMaxApplicationSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].ContentType != "image/svg+xml" {
+		t.Errorf("expected the icon as an image/svg+xml attachment, got %v", attachments)
+	}
+}
+
+func TestCollapseLocales(t *testing.T) {
+	app := &App{
+		AppName:        map[string]string{"en": "Drive", "fr": "Drive FR", "de": "Drive DE"},
+		AppDescription: map[string]string{"en": "Files", "de": "Dateien"},
+	}
+	app.collapseLocales("fr-FR")
+	if len(app.AppName) != 1 || app.AppName["fr"] != "Drive FR" {
+		t.Fatalf("expected the french name only, got %v", app.AppName)
+	}
+	if len(app.AppDescription) != 1 || app.AppDescription["en"] != "Files" {
+		t.Fatalf("expected the english description as fallback, got %v", app.AppDescription)
+	}
+
+	app = &App{AppName: map[string]string{"de": "Drive DE", "it": "Drive IT"}}
+	app.collapseLocales("fr")
+	if len(app.AppName) != 1 || app.AppName["de"] != "Drive DE" || app.AppDescription != nil {
+		t.Fatalf("expected the first locale as fallback, got %v and %v", app.AppName, app.AppDescription)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	created := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	app := &App{Slug: "drive", Editor: "cozy", CreatedAt: created}
+
+	cursor, err := DecodeCursor(EncodeCursor(appCursor(app, "created_at")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Sort != "created_at" || cursor.Slug != "drive" || string(cursor.Value) != `"2019-03-01T10:00:00Z"` {
+		t.Fatalf("unexpected cursor %+v", cursor)
+	}
+
+	var selector map[string]interface{}
+	if err = json.Unmarshal([]byte("{"+cursorSelector(cursor, "desc")+"}"), &selector); err != nil {
+		t.Fatalf("invalid selector: %s", err)
+	}
+	expected := `{"$and":[{"$or":[{"created_at":{"$lt":"2019-03-01T10:00:00Z"}},{"created_at":"2019-03-01T10:00:00Z","slug":{"$lt":"drive"}}]}]}`
+	if b, _ := json.Marshal(selector); string(b) != expected {
+		t.Fatalf("unexpected selector %s", b)
+	}
+
+	cursor = appCursor(app, "slug")
+	if got := cursorSelector(cursor, "asc"); got != `"$and": [{"slug": {"$gt": "drive"}}]` {
+		t.Fatalf("unexpected selector %s", got)
+	}
+
+	for _, token := range []string{"", "not base64!", EncodeCursor(&Cursor{Sort: "editor", Slug: "drive"})} {
+		if _, err := DecodeCursor(token); err != ErrCursorInvalid {
+			t.Errorf("expected %q to be invalid, got %v", token, err)
+		}
+	}
+}
+
+func TestLatestVersionWithFallback(t *testing.T) {
+	beta := &Version{
+		Version:  "1.0.0-beta.2",
+		Manifest: json.RawMessage(`{"permissions": {"bank": {"type": "io.cozy.bank", "remote": true}}}`),
+	}
+	find := func(ch Channel) (*Version, error) {
+		if ch == Beta || ch == Dev {
+			return beta, nil
+		}
+		return nil, ErrVersionNotFound
+	}
+
+	ver, err := latestVersionWithFallback([]Channel{Stable, Beta, Dev}, find)
+	if err != nil || ver != beta {
+		t.Fatalf("expected the beta version for a beta-only app, got %v, %v", ver, err)
+	}
+	app := &App{DataUsageCommitment: DUCUserReserved, DataUsageCommitmentBy: DUCByCozy}
+	if label := calculateAppLabel(app, ver); label != LabelD {
+		t.Fatalf("expected the label to use the remote doctypes of the beta version, got %v", label)
+	}
+
+	if _, err = latestVersionWithFallback([]Channel{Stable}, find); err != ErrVersionNotFound {
+		t.Fatalf("expected ErrVersionNotFound, got %v", err)
+	}
+
+	patch := &Version{Version: "1.0.0-patch.1"}
+	ver, err = latestVersionWithFallback(LatestVersionChannels, func(ch Channel) (*Version, error) {
+		switch ch {
+		case Patch:
+			return patch, nil
+		case Beta, Dev:
+			return beta, nil
+		}
+		return nil, ErrVersionNotFound
+	})
+	if err != nil || ver != patch {
+		t.Fatalf("expected the patch version before the beta one, got %v, %v", ver, err)
+	}
+
+	failure := errors.New("couchdb is down")
+	_, err = latestVersionWithFallback([]Channel{Stable, Beta}, func(Channel) (*Version, error) {
+		return nil, failure
+	})
+	if err != failure {
+		t.Fatalf("expected the error to be returned, got %v", err)
+	}
+}
+
+func TestScreenshots(t *testing.T) {
+	var manifest Manifest
+	raw := `{"screenshots": [
+		"screenshots/a.png",
+		{"url": "/screenshots/b.png", "caption": {"en": "Home", "fr": "Accueil"}, "order": -1},
+		{"url": "screenshots/c.png", "order": 1}
+	]}`
+	if err := json.Unmarshal([]byte(raw), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	shots := sortScreenshots(manifest.Screenshots)
+	var urls []string
+	for _, shot := range shots {
+		urls = append(urls, shot.URL)
+	}
+	expected := []string{"screenshots/b.png", "screenshots/a.png", "screenshots/c.png"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %v, got %v", expected, urls)
+	}
+	if shots[0].Caption["fr"] != "Accueil" {
+		t.Fatalf("expected the caption to be kept, got %v", shots[0].Caption)
+	}
+	if manifest.Screenshots[1].URL != "/screenshots/b.png" {
+		t.Fatal("expected the screenshots of the manifest to be left untouched")
+	}
+
+	if err := json.Unmarshal([]byte(`{"screenshots": [42]}`), &manifest); err == nil {
+		t.Fatal("expected an error for an invalid screenshot")
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	var opts AppOptions
+	err := DecodeStrict(strings.NewReader(`{"slug": "drive", "categorie": "cozy"}`), &opts)
+	if err == nil || !strings.Contains(err.Error(), `"categorie"`) {
+		t.Fatalf("expected an error naming the unknown field, got %v", err)
+	}
+	if err = DecodeStrict(strings.NewReader(`{"slug": "drive", "category": "cozy"}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Slug != "drive" || opts.Category != "cozy" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if err = DecodeStrict(strings.NewReader(`{"slug": `), &opts); err == nil {
+		t.Fatal("expected an error for an invalid document")
+	}
+}
+
+func TestIncrementVersionDownloads(t *testing.T) {
+	c := NewSpace("downloads-test")
+	IncrementVersionDownloads(c, "drive", "1.0.0")
+	IncrementVersionDownloads(c, "drive", "1.0.0")
+	IncrementVersionDownloads(c, "drive", "1.0.1")
+
+	pendingDownloads.Lock()
+	count := pendingDownloads.counts[downloadsKey{space: "downloads-test", slug: "drive", version: "1.0.0"}]
+	pendingDownloads.Unlock()
+	if count != 2 {
+		t.Fatalf("expected 2 buffered downloads, got %d", count)
+	}
+
+	// The space is not registered, so its counters are dropped by the flush.
+	if err := FlushDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	pendingDownloads.Lock()
+	n := len(pendingDownloads.counts)
+	pendingDownloads.Unlock()
+	if n != 0 {
+		t.Fatalf("expected the buffer to be emptied, got %d counters", n)
+	}
+}
+
+func TestPopularityUpdate(t *testing.T) {
+	fields, err := popularityUpdate(json.RawMessage(`{"_id": "drive", "slug": "drive"}`), 0)
+	if err != nil || fields == nil || string(fields["total_downloads"]) != "0" {
+		t.Fatalf("expected a document without the field to be updated, got %v, %v", fields, err)
+	}
+	fields, err = popularityUpdate(json.RawMessage(`{"_id": "drive", "slug": "drive", "total_downloads": 12}`), 12)
+	if err != nil || fields != nil {
+		t.Fatalf("expected an up to date document to be skipped, got %v, %v", fields, err)
+	}
+	doc := `{"_id": "drive", "slug": "drive", "created_at": "2018-06-01T12:00:00.123456789Z", "unknown": {"a": 1}, "total_downloads": 12}`
+	fields, err = popularityUpdate(json.RawMessage(doc), 15)
+	if err != nil || fields == nil || string(fields["total_downloads"]) != "15" {
+		t.Fatalf("expected the total to be updated, got %v, %v", fields, err)
+	}
+	for name, value := range map[string]string{
+		"slug":       `"drive"`,
+		"created_at": `"2018-06-01T12:00:00.123456789Z"`,
+		"unknown":    `{"a": 1}`,
+	} {
+		if string(fields[name]) != value {
+			t.Errorf("expected the field %s to be kept as %s, got %s", name, value, fields[name])
+		}
+	}
+
+	if _, ok := appsIndexes["by-downloads"]; !ok {
+		t.Fatal("expected an index for the downloads sort")
+	}
+	cursor := appCursor(&App{Slug: "drive", TotalDownloads: 15}, "downloads")
+	selector := cursorSelector(cursor, "desc")
+	if !strings.Contains(selector, `"total_downloads": {"$lt": 15}`) {
+		t.Fatalf("expected the cursor to use the total_downloads field, got %s", selector)
+	}
+}
+
+func TestArchivedAppError(t *testing.T) {
+	if err := ArchivedAppError(&App{Slug: "drive"}); err != nil {
+		t.Fatalf("expected no error for a live application, got %v", err)
+	}
+
+	err := ArchivedAppError(&App{Slug: "drive", Archived: true})
+	if err != ErrAppArchived || kivik.StatusCode(err) != http.StatusGone {
+		t.Fatalf("expected ErrAppArchived, got %v", err)
+	}
+
+	err = ArchivedAppError(&App{Slug: "drive", Archived: true, ReplacedBy: "drive-v2"})
+	archived, ok := err.(*AppArchivedError)
+	if !ok || archived.ReplacedBy != "drive-v2" || kivik.StatusCode(err) != http.StatusGone {
+		t.Fatalf("expected an error with the replacement slug, got %v", err)
+	}
+
+	// A slug that has never been used is still reported as not found.
+	if kivik.StatusCode(ErrAppNotFound) != http.StatusNotFound {
+		t.Fatalf("expected ErrAppNotFound to be a 404, got %d", kivik.StatusCode(ErrAppNotFound))
+	}
+}
+
+func TestManifestOverrides(t *testing.T) {
+	manifest := map[string]interface{}{
+		"slug":     "drive",
+		"version":  "1.0.0",
+		"category": "cozy",
+	}
+	content, fields, err := applyManifestOverrides(manifest, map[string]interface{}{
+		"category":          "partners",
+		"short_description": "Your files",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, []string{"category", "short_description"}) {
+		t.Fatalf("unexpected overridden fields %v", fields)
+	}
+	var parsed map[string]interface{}
+	if err = json.Unmarshal(content, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["category"] != "partners" || parsed["slug"] != "drive" {
+		t.Fatalf("unexpected manifest %s", content)
+	}
+
+	for _, field := range []string{"slug", "version", "editor"} {
+		if _, _, err = applyManifestOverrides(manifest, map[string]interface{}{field: "x"}); err == nil {
+			t.Fatalf("expected the %s field to not be overridable", field)
+		}
+		opts := &VersionOptions{ManifestOverrides: map[string]interface{}{field: "x"}}
+		verr, ok := IsValidVersion(opts).(*ValidationError)
+		if !ok || !strings.Contains(verr.Fields["manifest_overrides"], field) {
+			t.Fatalf("expected the %s override to be rejected, got %v", field, verr)
+		}
+	}
+}
+
+func TestTruncateDates(t *testing.T) {
+	created := time.Date(2020, 3, 4, 5, 6, 7, 891234567, time.FixedZone("CET", 3600))
+	published := created.Add(time.Hour)
+	app := &App{Slug: "drive", CreatedAt: created, UpdatedAt: created, LatestStableCreatedAt: &created}
+	ver := &Version{Slug: "drive", Version: "1.0.0", CreatedAt: created, PublishedAt: &published}
+
+	// The documents written to CouchDB keep the full precision.
+	data, err := json.Marshal(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Version
+	if err = json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CreatedAt.Equal(created) || !stored.PublishedAt.Equal(published) {
+		t.Fatalf("expected the dates to keep their precision, got %s", data)
+	}
+
+	app.TruncateDates()
+	data, err = json.Marshal(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"created_at":"2020-03-04T04:06:07Z"`, `"updated_at":"2020-03-04T04:06:07Z"`, `"latest_version_created_at":"2020-03-04T04:06:07Z"`} {
+		if !strings.Contains(string(data), field) {
+			t.Fatalf("expected %s in %s", field, data)
+		}
+	}
+	if !created.Equal(time.Date(2020, 3, 4, 5, 6, 7, 891234567, time.FixedZone("CET", 3600))) {
+		t.Fatal("expected the truncated date to be a copy")
+	}
+
+	ver.TruncateDates()
+	data, err = json.Marshal(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"published_at":"2020-03-04T05:06:07Z"`) {
+		t.Fatalf("unexpected version %s", data)
+	}
+
+	data, _ = json.Marshal(&Version{CreatedAt: created})
+	if strings.Contains(string(data), "published_at") {
+		t.Fatalf("expected published_at to be omitted, got %s", data)
+	}
+}
+
+func TestExistsValidation(t *testing.T) {
+	c := NewSpace("")
+	if _, err := AppExists(c, "Not a slug"); err != ErrAppSlugInvalid {
+		t.Fatalf("expected ErrAppSlugInvalid, got %v", err)
+	}
+	if _, err := VersionExists(c, "drive", "not-a-version"); err != ErrVersionInvalid {
+		t.Fatalf("expected ErrVersionInvalid, got %v", err)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	since := time.Date(2020, 1, 2, 3, 4, 5, 600, time.FixedZone("CET", 3600))
+	query := auditQuery("myspace", AuditFilter{Editor: "cozy", Since: since, Limit: 5000})
+	var parsed struct {
+		UseIndex string                 `json:"use_index"`
+		Selector map[string]interface{} `json:"selector"`
+		Limit    int                    `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(query), &parsed); err != nil {
+		t.Fatalf("invalid query %s: %s", query, err)
+	}
+	if parsed.UseIndex != "audit-index" || parsed.Limit != maxAuditLimit {
+		t.Fatalf("unexpected query %s", query)
+	}
+	if parsed.Selector["space"] != "myspace" || parsed.Selector["editor"] != "cozy" {
+		t.Fatalf("unexpected selector %v", parsed.Selector)
+	}
+	if _, ok := parsed.Selector["slug"]; ok {
+		t.Fatalf("expected no filter on the slug, got %v", parsed.Selector)
+	}
+	timestamp := parsed.Selector["timestamp"].(map[string]interface{})
+	if timestamp["$gte"] != "2020-01-02T02:04:05Z" {
+		t.Fatalf("unexpected timestamp filter %v", timestamp)
+	}
+}
+
+type memoryVault struct {
+	editors map[string]*auth.Editor
+}
+
+func (v *memoryVault) GetEditor(name string) (*auth.Editor, error) {
+	if e, ok := v.editors[name]; ok {
+		return e, nil
+	}
+	return nil, auth.ErrEditorNotFound
+}
+
+func (v *memoryVault) CreateEditor(e *auth.Editor) error {
+	v.editors[e.Name()] = e
+	return nil
+}
+
+func (v *memoryVault) UpdateEditor(e *auth.Editor) error { return v.CreateEditor(e) }
+
+func (v *memoryVault) DeleteEditor(e *auth.Editor) error {
+	delete(v.editors, e.Name())
+	return nil
+}
+
+func (v *memoryVault) AllEditors() ([]*auth.Editor, error) { return nil, nil }
+
+func TestVerifyVersionSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editors, _ := auth.NewEditorRegistry(&memoryVault{editors: make(map[string]*auth.Editor)})
+	editor, err := editors.CreateEditorWithPublicKey("cozy", der, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha := strings.Repeat("ab", sha256.Size)
+	hashed := sha256.Sum256([]byte(sha))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &VersionOptions{Sha256: sha, Signature: base64.StdEncoding.EncodeToString(sig)}
+	if err = VerifyVersionSignature(editor, opts); err != nil {
+		t.Fatalf("expected the signature to verify, got %s", err)
+	}
+	if opts.SignatureKeyID != editor.PublicKeyID() || opts.SignatureKeyID == "" {
+		t.Fatalf("expected the key id to be set, got %q", opts.SignatureKeyID)
+	}
+
+	opts = &VersionOptions{Sha256: strings.Repeat("cd", sha256.Size), Signature: base64.StdEncoding.EncodeToString(sig)}
+	if err = VerifyVersionSignature(editor, opts); err != ErrVersionSignatureInvalid {
+		t.Fatalf("expected ErrVersionSignatureInvalid for another tarball, got %v", err)
+	}
+	opts = &VersionOptions{Sha256: sha, Signature: base64.StdEncoding.EncodeToString(sig), SignatureKeyID: "0123456789abcdef"}
+	if err = VerifyVersionSignature(editor, opts); err != ErrVersionSignatureInvalid {
+		t.Fatalf("expected ErrVersionSignatureInvalid for an unknown key, got %v", err)
+	}
+
+	if err = VerifyVersionSignature(editor, &VersionOptions{Sha256: sha}); err != nil {
+		t.Fatalf("expected an unsigned version to be accepted, got %s", err)
+	}
+	if err = editors.SetSigningRequired(editor, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyVersionSignature(editor, &VersionOptions{Sha256: sha}); err != ErrVersionSignatureMissing {
+		t.Fatalf("expected ErrVersionSignatureMissing, got %v", err)
+	}
+}
+
+func TestFindLatestVersionsFromCache(t *testing.T) {
+	InitCaches(CacheConfig{})
+	for _, slug := range []string{"drive", "photos"} {
+		data, _ := json.Marshal(&Version{Slug: slug, Version: "1.0.0"})
+		cacheVersionsLatest.Add(lru.Key(slug+"/stable"), lru.Value(data))
+	}
+
+	// The space has no database: all the versions must come from the cache.
+	versions, err := FindLatestVersions(context.Background(), NewSpace(""), []string{"drive", "photos", "drive"}, Stable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions["drive"].Version != "1.0.0" || versions["photos"].Slug != "photos" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	if _, err = FindLatestVersions(context.Background(), NewSpace(""), []string{"Not a slug"}, Stable); err != ErrAppSlugInvalid {
+		t.Fatalf("expected ErrAppSlugInvalid, got %v", err)
+	}
+}
+
+func TestFeaturedApps(t *testing.T) {
+	featured := []*App{
+		{Slug: "drive", Featured: 1},
+		{Slug: "photos", Featured: 3},
+		{Slug: "banks", Featured: 1},
+	}
+	sortFeaturedApps(featured)
+	var slugs []string
+	for _, app := range featured {
+		slugs = append(slugs, app.Slug)
+	}
+	if !reflect.DeepEqual(slugs, []string{"photos", "banks", "drive"}) {
+		t.Fatalf("unexpected order %v", slugs)
+	}
+
+	page := []*App{{Slug: "contacts"}, {Slug: "drive"}, {Slug: "notes"}}
+	slugs = nil
+	for _, app := range prependFeatured(featured, page) {
+		slugs = append(slugs, app.Slug)
+	}
+	if !reflect.DeepEqual(slugs, []string{"photos", "banks", "drive", "contacts", "notes"}) {
+		t.Fatalf("unexpected page %v", slugs)
+	}
+
+	excluded := exclusionSelector(&AppsListOptions{FeaturedFirst: true})
+	if excluded != `"$nor": [{"archived": true},{"private": true},{"featured": {"$gt": 0}}]` {
+		t.Fatalf("unexpected selector %s", excluded)
+	}
+
+	// The featured applications would be excluded from the reversed pages
+	// without being listed first.
+	opts := &AppsListOptions{FeaturedFirst: true, Reverse: true}
+	if _, _, err := GetAppsList(context.Background(), NewSpace(""), opts); err != ErrFeaturedFirstReverse {
+		t.Fatalf("expected ErrFeaturedFirstReverse, got %v", err)
+	}
+}
+
+func TestValidateTarballManifestFilenames(t *testing.T) {
+	defer func(names []string) { ManifestFilenames = names }(ManifestFilenames)
+	ManifestFilenames = []string{"manifest.webapp", "manifest.konnector", "manifest.json"}
+
+	manifest := `{"slug": "bank", "editor": "cozy", "version": "1.0.0", "type": "konnector"}`
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, f := range []struct{ name, content string }{
+		{"bank/package.json", `{"version": "1.0.0"}`},
+		{"bank/build/manifest.json", manifest},
+		{"bank/build/index.js", "module.exports = {}"},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &VersionOptions{Version: "1.0.0", URL: "http://example.org/bank.tar"}
+	ver, _, err := validateTarball(bytes.NewReader(tarball.Bytes()), opts, defaultMaxApplicationSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.ManifestPath != "/bank/build/manifest.json" {
+		t.Errorf("unexpected manifest path %q", ver.ManifestPath)
+	}
+	if ver.Type != "konnector" {
+		t.Errorf("expected type konnector, got %q", ver.Type)
+	}
+
+	// The manifest.webapp is preferred to the manifest.json of a PWA, and
+	// the shallowest manifest.json to the ones of the dependencies.
+	webapp := `{"slug": "drive", "editor": "cozy", "version": "1.0.0"}`
+	pwa := `{"name": "Drive", "display": "standalone"}`
+	tarball.Reset()
+	tw = tar.NewWriter(&tarball)
+	for _, f := range []struct{ name, content string }{
+		{"drive/build/manifest.json", pwa},
+		{"drive/node_modules/lib/manifest.webapp", `{}`},
+		{"drive/manifest.webapp", webapp},
+		{"drive/manifest.json", pwa},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.URL = "http://example.org/drive.tar"
+	ver, _, err = validateTarball(bytes.NewReader(tarball.Bytes()), opts, defaultMaxApplicationSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.ManifestPath != "/drive/manifest.webapp" || ver.Type != "webapp" {
+		t.Errorf("unexpected manifest %q of type %q", ver.ManifestPath, ver.Type)
+	}
+	if !isPreferredManifest("/a/manifest.json", "/a/b/manifest.json") ||
+		isPreferredManifest("/a/b/manifest.json", "/a/manifest.json") ||
+		isPreferredManifest("/a/manifest.json", "/a/b/c/manifest.webapp") {
+		t.Errorf("unexpected order of the manifests")
+	}
+
+	tests := []struct {
+		filename string
+		manifest map[string]interface{}
+		appType  string
+	}{
+		{"manifest.webapp", map[string]interface{}{"type": "konnector"}, "webapp"},
+		{"manifest.konnector", nil, "konnector"},
+		{"manifest.json", map[string]interface{}{"type": "webapp"}, "webapp"},
+		{"manifest.json", map[string]interface{}{"type": "theme"}, ""},
+		{"manifest.json", map[string]interface{}{}, ""},
+	}
+	for _, test := range tests {
+		appType, err := manifestAppType(test.filename, test.manifest)
+		if appType != test.appType || (err != nil) != (test.appType == "") {
+			t.Errorf("manifestAppType(%q, %v) = %q, %v", test.filename, test.manifest, appType, err)
+		}
+	}
+}
+
+func TestInitGlobalClientKeepsClientOnError(t *testing.T) {
+	previous := dbClient()
+	if _, err := InitGlobalClient("://not a url", "", "", ""); err == nil {
+		t.Fatal("expected an error for an invalid address")
+	}
+	if dbClient() != previous {
+		t.Fatal("the client should not have been replaced")
+	}
+}
+
+type fakeDocRows struct {
+	ids   []string
+	docs  []string
+	index int
+	err   error
+}
+
+func (r *fakeDocRows) Next() bool {
+	r.index++
+	return r.index <= len(r.ids)
+}
+
+func (r *fakeDocRows) ID() string {
+	return r.ids[r.index-1]
+}
+
+func (r *fakeDocRows) ScanDoc(dest interface{}) error {
+	return json.Unmarshal([]byte(r.docs[r.index-1]), dest)
+}
+
+func (r *fakeDocRows) Err() error {
+	return r.err
+}
+
+func TestSpaceStatsRows(t *testing.T) {
+	rows := &fakeDocRows{ids: []string{"_design/by-slug", "bank", "drive"}}
+	if count, err := countRows(rows); err != nil || count != 2 {
+		t.Fatalf("expected 2 documents without the design document, got %d, %v", count, err)
+	}
+
+	rows = &fakeDocRows{
+		ids: []string{"_design/versions", "bank-1.0.0", "drive-1.0.0"},
+		docs: []string{
+			`{"_attachments": {"app.tar.gz": {"length": 1000}}}`,
+			`{"_attachments": {"app.tar.gz": {"length": 2000}, "icon": {"length": 24}}}`,
+			`{}`,
+		},
+	}
+	count, size, err := sumAttachments(rows)
+	if err != nil || count != 2 || size != 2024 {
+		t.Fatalf("expected 2 versions and 2024 bytes of attachments, got %d, %d, %v", count, size, err)
+	}
+
+	interrupted := errors.New("stream interrupted")
+	if _, err = countRows(&fakeDocRows{ids: []string{"bank"}, err: interrupted}); err != interrupted {
+		t.Fatalf("expected the error of the rows, got %v", err)
+	}
+	if _, _, err = sumAttachments(&fakeDocRows{ids: []string{"bank"}, docs: []string{`{}`}, err: interrupted}); err != interrupted {
+		t.Fatalf("expected the error of the rows, got %v", err)
+	}
+}
+
+func TestCachedSpaceStats(t *testing.T) {
+	key := lru.Key("test-space-stats")
+	now := time.Now().UTC()
+	if _, ok := cachedSpaceStats(key, now); ok {
+		t.Fatal("expected no statistics in the cache")
+	}
+
+	data, err := json.Marshal(&SpaceStats{Name: "test-space-stats", Apps: 3, ComputedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheSpaceStats.Add(key, lru.Value(data))
+	stats, ok := cachedSpaceStats(key, now.Add(spaceStatsTTL/2))
+	if !ok || stats.Apps != 3 {
+		t.Fatalf("expected the cached statistics, got %v", stats)
+	}
+	// The lru cache extends the life of the entry on each read, but the
+	// statistics must still be computed again after the TTL.
+	if _, ok = cachedSpaceStats(key, now.Add(2*spaceStatsTTL)); ok {
+		t.Fatal("expected the expired statistics to be ignored")
+	}
+}
+
+func TestFindCachedPublishedVersion(t *testing.T) {
+	InitCaches(CacheConfig{})
+	defer InitCaches(CacheConfig{})
+
+	// The version is served from the cache, filled without database here.
+	publishedAt := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := NewSpace("")
+	data, _ := json.Marshal(&Version{Slug: "bank", Version: "1.0.0", PublishedAt: &publishedAt})
+	cacheVersionsPublished.Add(publishedVersionKey(c, "bank", "1.0.0"), lru.Value(data))
+	ver, err := findCachedPublishedVersion(context.Background(), c, "bank", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.Version != "1.0.0" || ver.PublishedAt == nil || !ver.PublishedAt.Equal(publishedAt) {
+		t.Fatalf("unexpected cached version %+v", ver)
+	}
+
+	if _, ok := cacheVersionsPublished.Get(publishedVersionKey(NewSpace("other"), "bank", "1.0.0")); ok {
+		t.Error("expected the cached versions to be per space")
+	}
+	forgetPublishedVersion(c, "bank", "1.0.0")
+	if _, ok := cacheVersionsPublished.Get(publishedVersionKey(c, "bank", "1.0.0")); ok {
+		t.Error("expected the deleted version to be removed from the cache")
+	}
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/lru"
+	"github.com/go-kivik/kivik"
+)
+
+// spaceStatsTTL is the time during which the statistics of a space are served
+// from the cache. The lru cache extends the life of the entries each time they
+// are read, so the date of computation is checked too.
+const spaceStatsTTL = time.Minute
+
+var cacheSpaceStats = lru.New(64, spaceStatsTTL)
+
+// SpaceStats contains the statistics of a space.
+type SpaceStats struct {
+	Name            string `json:"name"`
+	Apps            int    `json:"apps_count"`
+	Versions        int    `json:"versions_count"`
+	PendingVersions int    `json:"pending_versions_count"`
+	// AttachmentsSize is the total size in bytes of the attachments of the
+	// published versions: icons, screenshots and tarballs.
+	AttachmentsSize int64     `json:"attachments_size"`
+	ComputedAt      time.Time `json:"computed_at"`
+}
+
+// ListSpaces returns the registered spaces, sorted by name.
+func ListSpaces() []*Space {
+	names := Spaces()
+	list := make([]*Space, 0, len(names))
+	for _, name := range names {
+		list = append(list, spaces[name])
+	}
+	return list
+}
+
+// Name returns the name of the space, which is empty for the default space.
+func (c *Space) Name() string {
+	return c.prefix
+}
+
+// SpaceInfo returns the statistics of the given space. Computing them reads
+// all the versions documents, so they are cached for a short time.
+func SpaceInfo(c *Space) (*SpaceStats, error) {
+	key := lru.Key(c.prefix)
+	if stats, ok := cachedSpaceStats(key, time.Now()); ok {
+		return stats, nil
+	}
+
+	stats := &SpaceStats{Name: c.prefix}
+	var err error
+	if stats.Apps, err = countDocs(c.AppsDB()); err != nil {
+		return nil, err
+	}
+	if stats.PendingVersions, err = countDocs(c.PendingVersDB()); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.VersDB().AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if stats.Versions, stats.AttachmentsSize, err = sumAttachments(rows); err != nil {
+		return nil, err
+	}
+
+	stats.ComputedAt = time.Now().UTC()
+	if data, err := json.Marshal(stats); err == nil {
+		cacheSpaceStats.Add(key, lru.Value(data))
+	}
+	return stats, nil
+}
+
+// cachedSpaceStats returns the statistics of a space from the cache, if they
+// have been computed less than spaceStatsTTL before now.
+func cachedSpaceStats(key lru.Key, now time.Time) (*SpaceStats, bool) {
+	data, ok := cacheSpaceStats.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var stats SpaceStats
+	if err := json.Unmarshal(data, &stats); err != nil || now.Sub(stats.ComputedAt) > spaceStatsTTL {
+		return nil, false
+	}
+	return &stats, true
+}
+
+// docRows is the subset of *kivik.Rows used to read the _all_docs of a
+// database, so that it can be faked in the tests.
+type docRows interface {
+	Next() bool
+	ID() string
+	ScanDoc(dest interface{}) error
+	Err() error
+}
+
+// countDocs returns the number of documents of the database, without the
+// design documents.
+func countDocs(db *kivik.DB) (int, error) {
+	rows, err := db.AllDocs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	return countRows(rows)
+}
+
+func countRows(rows docRows) (int, error) {
+	count := 0
+	for rows.Next() {
+		if !strings.HasPrefix(rows.ID(), "_design") {
+			count++
+		}
+	}
+	return count, rows.Err()
+}
+
+// sumAttachments returns the number of documents read with their content,
+// without the design documents, and the total size of their attachments.
+func sumAttachments(rows docRows) (count int, size int64, err error) {
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var doc struct {
+			Attachments map[string]struct {
+				Length int64 `json:"length"`
+			} `json:"_attachments"`
+		}
+		if err = rows.ScanDoc(&doc); err != nil {
+			return 0, 0, err
+		}
+		count++
+		for _, att := range doc.Attachments {
+			size += att.Length
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
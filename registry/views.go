@@ -7,9 +7,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/go-kivik/couchdb/chttp"
+	"github.com/go-kivik/kivik"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -21,6 +24,9 @@ function getVersionChannel(version) {
   if (version.indexOf("-beta.") >= 0) {
     return "beta";
   }
+  if (version.indexOf("-patch.") >= 0) {
+    return "patch";
+  }
   return "stable";
 }
 
@@ -33,83 +39,189 @@ function expandVersion(doc) {
     v[1] = parseInt(sp[1], 10);
     v[2] = parseInt(sp[2].split("-")[0], 10);
     var channel = getVersionChannel(doc.version);
-    if (channel == "beta" && sp.length > 3) {
+    if ((channel == "beta" || channel == "patch") && sp.length > 3) {
       exp = parseInt(sp[3], 10)
     }
   }
   return {
     v: v,
     channel: channel,
-    code: (channel == "stable") ? 1 : 0,
+    code: (channel == "stable") ? 2 : (channel == "patch") ? 1 : 0,
     exp: exp,
     date: doc.created_at,
   };
 }`
 
+	// The dev versions sharing the same number are sorted on created_at,
+	// which is kept when the versions are imported, and not on published_at.
 	devView = `
 function(doc) {
   ` + viewsHelpers + `
-  if (doc.slug != %q) {
-    return
-  }
+  %[1]s
   var version = expandVersion(doc);
   var key = version.v.concat(version.code, +new Date(version.date))
-  emit(key, doc.version);
+  emit(%[2]s, %[3]s);
 }`
 
 	betaView = `
 function(doc) {
   ` + viewsHelpers + `
-  if (doc.slug != %q) {
-    return
+  %[1]s
+  var version = expandVersion(doc);
+  var channel = version.channel;
+  if (channel == "beta" || channel == "patch" || channel == "stable") {
+    var key = version.v.concat(version.code, version.exp)
+    emit(%[2]s, %[3]s);
   }
+}`
+
+	patchView = `
+function(doc) {
+  ` + viewsHelpers + `
+  %[1]s
   var version = expandVersion(doc);
   var channel = version.channel;
-  if (channel == "beta" || channel == "stable") {
+  if (channel == "patch" || channel == "stable") {
     var key = version.v.concat(version.code, version.exp)
-    emit(key, doc.version);
+    emit(%[2]s, %[3]s);
   }
 }`
 
 	stableView = `
 function(doc) {
   ` + viewsHelpers + `
-  if (doc.slug != %q) {
-    return
-  }
+  %[1]s
   var version = expandVersion(doc);
   var channel = version.channel;
   if (channel == "stable") {
     var key = version.v;
-    emit(key, doc.version);
+    emit(%[2]s, %[3]s);
   }
 }`
+
+	// maxDateReduce returns the most recent of the dates emitted as values.
+	maxDateReduce = `
+function(keys, values, rereduce) {
+  var max = null;
+  for (var i = 0; i < values.length; i++) {
+    if (values[i] && (max === null || values[i] > max)) {
+      max = values[i];
+    }
+  }
+  return max;
+}`
 )
 
 type view struct {
-	Map string `json:"map"`
+	Map    string `json:"map"`
+	Reduce string `json:"reduce,omitempty"`
+	// Value is the expression of the emitted values, doc.version by default.
+	Value string `json:"-"`
 }
 
+// The versions views are reduced with _count to count the versions of an
+// application without reading them: the other queries must not be reduced.
+// The companion -date views emit the creation dates of the versions, and are
+// reduced to the most recent one.
 var versionsViews = map[string]view{
-	"dev":    {Map: devView},
-	"beta":   {Map: betaView},
-	"stable": {Map: stableView},
+	"dev":         {Map: devView, Reduce: "_count"},
+	"beta":        {Map: betaView, Reduce: "_count"},
+	"patch":       {Map: patchView, Reduce: "_count"},
+	"stable":      {Map: stableView, Reduce: "_count"},
+	"dev-date":    {Map: devView, Reduce: maxDateReduce, Value: "doc.created_at"},
+	"beta-date":   {Map: betaView, Reduce: maxDateReduce, Value: "doc.created_at"},
+	"patch-date":  {Map: patchView, Reduce: maxDateReduce, Value: "doc.created_at"},
+	"stable-date": {Map: stableView, Reduce: maxDateReduce, Value: "doc.created_at"},
 }
 
+// sharedVersViewDocName is the name of the design document of the versions
+// views shared by all the applications, used when SharedVersionsViews is
+// true. Its keys are prefixed by the slug of the applications.
+const sharedVersViewDocName = "shared-versions-v3"
+
+// SharedVersionsViews makes the registry query the versions views shared by
+// all the applications, instead of a design document per application.
+var SharedVersionsViews = false
+
 func versViewDocName(appSlug string) string {
-	return "versions-" + appSlug + "-v1"
+	if SharedVersionsViews {
+		return sharedVersViewDocName
+	}
+	return "versions-" + appSlug + "-v4"
+}
+
+// versViewMap returns the code of the map function of the given view, for the
+// design document of the given application, or for the shared design
+// document if the slug is empty.
+func versViewMap(v view, appSlug string) string {
+	value := v.Value
+	if value == "" {
+		value = "doc.version"
+	}
+	if appSlug == "" {
+		return fmt.Sprintf(v.Map, "if (!doc.slug) {\n    return\n  }", "[doc.slug].concat(key)", value)
+	}
+	filter := fmt.Sprintf("if (doc.slug != %q) {\n    return\n  }", appSlug)
+	return fmt.Sprintf(v.Map, filter, "key", value)
+}
+
+// sharedViewOptions returns the options of a query on the shared versions
+// views, with the keys bounded by the slug of the application.
+func sharedViewOptions(appSlug string, opts map[string]interface{}) map[string]interface{} {
+	low := []interface{}{appSlug}
+	high := []interface{}{appSlug, map[string]interface{}{}}
+	descending, _ := opts["descending"].(bool)
+
+	shared := make(map[string]interface{}, len(opts)+2)
+	for k, v := range opts {
+		shared[k] = v
+	}
+	if key, ok := opts["startkey"].([]interface{}); ok {
+		shared["startkey"] = append([]interface{}{appSlug}, key...)
+	} else if descending {
+		shared["startkey"] = high
+	} else {
+		shared["startkey"] = low
+	}
+	if key, ok := opts["endkey"].([]interface{}); ok {
+		shared["endkey"] = append([]interface{}{appSlug}, key...)
+	} else if descending {
+		shared["endkey"] = low
+	} else {
+		shared["endkey"] = high
+	}
+	return shared
 }
 
 func createVersionsViews(c *Space, appSlug string) error {
+	_, err := ensureVersionsViews(c, appSlug)
+	return err
+}
+
+// ensureVersionsViews writes the design document of the versions views of the
+// given application, unless it already contains the current views. It
+// returns true if the design document has been written.
+func ensureVersionsViews(c *Space, appSlug string) (bool, error) {
+	if SharedVersionsViews {
+		appSlug = ""
+	}
 	ddoc := versViewDocName(appSlug)
-	chttpClient, err := chttp.New(clientURL.String())
+	chttpClient, err := chttp.New(dbClientURL().String())
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	// The current revision of the design document is needed to update it.
 	var object struct {
-		Rev   string `json:"_rev"`
-		Views map[string]view
+		Rev   string          `json:"_rev"`
+		Views map[string]view `json:"views"`
+	}
+	err = c.VersDB().Get(ctx, "_design/"+ddoc).ScanDoc(&object)
+	if err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+		return false, err
+	}
+	if sameVersionsViews(object.Views, appSlug) {
+		return false, nil
 	}
 
 	ddocID := fmt.Sprintf("_design/%s", url.PathEscape(ddoc))
@@ -117,9 +229,14 @@ func createVersionsViews(c *Space, appSlug string) error {
 
 	var viewsBodies []string
 	for name, view := range versionsViews {
-		code := fmt.Sprintf(view.Map, appSlug)
-		viewsBodies = append(viewsBodies,
-			string(sprintfJSON(`%s: {"map": %s}`, name, code)))
+		code := versViewMap(view, appSlug)
+		if view.Reduce != "" {
+			viewsBodies = append(viewsBodies,
+				string(sprintfJSON(`%s: {"map": %s, "reduce": %s}`, name, code, view.Reduce)))
+		} else {
+			viewsBodies = append(viewsBodies,
+				string(sprintfJSON(`%s: {"map": %s}`, name, code)))
+		}
 	}
 
 	viewsBody := `{` + strings.Join(viewsBodies, ",") + `}`
@@ -140,7 +257,195 @@ func createVersionsViews(c *Space, appSlug string) error {
 		Body: ioutil.NopCloser(bytes.NewReader(body)),
 	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	return true, resp.Body.Close()
+}
+
+// sameVersionsViews returns true if the given views of a design document are
+// the current versions views of the application.
+func sameVersionsViews(views map[string]view, appSlug string) bool {
+	if len(views) != len(versionsViews) {
+		return false
+	}
+	for name, v := range versionsViews {
+		existing, ok := views[name]
+		if !ok || existing.Map != versViewMap(v, appSlug) || existing.Reduce != v.Reduce {
+			return false
+		}
+	}
+	return true
+}
+
+// RebuildAllVersionViews rewrites the design documents of the versions views
+// of all the applications of the space whose views are outdated, to migrate
+// them after a change of their code. The up-to-date design documents are
+// skipped, so it can be run again to resume after a failure. It returns the
+// number of design documents written.
+func RebuildAllVersionViews(c *Space) (int, error) {
+	if SharedVersionsViews {
+		written, err := ensureVersionsViews(c, "")
+		if written {
+			return 1, err
+		}
+		return 0, err
+	}
+
+	rows, err := c.AppsDB().AllDocs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var slugs []string
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		slugs = append(slugs, rows.ID())
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i, slug := range slugs {
+		written, err := ensureVersionsViews(c, slug)
+		if err != nil {
+			return count, fmt.Errorf("%s: %s", slug, err)
+		}
+		if written {
+			count++
+		}
+		logrus.WithFields(logrus.Fields{
+			"nspace":  "registry",
+			"space":   c.prefix,
+			"slug":    slug,
+			"written": written,
+		}).Infof("Versions views checked (%d/%d)", i+1, len(slugs))
+	}
+	return count, nil
+}
+
+// versionViewKey returns the key used to index the given version in the view
+// of the specified channel. For the dev view, only the prefix of the key is
+// returned since it also contains the creation date of the version.
+//
+// The before value is true when the version itself is not part of the view,
+// and has a lower precedence than all the versions indexed with this key
+// prefix.
+func versionViewKey(version string, channel Channel) (key []interface{}, before bool) {
+	for _, n := range SplitVersion(version) {
+		i, _ := strconv.Atoi(n)
+		key = append(key, i)
+	}
+
+	code := 0
+	verChannel := GetVersionChannel(version)
+	switch verChannel {
+	case Stable:
+		code = 2
+	case Patch:
+		code = 1
+	}
+
+	switch channel {
+	case Stable:
+		before = verChannel != Stable
+	case Patch:
+		if verChannel != Stable && verChannel != Patch {
+			key = append(key, code)
+			before = true
+		} else {
+			exp, _ := strconv.Atoi(versionPrerelease(version))
+			key = append(key, code, exp)
+		}
+	case Beta:
+		if verChannel == Dev {
+			key = append(key, code)
+			before = true
+		} else {
+			exp, _ := strconv.Atoi(versionPrerelease(version))
+			key = append(key, code, exp)
+		}
+	case Dev:
+		key = append(key, code)
+	default:
+		panic("unreachable")
+	}
+	return
+}
+
+// versionsViewsPrefix is the prefix of the ids of the design documents
+// containing the versions views of the applications.
+const versionsViewsPrefix = "_design/versions-"
+
+// CleanupOrphanViews deletes the design documents of versions views that are
+// not used anymore: the ones of applications that do not exist, and the ones
+// of older versions of the views. When SharedVersionsViews is true, all the
+// design documents per application are deleted. It returns the number of
+// design documents deleted.
+func CleanupOrphanViews(c *Space) (int, error) {
+	apps, err := c.AppsDB().AllDocs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer apps.Close()
+
+	used := make(map[string]bool)
+	for apps.Next() {
+		if strings.HasPrefix(apps.ID(), "_design") {
+			continue
+		}
+		used["_design/"+versViewDocName(apps.ID())] = true
+	}
+	if err = apps.Err(); err != nil {
+		return 0, err
+	}
+
+	db := c.VersDB()
+	rows, err := db.AllDocs(ctx, map[string]interface{}{
+		"startkey": versionsViewsPrefix,
+		"endkey":   versionsViewsPrefix + "\ufff0",
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	orphans := make(map[string]string)
+	for rows.Next() {
+		id := rows.ID()
+		// The versions-index design document is the one of the mango index
+		// of the versions, and must be kept.
+		if id == "_design/versions-index" || used[id] {
+			continue
+		}
+		var value struct {
+			Rev string `json:"rev"`
+		}
+		if err = rows.ScanValue(&value); err != nil {
+			return 0, err
+		}
+		orphans[id] = value.Rev
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for id, rev := range orphans {
+		if _, err = db.Delete(ctx, id, rev); err != nil {
+			if kivik.StatusCode(err) == http.StatusNotFound {
+				continue
+			}
+			return count, err
+		}
+		count++
+	}
+
+	if count > 0 {
+		err = db.ViewCleanup(ctx)
 	}
-	return resp.Body.Close()
+	return count, err
 }
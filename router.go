@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -21,8 +22,6 @@ import (
 
 	"github.com/cozy/echo"
 	"github.com/cozy/echo/middleware"
-
-	"github.com/go-kivik/kivik"
 )
 
 const RegistryVersion = "0.1.0"
@@ -44,7 +43,7 @@ func createApp(c echo.Context) (err error) {
 	}
 
 	opts := &registry.AppOptions{}
-	if err = c.Bind(opts); err != nil {
+	if err = bindPublish(c, opts); err != nil {
 		return err
 	}
 
@@ -61,6 +60,7 @@ func createApp(c echo.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	writeAudit(c, editor.Name(), registry.AuditCreateApp, app.Slug, "")
 
 	cleanApp(app)
 
@@ -78,12 +78,12 @@ func patchApp(c echo.Context) (err error) {
 	}
 
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	app, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return err
 	}
 
-	_, err = checkPermissions(c, app.Editor, "", true /* = master */)
+	editor, err := checkPermissions(c, app.Editor, "", true /* = master */)
 	if err != nil {
 		return errshttp.NewError(http.StatusUnauthorized, err.Error())
 	}
@@ -92,6 +92,7 @@ func patchApp(c echo.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	writeAudit(c, editor.Name(), registry.AuditUpdateApp, app.Slug, "")
 
 	cleanApp(app)
 
@@ -103,17 +104,120 @@ func cleanVersion(version *registry.Version) {
 	version.ID = ""
 	version.Rev = ""
 	version.Attachments = nil
+	version.TruncateDates()
 }
 
 // Do not show internal identifier and revision
 func cleanApp(app *registry.App) {
 	app.ID = ""
 	app.Rev = ""
+	app.TruncateDates()
 	if app.LatestVersion != nil {
 		cleanVersion(app.LatestVersion)
 	}
 }
 
+// bindPublish binds the body of a publication request, rejecting the unknown
+// fields if the registry is configured to be strict.
+func bindPublish(c echo.Context, opts interface{}) error {
+	if !registry.StrictPublish {
+		return c.Bind(opts)
+	}
+	return registry.DecodeStrict(c.Request().Body, opts)
+}
+
+// writeAudit records the action of the editor in the audit log. The action
+// has already been done, so a failure is only logged.
+func writeAudit(c echo.Context, editorName, action, slug, version string) {
+	err := registry.WriteEditorAudit(getSpace(c), &registry.EditorAudit{
+		Editor:   editorName,
+		Action:   action,
+		Slug:     slug,
+		Version:  version,
+		ClientIP: clientIP(c.Request()),
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"nspace":  "audit",
+			"editor":  editorName,
+			"action":  action,
+			"slug":    slug,
+			"version": version,
+		}).Errorf("Could not write the audit log: %s", err)
+	}
+}
+
+// trustedProxies are the networks of the reverse proxies whose X-Forwarded-For
+// and X-Real-IP headers are trusted to find the IP address of the clients.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the given IP addresses and CIDR networks of the
+// trusted reverse proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q: %s", proxy, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of the request. The headers
+// set by the reverse proxies are only read when the request comes from a
+// trusted proxy, as they can be forged by the clients otherwise.
+func clientIP(req *http.Request) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+	// The addresses are appended by each proxy: the client is the last one
+	// that has not been added by a trusted proxy.
+	if xff := req.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+		ips := strings.Split(xff, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if i == 0 || !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	if ip := req.Header.Get(echo.HeaderXRealIP); ip != "" {
+		return ip
+	}
+	return remote
+}
+
 func checkAuthorized(c echo.Context) error {
 	token, err := extractAuthHeader(c)
 	if err != nil {
@@ -130,14 +234,16 @@ func createVersion(c echo.Context) (err error) {
 		return err
 	}
 
+	// The versions of the archived applications can still be published, for
+	// the existing installations.
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	app, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return err
 	}
 
 	opts := &registry.VersionOptions{}
-	if err = c.Bind(opts); err != nil {
+	if err = bindPublish(c, opts); err != nil {
 		return err
 	}
 	opts.Version = stripVersion(opts.Version)
@@ -151,7 +257,15 @@ func createVersion(c echo.Context) (err error) {
 		return err
 	}
 
-	_, err = registry.FindVersion(getSpace(c), appSlug, opts.Version)
+	if err = registry.VerifyVersionSignature(editor, opts); err != nil {
+		return err
+	}
+
+	if err = registry.CheckPublishRate(editor.Name()); err != nil {
+		return err
+	}
+
+	_, err = registry.FindVersion(c.Request().Context(), getSpace(c), appSlug, opts.Version)
 	if err == nil {
 		return registry.ErrVersionAlreadyExists
 	}
@@ -159,7 +273,7 @@ func createVersion(c echo.Context) (err error) {
 		return err
 	}
 
-	ver, attachments, err := registry.DownloadVersion(opts)
+	ver, attachments, err := registry.DownloadVersion(c.Request().Context(), getSpace(c), opts)
 	if err != nil {
 		return err
 	}
@@ -172,6 +286,7 @@ func createVersion(c echo.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	writeAudit(c, editor.Name(), registry.AuditCreateVersion, ver.Slug, ver.Version)
 
 	cleanVersion(ver)
 	return c.JSON(http.StatusCreated, ver)
@@ -218,21 +333,12 @@ func approvePendingVersion(c echo.Context) (err error) {
 	}
 
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
-	if err != nil {
-		return err
-	}
-
 	ver := stripVersion(c.Param("version"))
-	version, err := registry.FindPendingVersion(getSpace(c), appSlug, ver)
+	version, err := registry.PublishPendingVersion(getSpace(c), appSlug, ver)
 	if err != nil {
 		return err
 	}
 
-	if version, err = registry.ApprovePendingVersion(getSpace(c), version, app); err != nil {
-		return err
-	}
-
 	cleanVersion(version)
 
 	return c.JSON(http.StatusCreated, version)
@@ -243,6 +349,9 @@ func getMaintenanceApps(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	for _, app := range apps {
+		app.TruncateDates()
+	}
 	return writeJSON(c, apps)
 }
 
@@ -252,7 +361,7 @@ func activateMaintenanceApp(c echo.Context) (err error) {
 	}
 
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	app, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return
 	}
@@ -281,7 +390,7 @@ func deactivateMaintenanceApp(c echo.Context) (err error) {
 	}
 
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	app, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return
 	}
@@ -348,7 +457,8 @@ func extractAuthHeader(c echo.Context) ([]byte, error) {
 func getAppsList(c echo.Context) error {
 	var filter map[string]string
 	var limit, cursor int
-	var sort string
+	var sort, search, compatibleWith, locale, token string
+	var withTotal, reverse, summary, featuredFirst bool
 	var err error
 	latestVersionChannel := registry.Stable
 	versionsChannel := registry.Dev
@@ -369,6 +479,38 @@ func getAppsList(c echo.Context) error {
 			}
 		case "sort":
 			sort = val
+		case "token":
+			token = val
+		case "search":
+			search = val
+		case "compatibleWith":
+			compatibleWith = val
+		case "locale":
+			locale = val
+		case "reverse":
+			reverse, err = strconv.ParseBool(val)
+			if err != nil {
+				return errshttp.NewError(http.StatusBadRequest,
+					`Query param "reverse" is invalid: %s`, err)
+			}
+		case "total":
+			withTotal, err = strconv.ParseBool(val)
+			if err != nil {
+				return errshttp.NewError(http.StatusBadRequest,
+					`Query param "total" is invalid: %s`, err)
+			}
+		case "summary":
+			summary, err = strconv.ParseBool(val)
+			if err != nil {
+				return errshttp.NewError(http.StatusBadRequest,
+					`Query param "summary" is invalid: %s`, err)
+			}
+		case "featuredFirst":
+			featuredFirst, err = strconv.ParseBool(val)
+			if err != nil {
+				return errshttp.NewError(http.StatusBadRequest,
+					`Query param "featuredFirst" is invalid: %s`, err)
+			}
 		case "latestChannelVersion":
 			latestVersionChannel, err = registry.StrToChannel(val)
 			if err != nil {
@@ -394,29 +536,55 @@ func getAppsList(c echo.Context) error {
 		}
 	}
 
-	next, apps, err := registry.GetAppsList(getSpace(c), &registry.AppsListOptions{
+	// The full maps of the names and descriptions are returned by default:
+	// the locale is only read from the Accept-Language header when asked
+	// for with locale=auto.
+	if locale == "auto" {
+		c.Response().Header().Add("vary", "accept-language")
+		locale = preferredLanguage(c.Request().Header.Get("accept-language"))
+	}
+
+	opts := &registry.AppsListOptions{
 		Filters:              filter,
 		Limit:                limit,
 		Cursor:               cursor,
+		Token:                token,
 		Sort:                 sort,
 		LatestVersionChannel: latestVersionChannel,
 		VersionsChannel:      versionsChannel,
-	})
+		Search:               search,
+		WithTotal:            withTotal,
+		Reverse:              reverse,
+		SummaryOnly:          summary,
+		CompatibleWith:       compatibleWith,
+		Locale:               locale,
+		FeaturedFirst:        featuredFirst,
+		IfNoneMatch:          c.Request().Header.Get("if-none-match"),
+	}
+	next, apps, err := registry.GetAppsList(c.Request().Context(), getSpace(c), opts)
 	if err != nil {
 		return err
 	}
 
+	c.Response().Header().Set("etag", opts.ETag)
+	if opts.NotModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	for _, app := range apps {
 		cleanApp(app)
 	}
 
 	type pageInfo struct {
 		Count      int    `json:"count"`
+		Total      *int   `json:"total,omitempty"`
 		NextCursor string `json:"next_cursor,omitempty"`
+		NextToken  string `json:"next_token,omitempty"`
 	}
 
+	// The int cursor is meaningless when paginating with a token.
 	var nextCursor string
-	if next >= 0 {
+	if next >= 0 && token == "" {
 		nextCursor = strconv.Itoa(next)
 	}
 
@@ -428,15 +596,19 @@ func getAppsList(c echo.Context) error {
 		PageInfo: pageInfo{
 			Count:      len(apps),
 			NextCursor: nextCursor,
+			NextToken:  opts.NextToken,
 		},
 	}
+	if withTotal {
+		j.PageInfo.Total = &opts.Total
+	}
 
 	return writeJSON(c, j)
 }
 
 func getApp(c echo.Context) error {
 	appSlug := c.Param("app")
-	app, err := registry.FindApp(getSpace(c), appSlug, getVersionsChannel(c, registry.Dev))
+	app, err := registry.FindApp(c.Request().Context(), getSpace(c), appSlug, getVersionsChannel(c, registry.Dev))
 	if err != nil {
 		return err
 	}
@@ -450,6 +622,20 @@ func getApp(c echo.Context) error {
 	return writeJSON(c, app)
 }
 
+// headApp tells if the application exists, with the same status as getApp,
+// but only fetches the document of the application, not its versions.
+func headApp(c echo.Context) error {
+	app, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), c.Param("app"))
+	if err != nil {
+		return err
+	}
+	if err = registry.ArchivedAppError(app); err != nil {
+		return err
+	}
+	c.Response().Header().Set("cache-control", "no-cache")
+	return c.NoContent(http.StatusOK)
+}
+
 func getAppIcon(c echo.Context) error {
 	return getAppAttachment(c, "icon")
 }
@@ -469,12 +655,12 @@ func getAppAttachment(c echo.Context, filename string) error {
 	appSlug := c.Param("app")
 	channel := c.Param("channel")
 
-	var att *kivik.Attachment
+	var att *registry.Attachment
 	{
 		if channel == "" {
 			var err error
-			for _, ch := range []registry.Channel{registry.Stable, registry.Beta, registry.Dev} {
-				att, err = registry.FindAppAttachment(getSpace(c), appSlug, filename, ch)
+			for _, ch := range []registry.Channel{registry.Stable, registry.Patch, registry.Beta, registry.Dev} {
+				att, err = registry.FindAppAttachment(c.Request().Context(), getSpace(c), appSlug, filename, ch)
 				if err == nil {
 					break
 				}
@@ -490,7 +676,7 @@ func getAppAttachment(c echo.Context, filename string) error {
 			if err != nil {
 				ch = registry.Stable
 			}
-			att, err = registry.FindAppAttachment(getSpace(c), appSlug, filename, ch)
+			att, err = registry.FindAppAttachment(c.Request().Context(), getSpace(c), appSlug, filename, ch)
 			if err != nil {
 				return err
 			}
@@ -498,15 +684,12 @@ func getAppAttachment(c echo.Context, filename string) error {
 		defer att.Content.Close()
 	}
 
-	if cacheControl(c, att.Digest, oneHour) {
+	if cacheControl(c, att.ETag, oneHour) || notModifiedSince(c, att.LastModified) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
 	contentType := att.ContentType
-	// force image/svg content-type for svg assets that start with <?xml
-	if filename == "icon" && contentType == "text/xml" {
-		contentType = "image/svg+xml"
-	}
+	setAttachmentHeaders(c, att, filename)
 
 	if c.Request().Method == http.MethodHead {
 		c.Response().Header().Set(echo.HeaderContentType, contentType)
@@ -533,20 +716,17 @@ func getVersionScreenshot(c echo.Context) error {
 func getVersionAttachment(c echo.Context, filename string) error {
 	appSlug := c.Param("app")
 	version := c.Param("version")
-	att, err := registry.FindVersionAttachment(getSpace(c), appSlug, version, filename)
+	att, err := registry.FindVersionAttachment(c.Request().Context(), getSpace(c), appSlug, version, filename)
 	if err != nil {
 		return err
 	}
 	defer att.Content.Close()
 
 	contentType := att.ContentType
-	// force image/svg content-type for svg assets that start with <?xml
-	if filename == "icon" && contentType == "text/xml" {
-		contentType = "image/svg+xml"
-	}
+	setAttachmentHeaders(c, att, filename)
 
 	c.Response().Header().Set(echo.HeaderContentType, contentType)
-	if cacheControl(c, att.Digest, oneHour) {
+	if cacheControl(c, att.ETag, oneHour) || notModifiedSince(c, att.LastModified) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
@@ -556,9 +736,62 @@ func getVersionAttachment(c echo.Context, filename string) error {
 	return c.Stream(http.StatusOK, contentType, att.Content)
 }
 
+// setAttachmentHeaders prevents the browsers from sniffing the type of the
+// attachments, and makes them download the attachments whose type is not
+// allowed instead of displaying them. The SVG images can embed scripts: they
+// are also downloaded when opened directly, and sandboxed by a content
+// security policy. They are still displayed in an <img> tag.
+func setAttachmentHeaders(c echo.Context, att *registry.Attachment, filename string) {
+	headers := c.Response().Header()
+	headers.Set("x-content-type-options", "nosniff")
+	headers.Set("content-security-policy", "default-src 'none'; sandbox")
+	if att.Download || strings.EqualFold(att.ContentType, "image/svg+xml") {
+		headers.Set("content-disposition",
+			fmt.Sprintf("attachment; filename=%q", path.Base(filename)))
+	}
+}
+
+func getVersionTarball(c echo.Context) error {
+	appSlug := c.Param("app")
+	version := stripVersion(c.Param("version"))
+	tarball, contentType, size, err := registry.GetVersionTarball(c.Request().Context(), getSpace(c), appSlug, version)
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+
+	if size >= 0 {
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+	}
+	if c.Request().Method == http.MethodHead {
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		return c.NoContent(http.StatusOK)
+	}
+	// The download is only counted once the whole tarball has been sent.
+	if err = c.Stream(http.StatusOK, contentType, tarball); err != nil {
+		return err
+	}
+	registry.IncrementVersionDownloads(getSpace(c), appSlug, version)
+	return nil
+}
+
+func getVersionDownloads(c echo.Context) error {
+	appSlug := c.Param("app")
+	version := stripVersion(c.Param("version"))
+	if _, err := registry.FindVersion(c.Request().Context(), getSpace(c), appSlug, version); err != nil {
+		return err
+	}
+	count, err := registry.GetVersionDownloads(getSpace(c), appSlug, version)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("cache-control", "no-cache")
+	return writeJSON(c, echo.Map{"downloads": count})
+}
+
 func getAppVersions(c echo.Context) error {
 	appSlug := c.Param("app")
-	versions, err := registry.FindAppVersions(getSpace(c), appSlug, getVersionsChannel(c, registry.Dev))
+	versions, err := registry.FindAppVersions(c.Request().Context(), getSpace(c), appSlug, getVersionsChannel(c, registry.Dev))
 	if err != nil {
 		return err
 	}
@@ -573,24 +806,21 @@ func getAppVersions(c echo.Context) error {
 func getVersion(c echo.Context) error {
 	appSlug := c.Param("app")
 	version := stripVersion(c.Param("version"))
-	_, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	_, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return err
 	}
 
-	doc, err := registry.FindPublishedVersion(getSpace(c), appSlug, version)
+	doc, err := registry.FindPublishedVersion(c.Request().Context(), getSpace(c), appSlug, version)
 	if err != nil {
 		return err
 	}
 
-	if cacheControl(c, doc.Rev, oneYear) {
+	if versionCacheControl(c, doc) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
-	// Do not show internal identifier and revision
-	doc.ID = ""
-	doc.Rev = ""
-	doc.Attachments = nil
+	cleanVersion(doc)
 
 	return writeJSON(c, doc)
 }
@@ -598,7 +828,7 @@ func getVersion(c echo.Context) error {
 func getLatestVersion(c echo.Context) error {
 	appSlug := c.Param("app")
 	channel := c.Param("channel")
-	_, err := registry.FindApp(getSpace(c), appSlug, registry.Stable)
+	_, err := registry.FindAppMeta(c.Request().Context(), getSpace(c), appSlug)
 	if err != nil {
 		return err
 	}
@@ -607,12 +837,15 @@ func getLatestVersion(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	version, err := registry.FindLatestVersion(getSpace(c), appSlug, ch)
+	version, err := registry.FindLatestVersion(c.Request().Context(), getSpace(c), appSlug, ch)
 	if err != nil {
 		return err
 	}
 
-	if cacheControl(c, version.Rev, fiveMinute) {
+	// The latest version changes with each release: it must be revalidated,
+	// which is cheap thanks to the etag.
+	c.Response().Header().Set("cache-control", "no-cache")
+	if etagMatches(c, version.Rev) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
@@ -621,6 +854,129 @@ func getLatestVersion(c echo.Context) error {
 	return writeJSON(c, version)
 }
 
+// checkEditorMasterToken verifies that the request is authenticated with the
+// master token of the given editor itself. The master token of another editor
+// is not accepted.
+func checkEditorMasterToken(c echo.Context, editorName string) (*auth.Editor, error) {
+	if err := checkAuthorized(c); err != nil {
+		return nil, err
+	}
+	token, err := extractAuthHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	editor, err := editorRegistry.GetEditor(editorName)
+	if err != nil {
+		return nil, errshttp.NewError(http.StatusUnauthorized, "Could not find editor: %s", editorName)
+	}
+	if !editor.VerifyMasterToken(sessionSecret, token) {
+		return nil, errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
+	}
+	return editor, nil
+}
+
+// adminEditors are the editors whose master token gives access to the
+// endpoints reserved to the operators of the registry, like the statistics of
+// the spaces.
+var adminEditors []string
+
+// checkAdminToken verifies that the request is authenticated with the master
+// token of one of the admin editors, given in the query parameters.
+func checkAdminToken(c echo.Context) error {
+	editorName := c.QueryParam("editor")
+	if _, err := checkEditorMasterToken(c, editorName); err != nil {
+		return err
+	}
+	for _, name := range adminEditors {
+		if strings.EqualFold(name, editorName) {
+			return nil
+		}
+	}
+	return errshttp.NewError(http.StatusForbidden, "Editor %q is not an administrator of the registry", editorName)
+}
+
+func getSpacesList(c echo.Context) error {
+	if err := checkAdminToken(c); err != nil {
+		return err
+	}
+
+	spaces := registry.ListSpaces()
+	list := make([]*registry.SpaceStats, 0, len(spaces))
+	for _, space := range spaces {
+		stats, err := registry.SpaceInfo(space)
+		if err != nil {
+			return err
+		}
+		list = append(list, stats)
+	}
+	return writeJSON(c, list)
+}
+
+func getSpaceInfo(c echo.Context) error {
+	if err := checkAdminToken(c); err != nil {
+		return err
+	}
+
+	name := c.Param("space")
+	if name == "__default__" {
+		name = ""
+	}
+	space, ok := registry.GetSpace(name)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Space %q does not exist", name))
+	}
+	stats, err := registry.SpaceInfo(space)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, stats)
+}
+
+// getAuditLog returns the entries of the audit log of the authenticated
+// editor only, as they contain the IP addresses of its clients.
+func getAuditLog(c echo.Context) error {
+	editor, err := checkEditorMasterToken(c, c.QueryParam("editor"))
+	if err != nil {
+		return err
+	}
+
+	name := c.Param("space")
+	if name == "__default__" {
+		name = ""
+	}
+	space, ok := registry.GetSpace(name)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Space %q does not exist", name))
+	}
+
+	opts := registry.AuditFilter{
+		Editor: editor.Name(),
+		Slug:   c.QueryParam("filter[slug]"),
+	}
+	if since := c.QueryParam("since"); since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid since date: %s", err)
+		}
+	}
+	if until := c.QueryParam("until"); until != "" {
+		if opts.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid until date: %s", err)
+		}
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid limit: %s", err)
+		}
+	}
+
+	entries, err := registry.GetAuditLog(space, opts)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("cache-control", "no-cache")
+	return writeJSON(c, entries)
+}
+
 func getEditor(c echo.Context) error {
 	editorName := c.Param("editor")
 	editor, err := editorRegistry.GetEditor(editorName)
@@ -685,6 +1041,32 @@ func getSpace(c echo.Context) *registry.Space {
 	return c.Get(spaceKey).(*registry.Space)
 }
 
+// preferredLanguage returns the language with the highest quality in the
+// given Accept-Language header, or the empty string if there is none.
+func preferredLanguage(acceptLanguage string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
 func getVersionsChannel(c echo.Context, defaultChannel registry.Channel) registry.Channel {
 	queryParam := c.QueryParam("versionsChannel")
 	if queryParam == "" {
@@ -713,8 +1095,10 @@ func validateVersionRequest(c echo.Context, ver *registry.VersionOptions) error
 
 func httpErrorHandler(err error, c echo.Context) {
 	var (
-		code = http.StatusInternalServerError
-		msg  string
+		code       = http.StatusInternalServerError
+		msg        string
+		fields     map[string]string
+		replacedBy string
 	)
 
 	isJSON, _ := c.Get("json").(bool)
@@ -722,6 +1106,14 @@ func httpErrorHandler(err error, c echo.Context) {
 	if he, ok := err.(*errshttp.Error); ok {
 		code = he.StatusCode()
 		msg = err.Error()
+	} else if ve, ok := err.(*registry.ValidationError); ok {
+		code = http.StatusBadRequest
+		msg = err.Error()
+		fields = ve.Fields
+	} else if ae, ok := err.(*registry.AppArchivedError); ok {
+		code = ae.StatusCode()
+		msg = err.Error()
+		replacedBy = ae.ReplacedBy
 	} else if he, ok := err.(*echo.HTTPError); ok {
 		code = he.Code
 		msg = fmt.Sprintf("%s", he.Message)
@@ -734,7 +1126,11 @@ func httpErrorHandler(err error, c echo.Context) {
 	case registry.ErrVersionNotFound, registry.ErrAppNotFound:
 		respHeaders.Set("cache-control", "max-age=60")
 	default:
-		respHeaders.Set("cache-control", "no-cache")
+		if code == http.StatusGone {
+			respHeaders.Set("cache-control", "max-age=60")
+		} else {
+			respHeaders.Set("cache-control", "no-cache")
+		}
 	}
 
 	log := logrus.WithFields(logrus.Fields{
@@ -758,7 +1154,14 @@ func httpErrorHandler(err error, c echo.Context) {
 				c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 				c.NoContent(code)
 			} else {
-				c.JSON(code, echo.Map{"error": msg})
+				body := echo.Map{"error": msg}
+				if fields != nil {
+					body["fields"] = fields
+				}
+				if replacedBy != "" {
+					body["replaced_by"] = replacedBy
+				}
+				c.JSON(code, body)
 			}
 		} else {
 			if c.Request().Method == echo.HEAD {
@@ -778,12 +1181,35 @@ func wrapErr(err error, code int) error {
 	if errHTTP, ok := err.(*errshttp.Error); ok {
 		return errHTTP
 	}
+	if errValidation, ok := err.(*registry.ValidationError); ok {
+		return errValidation
+	}
 	return errshttp.NewError(code, err.Error())
 }
 
 func cacheControl(c echo.Context, rev string, maxAge time.Duration) bool {
 	headers := c.Response().Header()
 	headers.Set("cache-control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	return etagMatches(c, rev)
+}
+
+// versionCacheControl sets the caching headers of a version: a published
+// version never changes and can be cached forever by the CDN, while a pending
+// one must be revalidated.
+func versionCacheControl(c echo.Context, ver *registry.Version) bool {
+	headers := c.Response().Header()
+	if ver.IsImmutable() {
+		headers.Set("cache-control", fmt.Sprintf("public, max-age=%d, immutable", int(oneYear.Seconds())))
+	} else {
+		headers.Set("cache-control", "no-cache")
+	}
+	return etagMatches(c, ver.Rev)
+}
+
+// etagMatches sets the date and etag headers, and returns true if the etag
+// matches the if-none-match header of the request.
+func etagMatches(c echo.Context, rev string) bool {
+	headers := c.Response().Header()
 	headers.Set("date", time.Now().UTC().Format(http.TimeFormat))
 
 	if rev != "" {
@@ -799,6 +1225,27 @@ func cacheControl(c echo.Context, rev string, maxAge time.Duration) bool {
 	return false
 }
 
+// notModifiedSince sets the last-modified header, and returns true if the
+// resource has not been modified since the date given in the
+// if-modified-since header. As the etag is more precise, this header is
+// ignored when an if-none-match header is present.
+func notModifiedSince(c echo.Context, modtime time.Time) bool {
+	if modtime.IsZero() {
+		return false
+	}
+	c.Response().Header().Set("last-modified", modtime.UTC().Format(http.TimeFormat))
+
+	req := c.Request()
+	if req.Header.Get("if-none-match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("if-modified-since"))
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(since)
+}
+
 // stripVersion removes the 'v' prefix if any.
 // ex: v1.3.2 -> 1.3.2
 func stripVersion(v string) string {
@@ -838,7 +1285,7 @@ func Router(addr string) *echo.Echo {
 	e.Use(middleware.Gzip())
 	e.Use(middleware.Recover())
 
-	for _, c := range registry.GetSpacesNames() {
+	for _, c := range registry.Spaces() {
 		var groupName string
 		if c == "" {
 			groupName = "/registry"
@@ -861,7 +1308,7 @@ func Router(addr string) *echo.Echo {
 		g.PUT("/maintenance/:app/activate", activateMaintenanceApp, jsonEndpoint)
 		g.PUT("/maintenance/:app/deactivate", deactivateMaintenanceApp)
 
-		g.HEAD("/:app", getApp, jsonEndpoint)
+		g.HEAD("/:app", headApp, jsonEndpoint)
 		g.GET("/:app", getApp, jsonEndpoint)
 		g.GET("/:app/versions", getAppVersions, jsonEndpoint)
 		g.HEAD("/:app/:version", getVersion, jsonEndpoint)
@@ -881,8 +1328,15 @@ func Router(addr string) *echo.Echo {
 		g.GET("/:app/:version/icon", getVersionIcon)
 		g.HEAD("/:app/:version/screenshots/*", getVersionScreenshot)
 		g.GET("/:app/:version/screenshots/*", getVersionScreenshot)
+		g.HEAD("/:app/:version/tarball", getVersionTarball)
+		g.GET("/:app/:version/tarball", getVersionTarball)
+		g.GET("/:app/:version/downloads", getVersionDownloads, jsonEndpoint)
 	}
 
+	e.GET("/spaces", getSpacesList, jsonEndpoint)
+	e.GET("/spaces/:space", getSpaceInfo, jsonEndpoint)
+	e.GET("/spaces/:space/audit", getAuditLog, jsonEndpoint)
+
 	e.GET("/editors", getEditorsList, jsonEndpoint)
 	e.HEAD("/editors/:editor", getEditor, jsonEndpoint)
 	e.GET("/editors/:editor", getEditor, jsonEndpoint)